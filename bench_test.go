@@ -0,0 +1,100 @@
+package plugger_test
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/romshark/plugger"
+	"github.com/romshark/plugger/pluggertest"
+)
+
+func BenchmarkCall(b *testing.B) {
+	h := plugger.NewHost()
+	f := pluggertest.MakeModule(b, "bench_call", "testdata/t1_plugin_main.go.txt")
+	go func() { _ = h.RunPlugin(b.Context(), f, nil, plugger.WithStderr(io.Discard)) }()
+	b.Cleanup(func() { _ = h.Close() })
+	// Wait for the plugin to start.
+	if _, err := plugger.Call[AddReq, AddResp](
+		b.Context(), h, "add", AddReq{},
+	); err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			resp, err := plugger.Call[AddReq, AddResp](
+				b.Context(), h, "add", AddReq{A: 2, B: 3},
+			)
+			if err != nil {
+				b.Errorf("unexpected error: %v", err)
+				return
+			}
+			if resp.Sum != 5 {
+				b.Errorf("unexpected sum: %d", resp.Sum)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkCallBuffering(b *testing.B) {
+	for _, payload := range []struct {
+		name string
+		size int
+	}{{"small", 16}, {"large", 256 << 10}} {
+		for _, size := range []int{0, 64 << 10} {
+			name := fmt.Sprintf("%s/buffer_%d", payload.name, size)
+			b.Run(name, func(b *testing.B) {
+				benchmarkCallBuffering(b, strings.Repeat("x", payload.size), size)
+			})
+		}
+	}
+}
+
+// benchmarkCallBuffering benchmarks echoing req with all read and write
+// buffers of size bytes, or with the defaults if size is zero.
+func benchmarkCallBuffering(b *testing.B, req string, size int) {
+	var opts []plugger.RunOption
+	if size != 0 {
+		b.Setenv("TEST_BUFFER_SIZE", strconv.Itoa(size))
+		opts = append(opts,
+			plugger.WithReadBufferSize(size),
+			plugger.WithWriteBuffer(100*time.Microsecond),
+			plugger.WithWriteBufferSize(size))
+	}
+	h := plugger.NewHost()
+	f := pluggertest.MakeModule(b, "bench_call_buffering",
+		"testdata/tbuffer_plugin_main.go.txt")
+	go func() {
+		_ = h.RunPlugin(b.Context(), f, nil,
+			append(opts, plugger.WithStderr(io.Discard))...)
+	}()
+	b.Cleanup(func() { _ = h.Close() })
+	// Wait for the plugin to start.
+	if _, err := plugger.Call[string, string](b.Context(), h, "echo", ""); err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(req)))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			resp, err := plugger.Call[string, string](b.Context(), h, "echo", req)
+			if err != nil {
+				b.Errorf("unexpected error: %v", err)
+				return
+			}
+			if len(resp) != len(req) {
+				b.Errorf("unexpected response of %d bytes", len(resp))
+				return
+			}
+		}
+	})
+}
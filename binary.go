@@ -0,0 +1,139 @@
+package plugger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// frameBinary starts a binary frame, which no JSON value starts with.
+// The byte is followed by the envelope as a line of JSON whose "binary"
+// field is the length of the raw data following the line.
+// Binary frames are only sent to hosts supporting FeatureBinaryFrames.
+const frameBinary = 'b'
+
+// maxBinaryFrame is the maximum length of the data of a binary frame,
+// which limits what the host allocates for a frame. Larger writes are
+// split into multiple stream items.
+const maxBinaryFrame = 1 << 20
+
+// binaryChunk is a stream item of raw data, see HandleBinaryStream.
+// It's sent as a base64 string to hosts not supporting binary frames.
+type binaryChunk []byte
+
+// CallBinaryStream sends a typed request to a streaming endpoint
+// registered with HandleBinaryStream. The streamed data is read from
+// the returned reader, which returns io.EOF once the stream ended.
+// The returned function blocks until the stream ended and returns
+// the final summary or the error that terminated the stream.
+// Closing the reader before the end of the stream aborts the stream.
+// The data is sent in binary frames avoiding the base64 overhead of JSON
+// if the plugin supports FeatureBinaryFrames.
+func CallBinaryStream[Req, Summary any](
+	ctx context.Context, h *Host, method string, req Req, opts ...CallOption,
+) (io.ReadCloser, func() (Summary, error)) {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	var summary Summary
+	var err error
+
+	raw, errMarshal := marshal(req)
+	if errMarshal != nil {
+		err = fmt.Errorf("marshaling request: %w", errMarshal)
+		_ = pw.CloseWithError(err)
+		return pr, func() (Summary, error) { return summary, err }
+	}
+
+	go func() {
+		defer close(done)
+		// Unblock writes once the caller stopped reading.
+		stop := context.AfterFunc(ctx, func() {
+			_ = pw.CloseWithError(causeErr(ctx))
+		})
+		defer stop()
+		write := func(b []byte) error {
+			_, err := pw.Write(b)
+			return err
+		}
+		c := newCallConfig(opts)
+		c.onBinary = write
+		var resp envelope
+		resp, err = h.call(ctx, method, raw, c, func(raw json.RawMessage) error {
+			var b []byte // Sent base64 encoded without binary frames.
+			if err := json.Unmarshal(raw, &b); err != nil {
+				return fmt.Errorf("%w: %w", ErrMalformedResponse, err)
+			}
+			return write(b)
+		})
+		if err == nil {
+			errUnmarshal := unmarshal(resp.Data, &summary, h.useNumber.Load())
+			if errUnmarshal != nil {
+				err = fmt.Errorf("%w: %w", ErrMalformedResponse, errUnmarshal)
+			}
+		}
+		_ = pw.CloseWithError(err) // io.EOF if nil.
+	}()
+
+	return pr, func() (Summary, error) {
+		<-done
+		return summary, err
+	}
+}
+
+// HandleBinaryStream registers a streaming RPC endpoint of raw data
+// overwriting any existing endpoint. fn writes the data to w and returns
+// the final summary once done. Every write is sent as a stream item,
+// or as several items of up to 1 MiB if larger, so avoid small writes.
+// w returns an error if the request was canceled and must not be used
+// after fn returns.
+// Must be used before Run is invoked!
+func HandleBinaryStream[Req, Summary any](
+	p *Plugin,
+	name string,
+	fn func(ctx context.Context, req Req, w io.Writer) (Summary, error),
+) {
+	p.handle(name, func(
+		ctx context.Context, _ RequestMeta, raw json.RawMessage,
+		emit func(any) error,
+	) (any, error) {
+		var req Req
+		if err := unmarshal(raw, &req, p.useNumber); err != nil {
+			var zero Summary
+			return zero, err
+		}
+		return fn(ctx, req, emitWriter(emit))
+	})
+}
+
+// emitWriter sends writes as binary stream items.
+type emitWriter func(any) error
+
+func (w emitWriter) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		chunk := b[:min(len(b), maxBinaryFrame)]
+		if err := w(binaryChunk(chunk)); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+// writeBinary sends data as a binary frame of the stream of request id.
+func (p *Plugin) writeBinary(id string, data []byte) error {
+	header, err := json.Marshal(envelope{ID: id, Chunk: true, Binary: len(data)})
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 0, 2+len(header)+len(data))
+	frame = append(frame, frameBinary)
+	frame = append(frame, header...)
+	frame = append(frame, '\n')
+	frame = append(frame, data...)
+	p.lockEnc.Lock()
+	defer p.lockEnc.Unlock()
+	_, err = p.w.Write(frame) // A single write, see flushWriter.
+	return err
+}
@@ -0,0 +1,12 @@
+//go:build !plan9
+
+package plugger
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isBrokenPipe reports whether err is a write to a pipe
+// no longer read from.
+func isBrokenPipe(err error) bool { return errors.Is(err, syscall.EPIPE) }
@@ -0,0 +1,5 @@
+package plugger
+
+// isBrokenPipe reports whether err is a write to a pipe
+// no longer read from, which Plan 9 has no error for.
+func isBrokenPipe(error) bool { return false }
@@ -0,0 +1,139 @@
+package plugger
+
+import (
+	"context"
+	"sync"
+)
+
+// SetMaxBufferedBytes bounds the total size of response data and logs
+// received from the plugin but not yet received by callers, across all
+// calls and streams. Once n is exceeded the loop reading responses
+// waits until callers catch up, applying backpressure to the plugin,
+// which stalls all other calls just like a full receive buffer
+// (see WithReceiveBuffer). A single envelope larger than n is admitted
+// once nothing else is buffered. n <= 0 removes the limit, which is
+// the default. Cached responses are bounded by EnableCache instead.
+func (h *Host) SetMaxBufferedBytes(n int64) {
+	h.buffered.lock.Lock()
+	defer h.buffered.lock.Unlock()
+	h.buffered.max = n
+	h.buffered.notify() // The limit may have been raised.
+}
+
+// BufferedBytes returns the size of response data and logs currently
+// buffered for callers, see SetMaxBufferedBytes.
+func (h *Host) BufferedBytes() int64 {
+	h.buffered.lock.Lock()
+	defer h.buffered.lock.Unlock()
+	return h.buffered.n
+}
+
+// bufferBudget accounts for the bytes buffered in receive buffers.
+type bufferBudget struct {
+	lock     sync.Mutex
+	max      int64         // unlimited if <= 0
+	n        int64         // currently buffered
+	released chan struct{} // closed on release, nil if nobody waits
+}
+
+// acquire waits until n bytes fit the budget and accounts for them.
+// Returns false if done or ctx was canceled first.
+func (b *bufferBudget) acquire(
+	ctx context.Context, done <-chan struct{}, n int64,
+) bool {
+	for {
+		b.lock.Lock()
+		if b.max <= 0 || b.n == 0 || b.n+n <= b.max {
+			b.n += n
+			b.lock.Unlock()
+			return true
+		}
+		if b.released == nil {
+			b.released = make(chan struct{})
+		}
+		released := b.released
+		b.lock.Unlock()
+		select {
+		case <-released:
+		case <-done:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (b *bufferBudget) release(n int64) {
+	if n == 0 {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.n -= n
+	b.notify()
+}
+
+// notify wakes up waiting acquirers. Must be called with the lock held.
+func (b *bufferBudget) notify() {
+	if b.released != nil {
+		close(b.released)
+		b.released = nil
+	}
+}
+
+// bufferedSize returns the number of bytes ev accounts for
+// in the buffer budget.
+func (ev *envelope) bufferedSize() int64 {
+	n := len(ev.Data) + len(ev.bin)
+	if ev.Log != nil {
+		n += len(*ev.Log)
+	}
+	return int64(n)
+}
+
+// deliver passes ev to the caller once it fits the buffer budget.
+// ev is dropped if the caller stopped receiving.
+// Returns false if ctx was canceled.
+func (pc *pendingCall) deliver(
+	ctx context.Context, b *bufferBudget, ev envelope,
+) bool {
+	n := ev.bufferedSize()
+	if !b.acquire(ctx, pc.done, n) {
+		return ctx.Err() == nil
+	}
+	pc.lockDeliver.Lock()
+	defer pc.lockDeliver.Unlock()
+	if pc.abandoned {
+		b.release(n)
+		return true
+	}
+	select {
+	case pc.ch <- ev:
+		return true
+	case <-pc.done: // Caller stopped receiving.
+		b.release(n)
+		return true
+	case <-ctx.Done():
+		b.release(n)
+		return false
+	}
+}
+
+// abandon releases the envelopes left in the receive buffer once
+// the caller stopped receiving. Must be called after closing pc.done.
+func (pc *pendingCall) abandon(b *bufferBudget) {
+	pc.lockDeliver.Lock()
+	defer pc.lockDeliver.Unlock()
+	pc.abandoned = true
+	for {
+		select {
+		case ev, ok := <-pc.ch:
+			if !ok {
+				return
+			}
+			b.release(ev.bufferedSize())
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package plugger_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/romshark/plugger"
+	"github.com/romshark/plugger/pluggertest"
+)
+
+func TestMaxBufferedBytes(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_max_buffered_bytes",
+		"testdata/tstream_plugin_main.go.txt")
+	const limit = 32 // A few stream items.
+	h.SetMaxBufferedBytes(limit)
+	awaitStream(t, h)
+
+	items, result := plugger.CallStreamSummary[SearchReq, SearchItem, SearchSummary](
+		t.Context(), h, "search", SearchReq{N: 100}, plugger.WithReceiveBuffer(100),
+	)
+	// Stall the consumer while items are buffered.
+	if !eventually(func() bool { return h.BufferedBytes() > 0 }) {
+		t.Fatal("no bytes buffered")
+	}
+	if n := h.BufferedBytes(); n > limit {
+		t.Fatalf("expected up to %d bytes buffered, got %d", limit, n)
+	}
+
+	count := 0
+	for range items {
+		count++
+	}
+	if count != 100 {
+		t.Fatalf("expected 100 items, got %d", count)
+	}
+	if summary, err := result(); err != nil || summary.Total != 100 {
+		t.Fatalf("unexpected result: %#v, %v", summary, err)
+	}
+	if n := h.BufferedBytes(); n != 0 {
+		t.Fatalf("expected no bytes buffered, got %d", n)
+	}
+}
+
+func TestMaxBufferedBytesAbandoned(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_max_buffered_bytes_abandoned",
+		"testdata/tstream_plugin_main.go.txt")
+	h.SetMaxBufferedBytes(32)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	items, result := plugger.CallStreamSummary[struct{}, SearchItem, SearchSummary](
+		ctx, h, "endless", struct{}{}, plugger.WithReceiveBuffer(100),
+	)
+	<-items
+	if !eventually(func() bool { return h.BufferedBytes() > 0 }) {
+		t.Fatal("no bytes buffered")
+	}
+	cancel()
+	for range items {
+	}
+	if _, err := result(); err == nil {
+		t.Fatal("expected error")
+	}
+	// An item may still be on its way to the abandoned buffer.
+	if !eventually(func() bool { return h.BufferedBytes() == 0 }) {
+		t.Fatal("bytes still buffered")
+	}
+
+	// The host remains usable.
+	awaitStream(t, h)
+}
+
+// awaitStream waits for the stream plugin to be running.
+func awaitStream(t *testing.T, h *plugger.Host) {
+	t.Helper()
+	_, result := plugger.CallStreamSummary[SearchReq, SearchItem, SearchSummary](
+		t.Context(), h, "search", SearchReq{N: 0},
+	)
+	if _, err := result(); err != nil {
+		t.Fatalf("awaiting plugin: %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+package plugger
+
+import (
+	"bufio"
+	"io"
+	"sync"
+	"time"
+)
+
+// defaultBufferSize is the size of read and write buffers
+// unless configured otherwise.
+const defaultBufferSize = 4096
+
+// WithReadBufferSize sets the size of the buffer reading responses from
+// the plugin, which defaults to 4096 bytes. Larger buffers reduce the
+// number of syscalls for large responses. Negative values make responses
+// be decoded straight from the pipe, except for NDJSON (see WithNDJSON)
+// which always buffers lines.
+func WithReadBufferSize(n int) RunOption {
+	return func(c *runConfig) { c.readBufferSize = n }
+}
+
+// WithWriteBufferSize sets the size of the buffer requests are written
+// to if writes are buffered with WithWriteBuffer, which defaults to
+// 4096 bytes. Buffered requests are written once n bytes are buffered.
+func WithWriteBufferSize(n int) RunOption {
+	return func(c *runConfig) { c.writeBufferSize = n }
+}
+
+// WithPluginReadBufferSize is like WithReadBufferSize
+// but for requests read by the plugin.
+func WithPluginReadBufferSize(n int) PluginOption {
+	return func(c *pluginConfig) { c.readBufferSize = n }
+}
+
+// WithPluginWriteBuffer buffers responses written to the host reducing
+// the number of syscalls at high call rates. Buffered responses are
+// written once the buffer is full (see WithPluginWriteBufferSize),
+// delay after the first response was buffered or when Run returns,
+// whichever comes first. This adds up to delay to the latency of calls,
+// so keep it short.
+func WithPluginWriteBuffer(delay time.Duration) PluginOption {
+	return func(c *pluginConfig) { c.flushDelay = delay }
+}
+
+// WithPluginWriteBufferSize is like WithWriteBufferSize
+// but for responses buffered by WithPluginWriteBuffer.
+func WithPluginWriteBufferSize(n int) PluginOption {
+	return func(c *pluginConfig) { c.writeBufferSize = n }
+}
+
+// newReader buffers r with a buffer of size bytes, or the default size
+// if size is zero. Returns r if size is negative.
+func newReader(r io.Reader, size int) io.Reader {
+	if size < 0 {
+		return r
+	}
+	return bufio.NewReaderSize(r, bufferSize(size))
+}
+
+// bufferSize returns size or the default if size isn't positive.
+func bufferSize(size int) int {
+	if size <= 0 {
+		return defaultBufferSize
+	}
+	return size
+}
+
+// flush writes responses buffered due to WithPluginWriteBuffer.
+func (p *Plugin) flush() {
+	if p.out != nil {
+		_ = p.out.Flush() // Fails only if the host stopped reading.
+	}
+}
+
+// delayedWriter buffers writes flushing them delay after the first
+// buffered write, once the buffer is full or when Flush is called.
+type delayedWriter struct {
+	lock    sync.Mutex
+	w       *bufio.Writer
+	delay   time.Duration
+	timer   *time.Timer
+	pending bool // a flush is scheduled
+}
+
+func newDelayedWriter(w io.Writer, size int, delay time.Duration) *delayedWriter {
+	return &delayedWriter{w: bufio.NewWriterSize(w, bufferSize(size)), delay: delay}
+}
+
+func (w *delayedWriter) Write(b []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	n, err := w.w.Write(b)
+	if err != nil || w.pending || w.w.Buffered() == 0 {
+		return n, err
+	}
+	w.pending = true
+	if w.timer == nil {
+		w.timer = time.AfterFunc(w.delay, func() {
+			_ = w.Flush() // Failed writes surface in subsequent writes.
+		})
+	} else {
+		w.timer.Reset(w.delay)
+	}
+	return n, nil
+}
+
+// Flush writes all buffered data.
+func (w *delayedWriter) Flush() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.pending = false
+	return w.w.Flush()
+}
+
+// flusher is implemented by buffered writers such as *bufio.Writer.
+type flusher interface{ Flush() error }
+
+// flushWriter flushes after every write. json.Encoder writes each
+// message at once, so no message stays buffered.
+type flushWriter struct {
+	io.Writer
+	f flusher
+}
+
+func (w flushWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, w.f.Flush()
+}
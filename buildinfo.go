@@ -0,0 +1,69 @@
+package plugger
+
+import (
+	"os/exec"
+	"runtime/debug"
+	"strings"
+)
+
+// BuildInfo describes how the plugin was built.
+// Fields are empty if unknown.
+type BuildInfo struct {
+	GoVersion string `json:"goVersion,omitempty"` // e.g. "go1.25.1"
+	Path      string `json:"path,omitempty"`      // Main package path.
+	Version   string `json:"version,omitempty"`   // Main module version, e.g. "v1.2.3" or "(devel)".
+}
+
+// BuildInfo returns how the plugin was built. Plugins built with this
+// package report it in the handshake. For other Go source plugins
+// only the version of the go toolchain that compiled them is known.
+// Returns nil if the plugin isn't running or the build is unknown.
+func (h *Host) BuildInfo() *BuildInfo {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.proc == nil || h.proc.build == nil {
+		return nil
+	}
+	b := *h.proc.build
+	return &b
+}
+
+// ModulePath returns the module path declared by the go.mod of the plugin,
+// which is resolved when the plugin path is classified as a local package
+// (see SpawnLocalPackage). Returns false if the plugin isn't running or
+// wasn't launched as a local package.
+func (h *Host) ModulePath() (string, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.proc == nil || h.proc.kind != SpawnLocalPackage {
+		return "", false
+	}
+	return h.proc.module, true
+}
+
+// readBuildInfo returns the build info of the running binary,
+// nil if unavailable.
+func readBuildInfo() *BuildInfo {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return nil
+	}
+	return &BuildInfo{
+		GoVersion: info.GoVersion,
+		Path:      info.Path,
+		Version:   info.Main.Version,
+	}
+}
+
+// toolchainBuildInfo returns the version of the go toolchain compiling
+// the plugin launched by cmd, nil if unavailable.
+func toolchainBuildInfo(cmd *exec.Cmd) *BuildInfo {
+	c := exec.Command("go", "env", "GOVERSION")
+	c.Dir = cmd.Dir // The module may select a different toolchain.
+	c.Env = cmd.Env
+	out, err := c.Output()
+	if err != nil {
+		return nil
+	}
+	return &BuildInfo{GoVersion: strings.TrimSpace(string(out))}
+}
@@ -0,0 +1,104 @@
+package plugger
+
+import (
+	"container/list"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// EnableCache makes the host cache successful responses of method
+// keyed by the serialized request. Cached responses are returned without
+// calling the plugin until they expire after ttl. Once maxEntries
+// is reached the least recently used entry is evicted.
+// A ttl <= 0 disables expiration and maxEntries <= 0 disables eviction.
+// Enabling the cache again for the same method drops all its entries.
+//
+// Only use the cache for idempotent methods!
+func (h *Host) EnableCache(method string, ttl time.Duration, maxEntries int) {
+	h.cache.lock.Lock()
+	defer h.cache.lock.Unlock()
+	if h.cache.methods == nil {
+		h.cache.methods = map[string]*methodCache{}
+	}
+	h.cache.methods[method] = &methodCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		lru:        list.New(),
+		entries:    map[string]*list.Element{},
+	}
+}
+
+// InvalidateCache drops all cached responses of method.
+// No-op if the cache isn't enabled for method.
+func (h *Host) InvalidateCache(method string) {
+	h.cache.lock.Lock()
+	defer h.cache.lock.Unlock()
+	if m := h.cache.methods[method]; m != nil {
+		m.lru.Init()
+		clear(m.entries)
+	}
+}
+
+type responseCache struct {
+	lock    sync.Mutex
+	methods map[string]*methodCache
+}
+
+type methodCache struct {
+	ttl        time.Duration
+	maxEntries int
+	lru        *list.List // *cacheEntry, most recently used first
+	entries    map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key     string
+	resp    envelope
+	expires time.Time // Zero if the entry never expires.
+}
+
+func (c *responseCache) get(method string, req json.RawMessage) (envelope, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	m := c.methods[method]
+	if m == nil {
+		return envelope{}, false
+	}
+	el := m.entries[string(req)]
+	if el == nil {
+		return envelope{}, false
+	}
+	e := el.Value.(*cacheEntry)
+	if !e.expires.IsZero() && time.Now().After(e.expires) {
+		m.lru.Remove(el)
+		delete(m.entries, e.key)
+		return envelope{}, false
+	}
+	m.lru.MoveToFront(el)
+	return e.resp, true
+}
+
+func (c *responseCache) put(method string, req json.RawMessage, resp envelope) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	m := c.methods[method]
+	if m == nil {
+		return
+	}
+	e := &cacheEntry{key: string(req), resp: resp}
+	if m.ttl > 0 {
+		e.expires = time.Now().Add(m.ttl)
+	}
+	if el := m.entries[e.key]; el != nil {
+		el.Value = e
+		m.lru.MoveToFront(el)
+		return
+	}
+	m.entries[e.key] = m.lru.PushFront(e)
+	if m.maxEntries > 0 && m.lru.Len() > m.maxEntries {
+		oldest := m.lru.Back()
+		m.lru.Remove(oldest)
+		delete(m.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
@@ -0,0 +1,71 @@
+package plugger_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/romshark/plugger"
+	"github.com/romshark/plugger/pluggertest"
+)
+
+type CountReq struct {
+	Key string `json:"key"`
+}
+
+func callCount(t *testing.T, h *plugger.Host, key string) int64 {
+	t.Helper()
+	resp, err := plugger.Call[CountReq, CountResp](
+		t.Context(), h, "count", CountReq{Key: key},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return resp.Calls
+}
+
+func TestCache(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_cache",
+		"testdata/tcount_plugin_main.go.txt")
+	h.EnableCache("count", time.Minute, 2)
+
+	expect := func(key string, calls int64) {
+		t.Helper()
+		if got := callCount(t, h, key); got != calls {
+			t.Fatalf("key %q: expected %d, got %d", key, calls, got)
+		}
+	}
+
+	expect("a", 1)
+	expect("a", 1) // Cached.
+	expect("b", 2)
+	expect("c", 3) // Evicts "a".
+	expect("a", 4) // Evicts "b".
+	expect("c", 3)
+
+	h.InvalidateCache("count")
+	expect("c", 5)
+}
+
+func TestCacheTTL(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_cache_ttl",
+		"testdata/tcount_plugin_main.go.txt")
+	h.EnableCache("count", 50*time.Millisecond, 0)
+
+	if got := callCount(t, h, "a"); got != 1 {
+		t.Fatalf("expected 1, got %d", got)
+	}
+	if got := callCount(t, h, "a"); got != 1 {
+		t.Fatalf("expected cached 1, got %d", got)
+	}
+	// Served from the cache until the entry expires.
+	var got int64
+	if !eventually(func() bool {
+		got = callCount(t, h, "a")
+		return got != 1
+	}) {
+		t.Fatal("entry didn't expire")
+	}
+	if got != 2 {
+		t.Fatalf("expected expired entry, got %d", got)
+	}
+}
@@ -0,0 +1,150 @@
+package plugger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// hostHandler handles calls of the plugin to the host, see HandleHost.
+type hostHandler func(ctx context.Context, raw json.RawMessage) (any, error)
+
+// HandleHost registers an endpoint the plugin can call with CallHost
+// overwriting any existing endpoint. fn is invoked in a new goroutine for
+// every call, ctx is canceled once the plugin stopped. Plugins only call
+// the host if they support FeatureCallback. Calls of the plugin made while
+// it's being launched, such as from the init call (see SetInitCall), are
+// served as well, but calls made by fn with ctx fail with ErrReentrantCall
+// since they would wait for the launch fn is blocking. A panic of fn
+// fails the plugin's call with an error response.
+func HandleHost[Req, Resp any](
+	h *Host, name string, fn func(ctx context.Context, req Req) (Resp, error),
+) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.handlers == nil {
+		h.handlers = map[string]hostHandler{}
+	}
+	h.handlers[name] = func(ctx context.Context, raw json.RawMessage) (any, error) {
+		var req Req
+		if err := unmarshal(raw, &req, h.useNumber.Load()); err != nil {
+			return nil, fmt.Errorf("unmarshaling request: %w", err)
+		}
+		return fn(ctx, req)
+	}
+}
+
+// call invokes fn and returns a panic of fn as error,
+// which fails the plugin's call instead of crashing the host.
+func (fn hostHandler) call(ctx context.Context, raw json.RawMessage) (resp any, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return fn(ctx, raw)
+}
+
+// serveCallback handles a call of the plugin to the host
+// and sends the response.
+func (h *Host) serveCallback(ctx context.Context, p *process, ev envelope) {
+	h.lock.Lock()
+	fn := h.handlers[ev.Method]
+	h.lock.Unlock()
+	out := envelope{ID: ev.ID, Callback: true}
+	if fn == nil {
+		out.Error = "unknown method: " + ev.Method
+	} else if resp, err := fn.call(ctx, ev.Data); err != nil {
+		out.Error = err.Error()
+	} else if out.Data, err = marshal(resp); err != nil {
+		out.Error = fmt.Sprintf("marshaling response: %v", err)
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err := p.send(out); err == nil {
+		_ = p.flushLocked() // The plugin is waiting for it.
+	}
+}
+
+// CallHost calls the endpoint method the host registered with HandleHost,
+// for example from within a handler. Returns ErrCallbackUnsupported if
+// the host doesn't support FeatureCallback and ErrClosed if Run returned
+// before the response arrived. Canceling ctx stops waiting for
+// the response but doesn't cancel the host's handler.
+func CallHost[Req, Resp any](
+	ctx context.Context, p *Plugin, method string, req Req,
+) (resp Resp, err error) {
+	if !p.hasFeature(FeatureCallback) {
+		return resp, ErrCallbackUnsupported
+	}
+	raw, err := marshal(req)
+	if err != nil {
+		return resp, fmt.Errorf("marshaling request: %w", err)
+	}
+	id := strconv.FormatUint(p.callbackID.Add(1), 16)
+	ch := make(chan envelope, 1)
+	p.lockCallbacks.Lock()
+	if p.callbacks == nil {
+		p.lockCallbacks.Unlock()
+		return resp, ErrClosed
+	}
+	p.callbacks[id] = ch
+	p.lockCallbacks.Unlock()
+
+	p.lockEnc.Lock()
+	err = p.enc.Encode(envelope{ID: id, Method: method, Data: raw, Callback: true})
+	p.lockEnc.Unlock()
+	if err == nil {
+		p.flush() // The caller is blocked until the host responds.
+	}
+	if err != nil {
+		p.dropCallback(id)
+		return resp, fmt.Errorf("sending request: %w", err)
+	}
+
+	select {
+	case ev, ok := <-ch:
+		if !ok {
+			return resp, ErrClosed
+		}
+		if ev.Error != "" {
+			return resp, ErrorResponse(ev.Error)
+		}
+		if err := unmarshal(ev.Data, &resp, p.useNumber); err != nil {
+			return resp, fmt.Errorf("%w: %w", ErrMalformedResponse, err)
+		}
+		return resp, nil
+	case <-ctx.Done():
+		p.dropCallback(id)
+		return resp, causeErr(ctx)
+	}
+}
+
+// deliverCallback passes the host's response to the waiting CallHost.
+// Responses of calls that stopped waiting are dropped.
+func (p *Plugin) deliverCallback(ev envelope) {
+	p.lockCallbacks.Lock()
+	ch := p.callbacks[ev.ID]
+	delete(p.callbacks, ev.ID)
+	p.lockCallbacks.Unlock()
+	if ch != nil {
+		ch <- ev // Buffered, a call receives a single response.
+	}
+}
+
+func (p *Plugin) dropCallback(id string) {
+	p.lockCallbacks.Lock()
+	delete(p.callbacks, id)
+	p.lockCallbacks.Unlock()
+}
+
+// closeCallbacks fails all calls to the host still awaiting a response.
+func (p *Plugin) closeCallbacks() {
+	p.lockCallbacks.Lock()
+	defer p.lockCallbacks.Unlock()
+	for _, ch := range p.callbacks {
+		close(ch)
+	}
+	p.callbacks = nil
+}
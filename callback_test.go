@@ -0,0 +1,92 @@
+package plugger_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/romshark/plugger"
+	"github.com/romshark/plugger/pluggertest"
+)
+
+func TestCallback(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_callback",
+		"testdata/tcallback_plugin_main.go.txt")
+
+	_, err := plugger.Call[AddReq, AddResp](t.Context(), h, "add", AddReq{A: 2, B: 3})
+	if err == nil || !strings.Contains(err.Error(), "unknown method: multiply") {
+		t.Fatalf("expected unknown method error, got: %v", err)
+	}
+
+	plugger.HandleHost(h, "multiply",
+		func(_ context.Context, req AddReq) (int, error) { return req.A * req.B, nil })
+	resp, err := plugger.Call[AddReq, AddResp](t.Context(), h, "add", AddReq{A: 2, B: 3})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.Sum != 50 {
+		t.Fatalf("expected 50, got: %d", resp.Sum)
+	}
+
+	// Panics fail the plugin's call.
+	plugger.HandleHost(h, "multiply",
+		func(context.Context, AddReq) (int, error) { panic("boom") })
+	_, err = plugger.Call[AddReq, AddResp](t.Context(), h, "add", AddReq{A: 2, B: 3})
+	if !errors.Is(err, plugger.ErrorResponse("panic: boom")) {
+		t.Fatalf("expected panic error, got: %v", err)
+	}
+}
+
+func TestCallbackUnsupported(t *testing.T) {
+	errc := make(chan error, 1)
+	c := pluggertest.Serve(t, func(p *plugger.Plugin) {
+		plugger.Handle(p, "add",
+			func(ctx context.Context, req AddReq) (AddResp, error) {
+				_, err := plugger.CallHost[AddReq, int](ctx, p, "multiply", req)
+				errc <- err
+				return AddResp{}, err
+			})
+	})
+	// No handshake, so callbacks aren't negotiated.
+	c.Send(`{"id":"1","method":"add","data":{"a":1,"b":2}}`)
+	c.Receive()
+	if err := <-errc; err != plugger.ErrCallbackUnsupported {
+		t.Fatalf("expected ErrCallbackUnsupported, got: %v", err)
+	}
+}
+
+func TestCallbackDuringInit(t *testing.T) {
+	modDir := pluggertest.MakeModule(t, "test_callback_init",
+		"testdata/tcallback_plugin_main.go.txt")
+	h := plugger.NewHost()
+	var once sync.Once
+	errReentrant := make(chan error, 1)
+	plugger.HandleHost(h, "multiply",
+		func(ctx context.Context, req AddReq) (int, error) {
+			once.Do(func() { // Served for the init call first.
+				// Would wait for the launch blocked by the init call.
+				_, err := plugger.Call[AddReq, AddResp](ctx, h, "add", req)
+				errReentrant <- err
+			})
+			return req.A * req.B, nil
+		})
+	if err := h.SetInitCall("add", AddReq{A: 1, B: 2}); err != nil {
+		t.Fatalf("setting init call: %v", err)
+	}
+	h.Configure(modDir, plugger.WithStderr(pluggertest.NewLogWriter(t)))
+	defer func() { _ = h.Close() }()
+
+	// Launches the plugin, whose init call calls the host.
+	resp, err := plugger.Call[AddReq, AddResp](t.Context(), h, "add", AddReq{A: 2, B: 3})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.Sum != 50 {
+		t.Fatalf("expected 50, got: %d", resp.Sum)
+	}
+	if err := <-errReentrant; !errors.Is(err, plugger.ErrReentrantCall) {
+		t.Fatalf("expected ErrReentrantCall, got: %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package plugger
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// CallWithLogs is like Call but also receives the logs the plugin writes
+// to Logger(ctx) while handling the request. Logs are delivered through
+// the returned channel which is closed once the call completed.
+// The returned function blocks until the call completed and returns
+// its result. The log channel must be drained, canceling ctx aborts the call.
+// Waiting for another call before receiving the next log can deadlock
+// just like for CallStreamSummary.
+// The plugin writes logs to its stderr instead if it doesn't support
+// FeatureCallLog.
+func CallWithLogs[Req any, Resp any](
+	ctx context.Context, h *Host, method string, req Req, opts ...CallOption,
+) (<-chan string, func() (Resp, error)) {
+	logs := make(chan string)
+	done := make(chan struct{})
+	var resp Resp
+	var err error
+
+	c := newCallConfig(opts)
+	c.onLog = func(msg string) error {
+		select {
+		case logs <- msg:
+			return nil
+		case <-ctx.Done():
+			return causeErr(ctx)
+		}
+	}
+	go func() {
+		defer close(done)
+		defer close(logs)
+		resp, err = callTyped[Req, Resp](ctx, h, method, req, c)
+	}()
+
+	return logs, func() (Resp, error) {
+		<-done
+		return resp, err
+	}
+}
+
+type ctxKeyCallLog struct{}
+
+// callLog sends log messages of a request to the host.
+type callLog struct {
+	p   *Plugin
+	ctx context.Context
+	id  string
+}
+
+func (l *callLog) Write(b []byte) (int, error) {
+	if l.ctx.Err() != nil {
+		// The request completed, the host no longer receives its logs.
+		return os.Stderr.Write(b)
+	}
+	msg := strings.TrimSuffix(string(b), "\n")
+	l.p.lockEnc.Lock()
+	defer l.p.lockEnc.Unlock()
+	if err := l.p.enc.Encode(envelope{ID: l.id, Log: &msg}); err != nil {
+		return 0, fmt.Errorf("encoding log: %w", err)
+	}
+	return len(b), nil
+}
+
+// Logger returns a logger sending log messages to the host if ctx
+// is the context of a request made by CallWithLogs.
+// Otherwise messages are written to stderr.
+func Logger(ctx context.Context) *log.Logger {
+	if l, ok := ctx.Value(ctxKeyCallLog{}).(*callLog); ok {
+		return log.New(l, "", 0)
+	}
+	return log.New(os.Stderr, "", 0)
+}
@@ -0,0 +1,53 @@
+package plugger_test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/romshark/plugger"
+	"github.com/romshark/plugger/pluggertest"
+)
+
+func TestCallWithLogs(t *testing.T) {
+	h, logWriter := pluggertest.Launch(t, t.Context(), "test_call_with_logs",
+		"testdata/tlog_plugin_main.go.txt")
+
+	logs, result := plugger.CallWithLogs[int, string](t.Context(), h, "work", 3)
+	var received []string
+	for l := range logs {
+		received = append(received, l)
+	}
+	resp, err := result()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp != "done" {
+		t.Fatalf("unexpected response: %q", resp)
+	}
+	if expect := []string{"step 1", "step 2", "step 3"}; !slices.Equal(received, expect) {
+		t.Fatalf("expected logs %q, got %q", expect, received)
+	}
+
+	// Empty messages don't end the call.
+	logs, result = plugger.CallWithLogs[struct{}, string](t.Context(), h, "empty", struct{}{})
+	received = nil
+	for l := range logs {
+		received = append(received, l)
+	}
+	if resp, err := result(); err != nil || resp != "done" {
+		t.Fatalf("unexpected result: %q, %v", resp, err)
+	}
+	if expect := []string{""}; !slices.Equal(received, expect) {
+		t.Fatalf("expected logs %q, got %q", expect, received)
+	}
+
+	// Logs of other calls go to stderr.
+	c := make(chan string, 1)
+	logWriter.AddReader(c)
+	if _, err := plugger.Call[int, string](t.Context(), h, "work", 1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m := <-c; m != "step 1\n" {
+		t.Fatalf("unexpected stderr: %q", m)
+	}
+}
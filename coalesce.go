@@ -0,0 +1,99 @@
+package plugger
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+)
+
+// WithCoalescing makes concurrent calls of the same method with identical
+// serialized arguments share a single plugin call, the response or error
+// of which is delivered to all of them. A canceled call stops waiting
+// but the shared call is only canceled once all calls sharing it are canceled.
+// The shared call has the deadline of the call that started it, so calls
+// joining it with a later deadline or none fail with
+// context.DeadlineExceeded once that deadline is exceeded.
+func WithCoalescing() CallOption {
+	return func(c *callConfig) { c.coalesce = true }
+}
+
+// coalescer deduplicates concurrent identical calls.
+type coalescer struct {
+	lock    sync.Mutex
+	flights map[string]*flight // method+args → in-flight call
+}
+
+// flight is a plugin call shared by one or more waiters.
+type flight struct {
+	done    chan struct{} // closed once resp and err are set
+	cancel  context.CancelFunc
+	waiters int
+	handle  CallHandle
+	resp    envelope
+	err     error
+}
+
+func (c *coalescer) call(
+	ctx context.Context, h *Host, method string, raw json.RawMessage,
+	conf *callConfig,
+) (envelope, error) {
+	key := method + "\x00" + string(raw)
+
+	c.lock.Lock()
+	f := c.flights[key]
+	if f == nil {
+		// The shared call must not be canceled by the first waiter alone
+		// but it keeps its deadline.
+		base := context.WithoutCancel(ctx)
+		var ctxFlight context.Context
+		var cancel context.CancelFunc
+		if d, ok := ctx.Deadline(); ok {
+			ctxFlight, cancel = context.WithDeadline(base, d)
+		} else {
+			ctxFlight, cancel = context.WithCancel(base)
+		}
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		if c.flights == nil {
+			c.flights = map[string]*flight{}
+		}
+		c.flights[key] = f
+		confFlight := *conf
+		confFlight.handle = &f.handle
+		go func() {
+			defer cancel()
+			f.resp, f.err = h.call(ctxFlight, method, raw, &confFlight, nil)
+			c.remove(key, f)
+			close(f.done)
+		}()
+	}
+	f.waiters++
+	c.lock.Unlock()
+
+	select {
+	case <-f.done:
+		if conf.handle != nil {
+			*conf.handle = f.handle
+		}
+		return f.resp, f.err
+	case <-ctx.Done():
+		c.lock.Lock()
+		if f.waiters--; f.waiters == 0 {
+			// Last waiter gone, abort the shared call
+			// and don't let new calls join it.
+			f.cancel()
+			if c.flights[key] == f {
+				delete(c.flights, key)
+			}
+		}
+		c.lock.Unlock()
+		return envelope{}, causeErr(ctx)
+	}
+}
+
+func (c *coalescer) remove(key string, f *flight) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.flights[key] == f {
+		delete(c.flights, key)
+	}
+}
@@ -0,0 +1,158 @@
+package plugger_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/romshark/plugger"
+	"github.com/romshark/plugger/pluggertest"
+)
+
+type CountResp struct {
+	Calls int64 `json:"calls"`
+}
+
+func TestCoalescing(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_coalescing",
+		"testdata/tcount_plugin_main.go.txt")
+
+	var wg sync.WaitGroup
+	results := make([]CountResp, 10)
+	for i := range results {
+		wg.Go(func() {
+			resp, err := plugger.Call[struct{}, CountResp](
+				t.Context(), h, "slow_count", struct{}{}, plugger.WithCoalescing(),
+			)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			results[i] = resp
+		})
+	}
+	wg.Wait()
+	for i, r := range results {
+		if r.Calls != 1 {
+			t.Errorf("call %d: expected to share the first plugin call, got %d", i, r.Calls)
+		}
+	}
+
+	// A call after the shared one completed isn't coalesced with it.
+	resp, err := plugger.Call[struct{}, CountResp](
+		t.Context(), h, "slow_count", struct{}{}, plugger.WithCoalescing(),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.Calls != 2 {
+		t.Fatalf("expected second plugin call, got %d", resp.Calls)
+	}
+}
+
+func TestCoalescingCancelOneWaiter(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_coalescing_cancel",
+		"testdata/tcount_plugin_main.go.txt")
+
+	ctx, cancel := context.WithCancel(t.Context())
+	errs := make(chan error, 2)
+	for _, ctx := range []context.Context{ctx, t.Context()} {
+		go func() {
+			// Sleeps ignoring cancelation, so the shared call is bounded.
+			_, err := plugger.Call[int, struct{}](
+				ctx, h, "sleep", 1000, plugger.WithCoalescing(),
+			)
+			errs <- err
+		}()
+	}
+	awaitStats(t, h, func(s plugger.DebugStats) bool {
+		return s.CoalescedCalls == 1 && s.CoalescedWaits == 2
+	})
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got: %v", err)
+	}
+	// The shared call continues for the remaining caller.
+	if s := h.DebugStats(); s.CoalescedCalls != 1 || s.CoalescedWaits != 1 {
+		t.Fatalf("expected the shared call to continue, got: %#v", s)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestCoalescingDeadline(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_coalescing_deadline",
+		"testdata/tcount_plugin_main.go.txt")
+
+	ctx, cancel := context.WithTimeout(t.Context(), 300*time.Millisecond)
+	defer cancel()
+	errs := make(chan error, 2)
+	call := func(ctx context.Context) {
+		// Sleeps ignoring cancelation, so the shared call is bounded.
+		_, err := plugger.Call[int, struct{}](
+			ctx, h, "sleep", 1000, plugger.WithCoalescing(),
+		)
+		errs <- err
+	}
+	go call(ctx)
+	awaitStats(t, h, func(s plugger.DebugStats) bool { return s.CoalescedWaits == 1 })
+	go call(t.Context())
+	awaitStats(t, h, func(s plugger.DebugStats) bool { return s.CoalescedWaits == 2 })
+	// The shared call keeps the deadline of the call that started it,
+	// the call joining it without a deadline fails once it's exceeded.
+	for range 2 {
+		if err := <-errs; !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected context.DeadlineExceeded, got: %v", err)
+		}
+	}
+}
+
+func TestDebugStatsNoLeaks(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_debug_stats",
+		"testdata/tcount_plugin_main.go.txt")
+	// Wait for the plugin to start.
+	if _, err := plugger.Call[struct{}, CountResp](
+		t.Context(), h, "count", struct{}{},
+	); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	var wg sync.WaitGroup
+	for i := range 20 {
+		var opts []plugger.CallOption
+		if i%2 == 0 {
+			opts = append(opts, plugger.WithCoalescing())
+		}
+		wg.Go(func() {
+			_, _ = plugger.Call[struct{}, struct{}](
+				ctx, h, "wait", struct{}{}, opts...,
+			)
+		})
+	}
+	// The coalesced calls share one request.
+	awaitStats(t, h, func(s plugger.DebugStats) bool {
+		return s.ActiveCalls == 11 && s.PendingCalls == 11 && s.CoalescedWaits == 10
+	})
+	cancel()
+	wg.Wait()
+
+	awaitStats(t, h, func(s plugger.DebugStats) bool {
+		return s == (plugger.DebugStats{})
+	})
+}
+
+// awaitStats fails t unless the debug stats of h satisfy ok
+// within 5 seconds.
+func awaitStats(t *testing.T, h *plugger.Host, ok func(plugger.DebugStats) bool) {
+	t.Helper()
+	var s plugger.DebugStats
+	if !eventually(func() bool {
+		s = h.DebugStats()
+		return ok(s)
+	}) {
+		t.Fatalf("unexpected debug stats: %#v", s)
+	}
+}
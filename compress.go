@@ -0,0 +1,124 @@
+package plugger
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Compression algorithms supported by WithAdaptiveCompression.
+const (
+	CompressionGzip = "gzip"
+)
+
+// defaultMaxDecompressedSize is the maximum size of decompressed data
+// unless set by WithMaxDecompressedSize.
+const defaultMaxDecompressedSize = 64 << 20
+
+// compression is the response compression agreed on in the handshake.
+type compression struct {
+	Algo      string `json:"algo"`
+	Threshold int    `json:"threshold"` // Minimum size of compressed data
+
+	maxSize int64 // of decompressed data, set on the host only
+}
+
+// WithAdaptiveCompression makes the plugin compress the data of responses
+// and stream items larger than threshold bytes using algo (e.g.
+// CompressionGzip), which saves bandwidth on large responses without
+// spending CPU on small ones. Compressed data is sent base64 encoded,
+// so threshold should be well above the size where compression pays off
+// (see BenchmarkCompression). Responses are sent uncompressed if the plugin
+// doesn't support FeatureCompression or algo.
+func WithAdaptiveCompression(algo string, threshold int) RunOption {
+	return func(c *runConfig) {
+		c.compression = &compression{Algo: algo, Threshold: threshold}
+	}
+}
+
+// WithMaxDecompressedSize limits the size of the decompressed data of
+// responses and stream items to n bytes, which protects the host from
+// small compressed data expanding to exhaust its memory. Calls receiving
+// larger data fail with ErrPayloadTooLarge. Defaults to 64 MiB,
+// n <= 0 restores the default.
+func WithMaxDecompressedSize(n int64) RunOption {
+	return func(c *runConfig) { c.maxDecompressedSize = n }
+}
+
+// accept returns the compression the plugin agrees to
+// or nil if it doesn't support the algorithm.
+func (c *compression) accept() *compression {
+	if c == nil || c.Algo != CompressionGzip {
+		return nil
+	}
+	return &compression{Algo: c.Algo, Threshold: max(c.Threshold, 0)}
+}
+
+var gzipWriters = sync.Pool{
+	New: func() any { return gzip.NewWriter(nil) },
+}
+
+// compress compresses the data of ev if it exceeds the threshold.
+func (c *compression) compress(ev *envelope) error {
+	if c == nil || len(ev.Data) <= c.Threshold {
+		return nil
+	}
+	var buf bytes.Buffer
+	w := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(ev.Data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	raw, err := json.Marshal(buf.Bytes()) // base64
+	if err != nil {
+		return err
+	}
+	ev.Data, ev.Compressed = raw, true
+	return nil
+}
+
+// decompress replaces the compressed data of ev by the original data,
+// c is the compression requested by the host, nil if none was requested.
+func (c *compression) decompress(ev *envelope) error {
+	if !ev.Compressed {
+		return nil
+	}
+	var data []byte
+	if err := json.Unmarshal(ev.Data, &data); err != nil {
+		return fmt.Errorf("%w: compressed data: %w", ErrMalformedResponse, err)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("%w: compressed data: %w", ErrMalformedResponse, err)
+	}
+	limit := int64(defaultMaxDecompressedSize)
+	if c != nil && c.maxSize > 0 {
+		limit = c.maxSize
+	}
+	if ev.Data, err = io.ReadAll(io.LimitReader(r, limit+1)); err != nil {
+		return fmt.Errorf("%w: compressed data: %w", ErrMalformedResponse, err)
+	}
+	if int64(len(ev.Data)) > limit {
+		return fmt.Errorf("%w: decompressed data exceeds %d bytes",
+			ErrPayloadTooLarge, limit)
+	}
+	ev.Compressed = false
+	return nil
+}
+
+// withMaxSize returns a copy of c limiting decompressed data to n bytes.
+func (c *compression) withMaxSize(n int64) *compression {
+	if c == nil {
+		return nil
+	}
+	cp := *c
+	cp.maxSize = n
+	return &cp
+}
@@ -0,0 +1,119 @@
+package plugger_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/romshark/plugger"
+	"github.com/romshark/plugger/pluggertest"
+)
+
+func text(n int) string {
+	const s = "lorem ipsum dolor sit amet "
+	return strings.Repeat(s, n/len(s)+1)[:n]
+}
+
+func TestAdaptiveCompression(t *testing.T) {
+	f := pluggertest.MakeModule(t, "test_adaptive_compression",
+		"testdata/tcompress_plugin_main.go.txt")
+	h := plugger.NewHost()
+	go func() {
+		_ = h.RunPlugin(t.Context(), f, pluggertest.NewLogWriter(t),
+			plugger.WithAdaptiveCompression(plugger.CompressionGzip, 1024))
+	}()
+	defer func() { _ = h.Close() }()
+
+	sizes := []int{0, 10, 1024, 1025, 1 << 20}
+	for _, n := range sizes {
+		resp, err := plugger.Call[int, string](t.Context(), h, "text", n)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if resp != text(n) {
+			t.Fatalf("unexpected response of size %d: %.32q", n, resp)
+		}
+	}
+
+	items, result := plugger.CallStreamSummary[[]int, string, struct{}](
+		t.Context(), h, "texts", sizes,
+	)
+	i := 0
+	for item := range items {
+		if item != text(sizes[i]) {
+			t.Fatalf("unexpected item of size %d: %.32q", sizes[i], item)
+		}
+		i++
+	}
+	if _, err := result(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if i != len(sizes) {
+		t.Fatalf("expected %d items, got %d", len(sizes), i)
+	}
+}
+
+func TestMaxDecompressedSize(t *testing.T) {
+	f := pluggertest.MakeModule(t, "test_max_decompressed_size",
+		"testdata/tcompress_plugin_main.go.txt")
+	h := plugger.NewHost()
+	go func() {
+		_ = h.RunPlugin(t.Context(), f, pluggertest.NewLogWriter(t),
+			plugger.WithAdaptiveCompression(plugger.CompressionGzip, 0),
+			plugger.WithMaxDecompressedSize(4096))
+	}()
+	defer func() { _ = h.Close() }()
+
+	if resp, err := plugger.Call[int, string](t.Context(), h, "text", 4000); err != nil ||
+		resp != text(4000) {
+		t.Fatalf("unexpected result: %.32q, %v", resp, err)
+	}
+	// Compresses to a fraction of the limit.
+	_, err := plugger.Call[int, string](t.Context(), h, "text", 1<<20)
+	if !errors.Is(err, plugger.ErrPayloadTooLarge) {
+		t.Fatalf("expected ErrPayloadTooLarge, got: %v", err)
+	}
+}
+
+// BenchmarkCompression compares calls with compressed and uncompressed
+// responses of increasing size. Over local pipes, compression pays off
+// only for large responses.
+func BenchmarkCompression(b *testing.B) {
+	f := pluggertest.MakeModule(b, "bench_compression",
+		"testdata/tcompress_plugin_main.go.txt")
+	launch := func(b *testing.B, opts ...plugger.RunOption) *plugger.Host {
+		h := plugger.NewHost()
+		opts = append(opts, plugger.WithStderr(io.Discard))
+		go func() { _ = h.RunPlugin(b.Context(), f, nil, opts...) }()
+		b.Cleanup(func() { _ = h.Close() })
+		// Wait for the plugin to start.
+		if _, err := plugger.Call[int, string](b.Context(), h, "text", 0); err != nil {
+			b.Fatalf("unexpected error: %v", err)
+		}
+		return h
+	}
+	for _, size := range []int{256, 4 << 10, 64 << 10, 1 << 20} {
+		for _, compressed := range []bool{false, true} {
+			name := fmt.Sprintf("size=%d/compressed=%t", size, compressed)
+			b.Run(name, func(b *testing.B) {
+				var opts []plugger.RunOption
+				if compressed {
+					opts = append(opts,
+						plugger.WithAdaptiveCompression(plugger.CompressionGzip, 0))
+				}
+				h := launch(b, opts...)
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				for b.Loop() {
+					if _, err := plugger.Call[int, string](
+						b.Context(), h, "text", size,
+					); err != nil {
+						b.Fatalf("unexpected error: %v", err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package plugger
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime/debug"
+)
+
+// methodCrash is the reserved method of the envelope a plugin sends
+// before exiting due to a panic, see SetUncaughtPanicHandler.
+const methodCrash = "__crash"
+
+// crashReport is the data of the crash envelope.
+type crashReport struct {
+	Panic string `json:"panic"`
+	Stack string `json:"stack"`
+}
+
+// SetUncaughtPanicHandler makes the plugin recover panics in Run,
+// in handlers and in goroutines started with Plugin.Go, invoke fn with
+// the recovered value and the stack trace, report the panic to the host
+// and exit with code 2. The host returns the panic as PanicError from
+// calls in progress and Host.Err instead of an opaque EOF.
+// Panics in goroutines started otherwise still crash the plugin
+// without a report, since Go can't recover them.
+// Must be used before Run is invoked!
+func (p *Plugin) SetUncaughtPanicHandler(fn func(recovered any, stack []byte)) {
+	if p.running.Load() {
+		panic("set the panic handler before invoking Run")
+	}
+	p.panicHandler = fn
+}
+
+// Go runs fn in a new goroutine reporting panics to the host,
+// see SetUncaughtPanicHandler.
+func (p *Plugin) Go(fn func()) {
+	go func() {
+		defer p.recoverPanic()
+		fn()
+	}()
+}
+
+// recoverPanic reports a panic and exits if there is a panic handler.
+// Must be deferred directly.
+func (p *Plugin) recoverPanic() {
+	if p.panicHandler == nil {
+		return
+	}
+	if r := recover(); r != nil {
+		p.crash(r)
+	}
+}
+
+// crash reports the panic to the host and exits.
+func (p *Plugin) crash(recovered any) {
+	const exitCode = 2
+	p.exitCode.Store(exitCode) // In case Run returns first.
+	stack := debug.Stack()
+	p.panicHandler(recovered, stack)
+	fmt.Fprintf(os.Stderr, "panic: %v\n\n%s", recovered, stack)
+
+	p.lockEnc.Lock() // Held until exit, no more responses.
+	if p.hasFeature(FeatureCrashReport) {
+		data, err := json.Marshal(crashReport{
+			Panic: fmt.Sprint(recovered), Stack: string(stack),
+		})
+		if err == nil {
+			_ = p.enc.Encode(envelope{Method: methodCrash, Data: data})
+		}
+	}
+	p.flush()
+	os.Exit(exitCode)
+}
+
+// PanicError is returned by calls in progress and Host.Err
+// if the plugin reported a panic before exiting.
+type PanicError struct {
+	Value string // Recovered value
+	Stack string
+}
+
+func (e *PanicError) Error() string {
+	return ErrPluginPanic.Error() + ": " + e.Value
+}
+
+// Unwrap returns ErrPluginPanic.
+func (e *PanicError) Unwrap() error { return ErrPluginPanic }
+
+// StackTrace returns the stack trace of the panicking goroutine.
+func (e *PanicError) StackTrace() string { return e.Stack }
+
+// crashed records the panic reported by the plugin.
+func (p *process) crashed(ev envelope) {
+	var r crashReport
+	if err := json.Unmarshal(ev.Data, &r); err != nil {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.stopErr == nil {
+		p.stopErr = &PanicError{Value: r.Panic, Stack: r.Stack}
+	}
+}
+
+// Err returns the error the plugin stopped with if it panicked
+// (see PanicError), exited on its own with a non-zero exit code
+// (see ExitError and Host.ExitError) or timed out (see ErrTimeout).
+// Returns nil while the plugin is running or if it exited otherwise.
+func (h *Host) Err() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.err
+}
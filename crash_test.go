@@ -0,0 +1,63 @@
+package plugger_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/romshark/plugger"
+	"github.com/romshark/plugger/pluggertest"
+)
+
+func TestUncaughtPanic(t *testing.T) {
+	modDir := pluggertest.MakeModule(t, "test_uncaught_panic",
+		"testdata/tpanic_plugin_main.go.txt")
+
+	for _, tc := range []struct{ method, value string }{
+		{method: "panic", value: "boom"},
+		{method: "background", value: "background boom"},
+	} {
+		t.Run(tc.method, func(t *testing.T) {
+			h := plugger.NewHost()
+			defer func() { _ = h.Close() }()
+			var stderr syncBuffer
+			errs := make(chan error, 1)
+			go func() {
+				errs <- h.RunPlugin(t.Context(), modDir, nil,
+					plugger.WithStderr(&stderr))
+			}()
+
+			_, err := plugger.Call[struct{}, struct{}](
+				t.Context(), h, tc.method, struct{}{},
+			)
+			var p *plugger.PanicError
+			if !errors.As(err, &p) {
+				t.Fatalf("expected PanicError, got: %v", err)
+			}
+			if !errors.Is(err, plugger.ErrPluginPanic) {
+				t.Fatalf("expected ErrPluginPanic, got: %v", err)
+			}
+			if p.Value != tc.value {
+				t.Fatalf("unexpected panic value: %q", p.Value)
+			}
+			if !strings.Contains(p.StackTrace(), "main.main") {
+				t.Fatalf("unexpected stack trace: %s", p.StackTrace())
+			}
+
+			if err := <-errs; !errors.Is(err, plugger.ErrPluginPanic) {
+				t.Fatalf("expected RunPlugin to return ErrPluginPanic, got: %v", err)
+			}
+			if err := h.Err(); !errors.As(err, &p) || p.Value != tc.value {
+				t.Fatalf("unexpected Err: %v", err)
+			}
+			if err := h.ExitError(); err != nil {
+				t.Fatalf("expected no exit error for a panic, got: %v", err)
+			}
+			// RunPlugin returns once stdout closed, Close waits for stderr.
+			_ = h.Close()
+			if s := stderr.String(); !strings.Contains(s, "handled: "+tc.value) {
+				t.Fatalf("expected the panic handler to be invoked, stderr: %q", s)
+			}
+		})
+	}
+}
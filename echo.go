@@ -0,0 +1,32 @@
+package plugger
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// methodEcho is the reserved method answered with the request data.
+const methodEcho = "__echo"
+
+// Echo sends data to the plugin and returns the data it echoed back,
+// which verifies the connection end to end without registering
+// an endpoint. Responses are never cached or coalesced.
+// Plugins not built with this package may not support it
+// and respond with an ErrorResponse.
+func (h *Host) Echo(ctx context.Context, data json.RawMessage) (json.RawMessage, error) {
+	resp, err := h.call(ctx, methodEcho, data, newCallConfig(nil), nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+// echo is the endpoint of the echo method.
+func (p *Plugin) echo(
+	_ context.Context, _ RequestMeta, raw json.RawMessage, _ func(any) error,
+) (any, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	return raw, nil
+}
@@ -0,0 +1,24 @@
+package plugger_test
+
+import (
+	"testing"
+
+	"github.com/romshark/plugger/pluggertest"
+)
+
+func TestEcho(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_echo",
+		"testdata/t1_plugin_main.go.txt")
+
+	for _, data := range []string{
+		`{"a":1,"b":[true,null,"x"]}`, `"text"`, `42`, ``,
+	} {
+		resp, err := h.Echo(t.Context(), []byte(data))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(resp) != data {
+			t.Fatalf("expected %q, got %q", data, resp)
+		}
+	}
+}
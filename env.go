@@ -0,0 +1,35 @@
+package plugger
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// WithContextEnvMapping passes values of the context the plugin is
+// launched with to the plugin as environment variables, which makes
+// metadata such as trace IDs available to plugins unaware of the protocol.
+// mapping maps context keys to the names of the variables, values are
+// formatted with fmt.Sprint and keys without a value are skipped.
+// The launch context is the one passed to RunPlugin or, for plugins
+// launched lazily (see Configure), the one of the call launching it.
+// Variables are only set at launch, use WithHeaders to pass metadata
+// with every call.
+func WithContextEnvMapping(mapping map[any]string) RunOption {
+	mapping = maps.Clone(mapping)
+	return func(c *runConfig) { c.contextEnv = mapping }
+}
+
+// contextEnv returns the environment variables mapped from ctx values,
+// see WithContextEnvMapping.
+func contextEnv(ctx context.Context, mapping map[any]string) []string {
+	var env []string
+	for key, name := range mapping {
+		if v := ctx.Value(key); v != nil {
+			env = append(env, fmt.Sprintf("%s=%v", name, v))
+		}
+	}
+	slices.Sort(env) // Deterministic order for duplicate names.
+	return env
+}
@@ -0,0 +1,76 @@
+package plugger
+
+import "time"
+
+// EOFPolicy defines how Run handles requests still in progress
+// once the host closed the plugin's stdin.
+type EOFPolicy int
+
+const (
+	// EOFReturn makes Run return immediately, handlers in progress are cut
+	// off once the process exits. This is the default.
+	EOFReturn EOFPolicy = iota
+
+	// EOFDrain makes Run wait for the handlers in progress to return,
+	// letting them complete their work.
+	EOFDrain
+
+	// EOFCancel cancels all requests in progress and makes Run wait
+	// for their handlers to return.
+	EOFCancel
+)
+
+// SetEOFPolicy sets how requests in progress are handled once the host
+// closed stdin. Run waits for handlers at most timeout if it's positive
+// and returns even if they're still running. Shutdown hooks registered
+// with OnShutdown are invoked after the policy is applied, EOFReturn
+// cancels requests like EOFCancel if there are any.
+// Must be used before Run is invoked!
+func (p *Plugin) SetEOFPolicy(policy EOFPolicy, timeout time.Duration) {
+	if p.running.Load() {
+		panic("set the EOF policy before invoking Run")
+	}
+	p.eofPolicy, p.eofTimeout = policy, timeout
+}
+
+// handleEOF applies the EOF policy once stdin was closed.
+func (p *Plugin) handleEOF() {
+	switch {
+	case p.eofPolicy == EOFDrain:
+		p.settle(false)
+	case p.eofPolicy == EOFCancel || len(p.onShutdown) > 0:
+		p.settle(true)
+	}
+}
+
+// settle waits for the handlers in progress to return, at most for the
+// EOF timeout, canceling their requests first if cancel is set.
+// Only the first invocation has an effect.
+func (p *Plugin) settle(cancel bool) {
+	if p.settled {
+		return
+	}
+	p.settled = true
+	if cancel {
+		p.lockCancel.Lock()
+		for _, cancel := range p.cancel {
+			cancel(nil)
+		}
+		p.lockCancel.Unlock()
+	}
+	done := make(chan struct{})
+	go func() {
+		p.wgDispatcher.Wait()
+		close(done)
+	}()
+	var timeout <-chan time.Time
+	if p.eofTimeout > 0 {
+		t := time.NewTimer(p.eofTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-done:
+	case <-timeout:
+	}
+}
@@ -0,0 +1,35 @@
+package plugger
+
+import "errors"
+
+// errorCodes maps the codes of error responses ("code") to the errors
+// they identify, see FeatureErrorCode.
+var errorCodes = map[string]error{
+	"paused":            ErrPaused,
+	"payload_too_large": ErrPayloadTooLarge,
+}
+
+// errorCode returns the code identifying err if the host supports
+// FeatureErrorCode, otherwise or if err has no code returns "".
+func (p *Plugin) errorCode(err error) string {
+	if !p.hasFeature(FeatureErrorCode) {
+		return ""
+	}
+	for code, e := range errorCodes {
+		if errors.Is(err, e) {
+			return code
+		}
+	}
+	return ""
+}
+
+// codedError is an error response identified by its code.
+type codedError struct {
+	err  error // ErrorResponse or StackTraceError
+	code error // The error identified by the code, such as ErrPaused
+}
+
+func (e *codedError) Error() string { return e.err.Error() }
+
+// Unwrap returns the error response and the error identified by the code.
+func (e *codedError) Unwrap() []error { return []error{e.err, e.code} }
@@ -0,0 +1,55 @@
+package plugger
+
+import "fmt"
+
+// PluginEventKind is the kind of a PluginEvent.
+type PluginEventKind int
+
+const (
+	// EventReceived is reported once a request was registered, before its
+	// handler is started. Cancels sent afterwards find the request.
+	EventReceived PluginEventKind = iota + 1
+	// EventCanceled is reported once the host canceled a request
+	// whose handler is still running.
+	EventCanceled
+	// EventDone is reported once the handler of a request returned
+	// and its response was written or discarded.
+	EventDone
+)
+
+func (k PluginEventKind) String() string {
+	switch k {
+	case EventReceived:
+		return "received"
+	case EventCanceled:
+		return "canceled"
+	case EventDone:
+		return "done"
+	}
+	return fmt.Sprintf("PluginEventKind(%d)", int(k))
+}
+
+// PluginEvent is a step in the lifecycle of a request, see WithPluginEvents.
+type PluginEvent struct {
+	Kind   PluginEventKind
+	ID     string // Request ID.
+	Method string // Empty for EventCanceled.
+	Reason string // Sent by the host, EventCanceled only.
+}
+
+// WithPluginEvents makes the plugin report the lifecycle of requests to
+// fn, which lets tests synchronize with the plugin deterministically,
+// for example to cancel a request only once it was received instead of
+// relying on timing or log output (see pluggertest.Serve).
+// fn is invoked synchronously from the plugin's goroutines and must
+// not block. Events of a request are reported in order.
+func WithPluginEvents(fn func(PluginEvent)) PluginOption {
+	return func(c *pluginConfig) { c.onEvent = fn }
+}
+
+// event reports ev to the function set by WithPluginEvents.
+func (p *Plugin) event(ev PluginEvent) {
+	if p.onEvent != nil {
+		p.onEvent(ev)
+	}
+}
@@ -0,0 +1,99 @@
+package plugger
+
+import (
+	"errors"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// exitWaitTimeout is how long the host waits for a plugin that closed its
+// stdout on its own to exit before failing pending calls with ErrClosed.
+const exitWaitTimeout = time.Second
+
+// stderrTailSize is the number of bytes of stderr kept for ExitError.
+const stderrTailSize = 4 << 10
+
+// ExitError is returned by calls in progress and Host.Err if the plugin
+// exited on its own with a non-zero exit code or was killed by a signal.
+type ExitError struct {
+	Err    error  // Typically *exec.ExitError
+	Stderr string // The last bytes the plugin wrote to stderr
+}
+
+func (e *ExitError) Error() string { return "plugin exited: " + e.Err.Error() }
+
+// Unwrap returns ErrClosed and the error the process exited with.
+func (e *ExitError) Unwrap() []error { return []error{ErrClosed, e.Err} }
+
+// ExitCode returns the exit code of the plugin
+// or -1 if it was killed by a signal or the code is unknown.
+func (e *ExitError) ExitCode() int {
+	var errExit *exec.ExitError
+	if errors.As(e.Err, &errExit) {
+		return errExit.ExitCode()
+	}
+	return -1
+}
+
+// ExitError returns the *ExitError of the last plugin process if it
+// exited on its own with a non-zero exit code or was killed by a signal,
+// which carries its exit code and the end of its stderr. Returns nil
+// otherwise, including if the plugin panicked or timed out, which
+// Host.Err reports along with exits.
+func (h *Host) ExitError() error {
+	var errExit *ExitError
+	if !errors.As(h.Err(), &errExit) {
+		return nil
+	}
+	return errExit
+}
+
+// exited records the exit status of a plugin that stopped writing
+// responses on its own. No-op if the host is closing the plugin or it
+// already stopped with another error.
+func (p *process) exited(errRead error) {
+	if !errors.Is(errRead, io.EOF) && !errors.Is(errRead, io.ErrUnexpectedEOF) {
+		return // The plugin may still be running.
+	}
+	p.lock.Lock()
+	skip := p.closing || p.stopErr != nil
+	p.lock.Unlock()
+	if skip {
+		return
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- p.wait() }()
+	t := time.NewTimer(exitWaitTimeout)
+	defer t.Stop()
+	var err error
+	select {
+	case err = <-errc:
+	case <-t.C:
+		return // Reaped by close.
+	}
+	if err == nil {
+		return
+	}
+	var stderr string
+	if p.stderrTail != nil {
+		stderr = p.stderrTail.String()
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.closing && p.stopErr == nil {
+		p.stopErr = &ExitError{Err: err, Stderr: stderr}
+	}
+}
+
+// waitOnce returns a function invoking wait once
+// and returning its result to every caller.
+func waitOnce(wait func() error) func() error {
+	var once sync.Once
+	var err error
+	return func() error {
+		once.Do(func() { err = wait() })
+		return err
+	}
+}
@@ -0,0 +1,209 @@
+package plugger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// envFDSocket tells the plugin which file descriptor is the Unix socket
+// file descriptors are passed over, see WithFDPassing.
+const envFDSocket = "PLUGGER_FD_SOCKET"
+
+// WithFDPassing connects the plugin to a Unix domain socket over which
+// SendFD passes open files and connections (SCM_RIGHTS), which lets
+// the plugin operate on them directly instead of having their data
+// copied through the protocol. The socket is passed to the plugin as an
+// extra file descriptor announced in the PLUGGER_FD_SOCKET environment
+// variable. Only supported on Unix, RunPlugin returns
+// ErrFDPassingUnsupported elsewhere.
+func WithFDPassing() RunOption {
+	return func(c *runConfig) { c.fdPassing = true }
+}
+
+// WithFDWriteTimeout declares the plugin dead if passing a file descriptor
+// over the socket of WithFDPassing blocks for longer than d, which happens
+// once the plugin stopped receiving them. The plugin is killed and calls
+// awaiting responses return ErrWriteTimeout, which wraps ErrTimeout just
+// like ErrReadTimeout of WithReadTimeout does, so errors.Is(err,
+// ErrTimeout) catches both. Disabled by default, writes block until the
+// plugin receives them or exits.
+// Unix domain sockets have no keepalives (unlike TCP's SO_KEEPALIVE),
+// so the write deadline is the only detection of dead peers on the socket
+// and a plugin that stopped receiving is only detected by the next write.
+// Use WithReadTimeout to detect stuck plugins while no files are passed.
+func WithFDWriteTimeout(d time.Duration) RunOption {
+	return func(c *runConfig) { c.fdWriteTimeout = d }
+}
+
+// SendFD is like Call but also passes fd, an open file or connection,
+// to an endpoint registered with HandleFD. The plugin receives a duplicate
+// of fd, so the caller still owns and must close fd.
+// Returns ErrFDPassingUnsupported if the plugin wasn't launched with
+// WithFDPassing or doesn't support FeatureFDPassing.
+// Responses are never cached or coalesced.
+func SendFD[Req any, Resp any](
+	ctx context.Context, h *Host, fd uintptr, method string, req Req,
+	opts ...CallOption,
+) (Resp, error) {
+	var zero Resp
+	raw, err := marshal(req)
+	if err != nil {
+		return zero, fmt.Errorf("marshaling request: %w", err)
+	}
+	c := newCallConfig(opts)
+	c.coalesce = false
+	c.fd = &fd
+	resp, err := h.call(ctx, method, raw, c, nil)
+	if err != nil {
+		return zero, err
+	}
+	if err := unmarshal(resp.Data, &zero, h.useNumber.Load()); err != nil {
+		return zero, fmt.Errorf("%w: %w", ErrMalformedResponse, err)
+	}
+	return zero, nil
+}
+
+// sendFD passes fd for request id to the plugin.
+func (p *process) sendFD(id string, fd uintptr) error {
+	p.lock.Lock()
+	supported := p.fdConn != nil && p.features.has(FeatureFDPassing)
+	p.lock.Unlock()
+	if !supported {
+		return ErrFDPassingUnsupported
+	}
+	if p.fdWriteTimeout > 0 {
+		_ = p.fdConn.SetWriteDeadline(time.Now().Add(p.fdWriteTimeout))
+	}
+	err := writeFD(p.fdConn, id, fd)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		p.lock.Lock()
+		p.timedOut(ErrWriteTimeout)
+		p.lock.Unlock()
+		err = ErrWriteTimeout
+	}
+	if err != nil {
+		return fmt.Errorf("passing file descriptor: %w", err)
+	}
+	return nil
+}
+
+// HandleFD registers an endpoint receiving a file descriptor sent by
+// SendFD overwriting any existing endpoint. fn owns f and must close it.
+// Requests sent without a file descriptor fail. Files of requests failing
+// before fn is invoked are closed, just like those sent to endpoints not
+// registered with HandleFD.
+// Must be used before Run is invoked!
+func HandleFD[Req any, Resp any](
+	p *Plugin,
+	name string,
+	fn func(ctx context.Context, req Req, f *os.File) (Resp, error),
+) {
+	p.handle(name, func(
+		ctx context.Context, meta RequestMeta, raw json.RawMessage,
+		_ func(any) error,
+	) (any, error) {
+		var req Req
+		if err := unmarshal(raw, &req, p.useNumber); err != nil {
+			return nil, err
+		}
+		if !meta.fd {
+			return nil, errors.New("no file descriptor sent")
+		}
+		f, err := p.awaitFD(ctx, meta.ID)
+		if err != nil {
+			return nil, err
+		}
+		return fn(ctx, req, f)
+	})
+}
+
+// passedFD is the file passed for a request.
+type passedFD struct {
+	c    chan *os.File // receives the file once it arrived
+	done bool          // taken by the handler or released
+}
+
+// passedFD returns the file passed for request id.
+// p.lockFDs must be held.
+func (p *Plugin) passedFD(id string) *passedFD {
+	f, ok := p.fds[id]
+	if !ok {
+		f = &passedFD{c: make(chan *os.File, 1)}
+		p.fds[id] = f
+	}
+	return f
+}
+
+// awaitFD returns the file passed for request id. The host passes it
+// before sending the request, but it may arrive after the request.
+func (p *Plugin) awaitFD(ctx context.Context, id string) (*os.File, error) {
+	p.lockFDs.Lock()
+	fd := p.passedFD(id)
+	p.lockFDs.Unlock()
+	select {
+	case f := <-fd.c:
+		p.lockFDs.Lock()
+		fd.done = true
+		p.lockFDs.Unlock()
+		return f, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// releaseFD closes the file passed for request id unless the handler
+// took it, or closes it once it arrives. Called once the request completed.
+func (p *Plugin) releaseFD(id string) {
+	p.lockFDs.Lock()
+	defer p.lockFDs.Unlock()
+	fd := p.passedFD(id)
+	if fd.done {
+		delete(p.fds, id)
+		return
+	}
+	select {
+	case f := <-fd.c:
+		_ = f.Close()
+		delete(p.fds, id)
+	default:
+		fd.done = true // Closed by receiveFDs.
+	}
+}
+
+// receiveFDs receives files passed by the host until the socket is closed.
+func (p *Plugin) receiveFDs() {
+	for {
+		id, f, err := readFD(p.fdConn)
+		if err != nil {
+			return
+		}
+		p.lockFDs.Lock()
+		fd := p.passedFD(id)
+		if fd.done {
+			delete(p.fds, id)
+			_ = f.Close() // The request already completed.
+		} else {
+			fd.c <- f
+		}
+		p.lockFDs.Unlock()
+	}
+}
+
+// supportedFeatures returns the features the plugin supports, excluding
+// FeatureFDPassing unless the host launched it with WithFDPassing.
+func (p *Plugin) supportedFeatures() []string {
+	if p.fdConn != nil {
+		return supportedFeatures
+	}
+	l := make([]string, 0, len(supportedFeatures))
+	for _, f := range supportedFeatures {
+		if f != FeatureFDPassing {
+			l = append(l, f)
+		}
+	}
+	return l
+}
@@ -0,0 +1,22 @@
+//go:build !unix
+
+package plugger
+
+import (
+	"net"
+	"os"
+)
+
+func fdSocketPair() (*net.UnixConn, *os.File, error) {
+	return nil, nil, ErrFDPassingUnsupported
+}
+
+func writeFD(*net.UnixConn, string, uintptr) error {
+	return ErrFDPassingUnsupported
+}
+
+func readFD(*net.UnixConn) (string, *os.File, error) {
+	return "", nil, ErrFDPassingUnsupported
+}
+
+func pluginFDSocket() *net.UnixConn { return nil }
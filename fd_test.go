@@ -0,0 +1,86 @@
+package plugger_test
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/romshark/plugger"
+	"github.com/romshark/plugger/pluggertest"
+)
+
+func TestSendFD(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("not supported on windows")
+	}
+	f := pluggertest.MakeModule(t, "test_send_fd", "testdata/tfd_plugin_main.go.txt")
+	h := plugger.NewHost()
+	go func() {
+		_ = h.RunPlugin(t.Context(), f, pluggertest.NewLogWriter(t), plugger.WithFDPassing())
+	}()
+	defer func() { _ = h.Close() }()
+
+	t.Run("file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "data")
+		if err := os.WriteFile(path, []byte("file content"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		resp, err := plugger.SendFD[struct{}, string](
+			t.Context(), h, file.Fd(), "read", struct{}{},
+		)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if resp != "file content" {
+			t.Fatalf("unexpected response: %q", resp)
+		}
+	})
+
+	t.Run("pipe", func(t *testing.T) {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		_, err = plugger.SendFD[string, struct{}](
+			t.Context(), h, w.Fd(), "write", "written by plugin",
+		)
+		_ = w.Close() // The plugin closed its duplicate.
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "written by plugin" {
+			t.Fatalf("unexpected pipe content: %q", b)
+		}
+	})
+
+	t.Run("without_fd", func(t *testing.T) {
+		_, err := plugger.Call[struct{}, string](t.Context(), h, "read", struct{}{})
+		if !errors.Is(err, plugger.ErrorResponse("no file descriptor sent")) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestSendFDUnsupported(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_send_fd_unsupported",
+		"testdata/tfd_plugin_main.go.txt")
+	_, err := plugger.SendFD[struct{}, string](
+		t.Context(), h, os.Stdin.Fd(), "read", struct{}{},
+	)
+	if !errors.Is(err, plugger.ErrFDPassingUnsupported) {
+		t.Fatalf("expected ErrFDPassingUnsupported, got: %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+//go:build unix
+
+package plugger
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// fdSocketPair creates the socket file descriptors are passed over
+// returning the host's end and the plugin's end.
+func fdSocketPair() (*net.UnixConn, *os.File, error) {
+	// Keep the sockets from leaking into processes started concurrently.
+	syscall.ForkLock.RLock()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fds[0])
+		syscall.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating fd socket: %w", err)
+	}
+	child := os.NewFile(uintptr(fds[1]), "plugger-fd-plugin")
+	conn, err := fileUnixConn(os.NewFile(uintptr(fds[0]), "plugger-fd-host"))
+	if err != nil {
+		_ = child.Close()
+		return nil, nil, fmt.Errorf("creating fd socket: %w", err)
+	}
+	return conn, child, nil
+}
+
+// fileUnixConn returns the Unix socket of f and closes f.
+func fileUnixConn(f *os.File) (*net.UnixConn, error) {
+	defer f.Close()
+	c, err := net.FileConn(f)
+	if err != nil {
+		return nil, err
+	}
+	conn, ok := c.(*net.UnixConn)
+	if !ok {
+		_ = c.Close()
+		return nil, errors.New("not a unix socket")
+	}
+	return conn, nil
+}
+
+func writeFD(conn *net.UnixConn, id string, fd uintptr) error {
+	_, _, err := conn.WriteMsgUnix([]byte(id), syscall.UnixRights(int(fd)), nil)
+	return err
+}
+
+func readFD(conn *net.UnixConn) (id string, f *os.File, err error) {
+	buf := make([]byte, 64)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return "", nil, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) != 1 {
+		return "", nil, fmt.Errorf("parsing control message: %w", err)
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil || len(fds) != 1 {
+		return "", nil, fmt.Errorf("parsing unix rights: %w", err)
+	}
+	syscall.CloseOnExec(fds[0])
+	id = string(buf[:n])
+	return id, os.NewFile(uintptr(fds[0]), "plugger-fd-"+id), nil
+}
+
+// pluginFDSocket returns the socket the host passes file descriptors
+// over, nil if it didn't launch the plugin with WithFDPassing.
+func pluginFDSocket() *net.UnixConn {
+	v := os.Getenv(envFDSocket)
+	if v == "" {
+		return nil
+	}
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		panic(fmt.Errorf("invalid %s: %q", envFDSocket, v))
+	}
+	// Don't pass the socket on to processes launched by the plugin.
+	_ = os.Unsetenv(envFDSocket)
+	conn, err := fileUnixConn(os.NewFile(uintptr(fd), "plugger-fd"))
+	if err != nil {
+		panic(fmt.Errorf("invalid %s: %w", envFDSocket, err))
+	}
+	return conn
+}
@@ -0,0 +1,86 @@
+//go:build unix
+
+package plugger_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/romshark/plugger"
+	"github.com/romshark/plugger/pluggertest"
+)
+
+func TestFDWriteTimeout(t *testing.T) {
+	f := pluggertest.MakeModule(t, "test_fd_write_timeout", "testdata/tfd_plugin_main.go.txt")
+	h := plugger.NewHost()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- h.RunPlugin(t.Context(), f, pluggertest.NewLogWriter(t),
+			plugger.WithFDPassing(), plugger.WithFDWriteTimeout(100*time.Millisecond))
+	}()
+	defer func() { _ = h.Close() }()
+
+	pid, err := plugger.Call[struct{}, int](t.Context(), h, "pid", struct{}{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The stopped plugin no longer receives files.
+	if err := syscall.Kill(pid, syscall.SIGSTOP); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = syscall.Kill(pid, syscall.SIGCONT) }()
+
+	file, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	for range 1000 {
+		ctx, cancel := context.WithTimeout(t.Context(), 10*time.Millisecond)
+		_, err = plugger.SendFD[struct{}, string](ctx, h, file.Fd(), "read", struct{}{})
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			break
+		}
+	}
+	if !errors.Is(err, plugger.ErrWriteTimeout) || !errors.Is(err, plugger.ErrTimeout) {
+		t.Fatalf("expected ErrWriteTimeout, got: %v", err)
+	}
+	if err := <-errs; !errors.Is(err, plugger.ErrWriteTimeout) {
+		t.Fatalf("expected RunPlugin to return ErrWriteTimeout, got: %v", err)
+	}
+}
+
+func TestFDClosedOnFailure(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_fd_closed_on_failure",
+		"testdata/tfd_plugin_main.go.txt", plugger.WithFDPassing())
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	// Unknown method and a request the handler can't unmarshal.
+	_, err = plugger.SendFD[struct{}, struct{}](t.Context(), h, w.Fd(), "missing", struct{}{})
+	if err == nil {
+		t.Fatal("expected an error for the unknown method")
+	}
+	_, err = plugger.SendFD[int, struct{}](t.Context(), h, w.Fd(), "write", 1)
+	if err == nil {
+		t.Fatal("expected an error for the malformed request")
+	}
+	_ = w.Close()
+
+	// EOF once the plugin closed its duplicates of w.
+	if err := r.SetReadDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the plugin to close the passed files, got: %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package plugger
+
+import (
+	"context"
+	"sync"
+)
+
+// WithFlowControl limits the stream items the plugin may send ahead of
+// the caller to initialCredits. The plugin spends a credit per stream
+// item and blocks once it ran out of credits until the host grants more,
+// which it does once the caller processed all but lowWater of the
+// granted items, topping them up to initialCredits again.
+// This bounds the memory used by fast producers and propagates the
+// backpressure of the caller to the plugin without stalling other calls,
+// unlike WithReceiveBuffer. Ignored if initialCredits is less than 1,
+// lowWater is clamped to [0, initialCredits). Plugins not supporting
+// FeatureFlowControl send stream items without flow control.
+func WithFlowControl(initialCredits, lowWater int) CallOption {
+	return func(c *callConfig) {
+		if initialCredits < 1 {
+			return
+		}
+		c.credits = initialCredits
+		c.lowWater = min(max(lowWater, 0), initialCredits-1)
+	}
+}
+
+// grantCredits grants the plugin n more stream items of request id.
+func (p *process) grantCredits(id string, n int) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err := p.send(envelope{Credit: id, Credits: n}); err != nil {
+		return err
+	}
+	return p.flushLocked() // The plugin may be blocked waiting for it.
+}
+
+// flowCredits are the stream items a request may still send.
+type flowCredits struct {
+	lock    sync.Mutex
+	n       int
+	granted chan struct{} // signaled whenever credits are granted
+}
+
+func newFlowCredits(n int) *flowCredits {
+	return &flowCredits{n: n, granted: make(chan struct{}, 1)}
+}
+
+// take spends a credit waiting until one is granted if necessary.
+func (f *flowCredits) take(ctx context.Context) error {
+	for {
+		f.lock.Lock()
+		if f.n > 0 {
+			f.n--
+			f.lock.Unlock()
+			return nil
+		}
+		f.lock.Unlock()
+		select {
+		case <-f.granted:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (f *flowCredits) grant(n int) {
+	f.lock.Lock()
+	f.n += n
+	f.lock.Unlock()
+	select {
+	case f.granted <- struct{}{}:
+	default: // Already signaled.
+	}
+}
+
+// grantCredits adds credits granted by the host to request id.
+// No-op if the request doesn't use flow control or already completed.
+func (p *Plugin) grantCredits(id string, n int) {
+	p.lockCancel.Lock()
+	f := p.flows[id]
+	p.lockCancel.Unlock()
+	if f != nil {
+		f.grant(n)
+	}
+}
@@ -0,0 +1,141 @@
+package plugger
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// decoder reads envelopes.
+type decoder interface {
+	Decode(v any) error
+
+	// buffered returns the data read but not decoded yet.
+	buffered() []byte
+}
+
+// newDecoder returns a decoder of concatenated JSON values,
+// or of newline-delimited JSON (NDJSON) if ndjson is set.
+// r is buffered by a buffer of bufSize bytes, see newReader.
+func newDecoder(r io.Reader, ndjson bool, bufSize int) decoder {
+	if ndjson {
+		return &ndjsonDecoder{r: bufio.NewReaderSize(r, bufferSize(bufSize))}
+	}
+	r = newReader(r, bufSize)
+	br, _ := r.(*bufio.Reader)
+	return &jsonDecoder{Decoder: json.NewDecoder(r), r: br, src: r, size: bufSize}
+}
+
+// binaryFrames returns a decoder of d's remaining input that accepts
+// binary frames (see frameBinary) besides NDJSON. Peers sending binary
+// frames write NDJSON, which concatenated JSON values decoded by d
+// so far were as well.
+func binaryFrames(d decoder) decoder {
+	switch d := d.(type) {
+	case *jsonDecoder:
+		r := io.MultiReader(d.Decoder.Buffered(), d.src)
+		return &ndjsonDecoder{r: bufio.NewReaderSize(r, bufferSize(d.size)), binary: true}
+	case *ndjsonDecoder:
+		d.binary = true
+	}
+	return d
+}
+
+// jsonDecoder reads concatenated JSON values.
+type jsonDecoder struct {
+	*json.Decoder
+	r    *bufio.Reader // nil if unbuffered
+	src  io.Reader     // Decoder reads from
+	size int           // of the read buffer, see newDecoder
+}
+
+func (d *jsonDecoder) buffered() []byte {
+	b, _ := io.ReadAll(d.Decoder.Buffered())
+	return append(b, peekBuffered(d.r)...)
+}
+
+// peekBuffered returns the data buffered by r without reading more.
+// Safe to call with nil.
+func peekBuffered(r *bufio.Reader) []byte {
+	if r == nil {
+		return nil
+	}
+	b, _ := r.Peek(r.Buffered())
+	return bytes.Clone(b)
+}
+
+// WithNDJSON makes the host require the plugin to write exactly one
+// envelope per line (NDJSON), which is what plugins built with this
+// package do. By default any concatenation of JSON values is accepted.
+// RunPlugin returns ErrInvalidFrame once a line isn't a single envelope.
+func WithNDJSON() RunOption {
+	return func(c *runConfig) { c.ndjson = true }
+}
+
+// ExitCodeInvalidFrame is returned by Run once the host wrote an invalid
+// frame, see WithPluginNDJSON.
+const ExitCodeInvalidFrame = 2
+
+// WithPluginNDJSON makes the plugin require the host to write exactly one
+// envelope per line (NDJSON), which is what hosts of this package do.
+// Run writes the violation to stderr and returns ExitCodeInvalidFrame once
+// a line isn't a single envelope, see SetStrictProtocol.
+func WithPluginNDJSON() PluginOption {
+	return func(c *pluginConfig) { c.ndjson = true }
+}
+
+// ndjsonDecoder reads one JSON value per line. Empty lines are skipped.
+type ndjsonDecoder struct {
+	r      *bufio.Reader
+	binary bool // binary frames are accepted, see binaryFrames
+}
+
+func (d *ndjsonDecoder) buffered() []byte { return peekBuffered(d.r) }
+
+func (d *ndjsonDecoder) Decode(v any) error {
+	for {
+		line, err := d.r.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) == 0 {
+			if err != nil {
+				return err // Not even a partial line left.
+			}
+			continue
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if d.binary && line[0] == frameBinary {
+			return d.decodeBinary(line[1:], v)
+		}
+		if err := json.Unmarshal(line, v); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidFrame, err)
+		}
+		return nil
+	}
+}
+
+// decodeBinary decodes the envelope header of a binary frame
+// and reads the data following it.
+func (d *ndjsonDecoder) decodeBinary(header []byte, v any) error {
+	ev, ok := v.(*envelope)
+	if !ok {
+		return fmt.Errorf("%w: unexpected binary frame", ErrInvalidFrame)
+	}
+	if err := json.Unmarshal(header, ev); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidFrame, err)
+	}
+	if ev.Binary < 0 || ev.Binary > maxBinaryFrame {
+		return fmt.Errorf("%w: invalid binary length %d", ErrInvalidFrame, ev.Binary)
+	}
+	ev.bin = make([]byte, ev.Binary)
+	if _, err := io.ReadFull(d.r, ev.bin); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("%w: binary data: %w", ErrInvalidFrame, err)
+	}
+	return nil
+}
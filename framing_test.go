@@ -0,0 +1,160 @@
+package plugger_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/romshark/plugger"
+	"github.com/romshark/plugger/pluggertest"
+)
+
+func TestNDJSON(t *testing.T) {
+	t.Run("concatenated", func(t *testing.T) {
+		h := plugger.NewHost()
+		go func() {
+			_ = h.RunPlugin(t.Context(), "testdata/test_multiline_executable.sh",
+				pluggertest.NewLogWriter(t))
+		}()
+		defer func() { _ = h.Close() }()
+
+		resp, err := plugger.Call[struct{}, string](t.Context(), h, "hello", struct{}{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if resp != "hello" {
+			t.Fatalf("unexpected response: %q", resp)
+		}
+	})
+
+	t.Run("ndjson", func(t *testing.T) {
+		h := plugger.NewHost()
+		err := h.RunPlugin(t.Context(), "testdata/test_multiline_executable.sh",
+			pluggertest.NewLogWriter(t), plugger.WithNDJSON())
+		if !errors.Is(err, plugger.ErrInvalidFrame) {
+			t.Fatalf("expected ErrInvalidFrame, got: %v", err)
+		}
+	})
+
+	t.Run("ndjson_plugger_plugin", func(t *testing.T) {
+		f := pluggertest.MakeModule(t, "test_ndjson", "testdata/t1_plugin_main.go.txt")
+		h := plugger.NewHost()
+		go func() {
+			_ = h.RunPlugin(t.Context(), f, pluggertest.NewLogWriter(t), plugger.WithNDJSON())
+		}()
+		defer func() { _ = h.Close() }()
+		testPlugin(t, h)
+	})
+}
+
+func TestPluginNDJSON(t *testing.T) {
+	reqR, reqW := io.Pipe()
+	p := plugger.NewPlugin(plugger.WithPluginIO(reqR, io.Discard),
+		plugger.WithPluginNDJSON())
+	done := make(chan int, 1)
+	go func() { done <- p.Run(t.Context()) }()
+
+	_, err := io.WriteString(reqW, `{"id":"1","method":"a"}{"id":"2","method":"b"}`+"\n")
+	if err != nil {
+		t.Fatalf("writing request: %v", err)
+	}
+	if code := <-done; code != plugger.ExitCodeInvalidFrame {
+		t.Fatalf("unexpected exit code: %d", code)
+	}
+}
+
+func TestBinaryFrameTooLarge(t *testing.T) {
+	h := plugger.NewHost()
+	errRun := make(chan error, 1)
+	go func() {
+		errRun <- h.RunPlugin(t.Context(), "testdata/test_binary_executable.sh",
+			pluggertest.NewLogWriter(t))
+	}()
+	defer func() { _ = h.Close() }()
+
+	r, _ := plugger.CallBinaryStream[struct{}, struct{}](t.Context(), h, "bytes", struct{}{})
+	if _, err := io.ReadAll(r); !errors.Is(err, plugger.ErrClosed) {
+		t.Fatalf("expected ErrClosed, got: %v", err)
+	}
+	if err := <-errRun; !errors.Is(err, plugger.ErrInvalidFrame) {
+		t.Fatalf("expected ErrInvalidFrame, got: %v", err)
+	}
+}
+
+func TestBufferSizes(t *testing.T) {
+	for _, size := range []int{-1, 64, 1 << 16} {
+		t.Run(fmt.Sprintf("size_%d", size), func(t *testing.T) {
+			t.Setenv("TEST_BUFFER_SIZE", strconv.Itoa(size))
+			h, _ := pluggertest.Launch(t, t.Context(), "test_buffer_sizes",
+				"testdata/tbuffer_plugin_main.go.txt",
+				plugger.WithReadBufferSize(size),
+				plugger.WithWriteBuffer(100*time.Microsecond),
+				plugger.WithWriteBufferSize(size))
+
+			large := strings.Repeat("x", 100_000)
+			var wg sync.WaitGroup
+			for i := range 32 {
+				req := strconv.Itoa(i)
+				if i%8 == 0 {
+					req = large
+				}
+				wg.Go(func() {
+					resp, err := plugger.Call[string, string](
+						t.Context(), h, "echo", req,
+					)
+					if err != nil {
+						t.Errorf("unexpected error: %v", err)
+					} else if resp != req {
+						t.Errorf("unexpected response of %d bytes", len(resp))
+					}
+				})
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestPluginFlushesEachMessage(t *testing.T) {
+	reqR, reqW := io.Pipe()
+	respR, respW := io.Pipe()
+	// Larger than any response, without per-message flushing
+	// the response would never reach the host.
+	out := bufio.NewWriterSize(respW, 1<<16)
+	p := plugger.NewPlugin(plugger.WithPluginIO(reqR, out))
+	plugger.Handle(p, "add", func(_ context.Context, r AddReq) (AddResp, error) {
+		return AddResp{Sum: r.A + r.B}, nil
+	})
+	done := make(chan int, 1)
+	go func() { done <- p.Run(t.Context()) }()
+
+	_, err := io.WriteString(reqW, `{"id":"1","method":"add","data":{"a":1,"b":2}}`+"\n")
+	if err != nil {
+		t.Fatalf("writing request: %v", err)
+	}
+	lines := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(respR).ReadString('\n')
+		lines <- line
+	}()
+	select {
+	case line := <-lines:
+		if !strings.Contains(line, `"sum":3`) {
+			t.Fatalf("unexpected response: %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("response wasn't flushed")
+	}
+
+	_ = reqW.Close()
+	go func() { _, _ = io.Copy(io.Discard, respR) }()
+	if code := <-done; code != 0 {
+		t.Fatalf("unexpected exit code: %d", code)
+	}
+}
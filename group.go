@@ -0,0 +1,119 @@
+package plugger
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+)
+
+// CallGroup tracks the calls made with WithCallGroup, for example calls
+// fanned out for the same task, to cancel them together. Canceling a
+// group sends a single batched cancelation (see FeatureCancelBatch)
+// instead of one per call as canceling a shared parent context does.
+// The zero value is an empty group.
+type CallGroup struct {
+	lock     sync.Mutex
+	calls    map[*pendingCall]groupCall
+	canceled bool
+}
+
+// groupCall is a call of a group awaiting its response.
+type groupCall struct {
+	p      *process
+	remote bool // whether the plugin is notified, see WithoutRemoteCancel
+	reason string
+}
+
+// WithCallGroup adds the call to g until it completes.
+// The call fails with ErrCanceledByHost if g is already canceled.
+func WithCallGroup(g *CallGroup) CallOption {
+	return func(c *callConfig) { c.group = g }
+}
+
+// Cancel cancels all calls of the group awaiting their response as if
+// they were canceled by Host.CancelCall. Calls made with the group
+// afterwards fail right away. Calls using WithCancelReason are
+// batched separately for each reason.
+func (g *CallGroup) Cancel() {
+	g.lock.Lock()
+	calls := g.calls
+	g.calls, g.canceled = nil, true
+	g.lock.Unlock()
+
+	byProc := make(map[*process]map[*pendingCall]groupCall)
+	for pc, gc := range calls {
+		if byProc[gc.p] == nil {
+			byProc[gc.p] = make(map[*pendingCall]groupCall)
+		}
+		byProc[gc.p][pc] = gc
+	}
+	for p, calls := range byProc {
+		_ = p.cancelGroup(calls) // Failed writes surface as EOF in run().
+	}
+}
+
+// add adds pc sent to p to the group.
+// Returns false if the group is canceled.
+func (g *CallGroup) add(pc *pendingCall, p *process, c *callConfig) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.canceled {
+		return false
+	}
+	if g.calls == nil {
+		g.calls = make(map[*pendingCall]groupCall)
+	}
+	gc := groupCall{
+		p:      p,
+		remote: !c.noRemoteCancel,
+		reason: cmp.Or(c.cancelReason, ErrCanceledByHost.Error()),
+	}
+	g.calls[pc] = gc
+	return true
+}
+
+func (g *CallGroup) remove(pc *pendingCall) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	delete(g.calls, pc)
+}
+
+// cancelGroup cancels calls and asks the plugin to abort their requests
+// in as few envelopes as WithCancelBatch allows.
+func (p *process) cancelGroup(calls map[*pendingCall]groupCall) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	byReason := make(map[string][]string)
+	for pc, gc := range calls {
+		select {
+		case <-pc.canceled: // Already canceled by CancelCall.
+			continue
+		default:
+		}
+		if gc.remote {
+			pc.remoteCanceled.Store(true)
+			reason := gc.reason
+			if !p.features.has(FeatureCancelReason) {
+				reason = ""
+			}
+			byReason[reason] = append(byReason[reason], pc.info.ID)
+		}
+		close(pc.canceled)
+	}
+	for reason, ids := range byReason {
+		if p.maxCancelBatch < 2 || !p.features.has(FeatureCancelBatch) {
+			for _, id := range ids {
+				if err := p.send(envelope{Cancel: id, Reason: reason}); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		for batch := range slices.Chunk(ids, p.maxCancelBatch) {
+			if err := p.send(envelope{Cancels: batch, Reason: reason}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
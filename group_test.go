@@ -0,0 +1,70 @@
+package plugger_test
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/romshark/plugger"
+	"github.com/romshark/plugger/pluggertest"
+)
+
+func TestCallGroup(t *testing.T) {
+	for _, batch := range []int{1, 4, 64} {
+		t.Run(fmt.Sprintf("batch_%d", batch), func(t *testing.T) {
+			h, _ := pluggertest.Launch(t, t.Context(), "test_call_group",
+				"testdata/tcount_plugin_main.go.txt",
+				plugger.WithCancelBatch(batch))
+			waitActive(t, h, 0) // Wait for the plugin to start.
+
+			// A call outside of the group isn't canceled.
+			other := make(chan error, 1)
+			go func() {
+				_, err := plugger.Call[struct{}, struct{}](
+					t.Context(), h, "wait", struct{}{},
+				)
+				other <- err
+			}()
+			waitActive(t, h, 1)
+
+			var g plugger.CallGroup
+			var wg sync.WaitGroup
+			errs := make(chan error, 50)
+			for i := range 50 {
+				opts := []plugger.CallOption{plugger.WithCallGroup(&g)}
+				if i%10 == 0 {
+					opts = append(opts, plugger.WithCancelReason("custom"))
+				}
+				wg.Go(func() {
+					_, err := plugger.Call[struct{}, struct{}](
+						t.Context(), h, "wait", struct{}{}, opts...,
+					)
+					errs <- err
+				})
+			}
+			waitActive(t, h, 51)
+			g.Cancel()
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if !errors.Is(err, plugger.ErrCanceledByHost) {
+					t.Fatalf("expected ErrCanceledByHost, got: %v", err)
+				}
+			}
+			waitActive(t, h, 1) // The plugin aborted all grouped requests.
+
+			_, err := plugger.Call[struct{}, struct{}](
+				t.Context(), h, "wait", struct{}{}, plugger.WithCallGroup(&g),
+			)
+			if !errors.Is(err, plugger.ErrCanceledByHost) {
+				t.Fatalf("expected ErrCanceledByHost, got: %v", err)
+			}
+			select {
+			case err := <-other:
+				t.Fatalf("unexpected result of ungrouped call: %v", err)
+			default:
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package plugger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// ReplaceHandlers atomically replaces all endpoints of the running plugin
+// by those register registers using Handle and its variants, for example
+// to load a new ruleset without restarting the plugin. Requests received
+// afterwards use the new endpoints while requests in progress complete
+// against the endpoints they were dispatched to. register must register
+// all endpoints synchronously. May also be used before Run is invoked.
+func (p *Plugin) ReplaceHandlers(register func(p *Plugin)) {
+	p.lockReplace.Lock()
+	defer p.lockReplace.Unlock()
+	endpoints := map[string]endpoint{}
+	p.lockEndpoints.Lock()
+	p.staging = endpoints
+	p.lockEndpoints.Unlock()
+	defer func() {
+		p.lockEndpoints.Lock()
+		p.staging = nil
+		p.lockEndpoints.Unlock()
+	}()
+	register(p)
+	p.lockEndpoints.Lock()
+	defer p.lockEndpoints.Unlock()
+	p.endpoints.Store(&endpoints)
+}
+
+// handle registers an endpoint overwriting any existing endpoint.
+// Panics if the plugin is running unless used by ReplaceHandlers.
+// Panics if name is empty since hosts never call empty method names.
+func (p *Plugin) handle(name string, fn endpoint) {
+	if name == "" {
+		panic(ErrEmptyMethod)
+	}
+	p.lockEndpoints.Lock()
+	defer p.lockEndpoints.Unlock()
+	if p.staging != nil {
+		p.staging[name] = fn
+		return
+	}
+	if p.running.Load() {
+		panic("add handlers before invoking Run")
+	}
+	(*p.endpoints.Load())[name] = fn
+}
+
+// HandleWithLimits is like Handle but rejects requests whose JSON
+// data exceeds maxReqBytes with ErrPayloadTooLarge before unmarshaling
+// them, which cheaply protects endpoints expecting small inputs
+// from oversized requests. Calls of hosts supporting FeatureErrorCode
+// fail with an error wrapping ErrPayloadTooLarge.
+// Must be used before Run is invoked!
+func HandleWithLimits[Req any, Resp any](
+	p *Plugin,
+	name string,
+	maxReqBytes int,
+	fn func(context.Context, Req) (Resp, error),
+) {
+	p.handle(name, func(
+		ctx context.Context, _ RequestMeta, raw json.RawMessage, _ func(any) error,
+	) (any, error) {
+		if len(raw) > maxReqBytes {
+			return nil, fmt.Errorf("%w: %d bytes exceed the limit of %d",
+				ErrPayloadTooLarge, len(raw), maxReqBytes)
+		}
+		var req Req
+		if err := unmarshal(raw, &req, p.useNumber); err != nil {
+			return nil, err
+		}
+		return fn(ctx, req)
+	})
+}
+
+var (
+	typeContext = reflect.TypeFor[context.Context]()
+	typeError   = reflect.TypeFor[error]()
+)
+
+// RegisterStruct registers the exported methods of obj shaped like
+// func(context.Context, Req) (Resp, error) as endpoints named after
+// the methods, similar to how net/rpc registers services. Pass a pointer
+// to register methods with pointer receivers too. Methods not taking
+// a context.Context first are skipped. Returns an error naming the method
+// and registers nothing if a method taking a context.Context has another
+// shape, or if obj has no such methods at all.
+// Must be used before Run is invoked!
+func RegisterStruct(p *Plugin, obj any) error {
+	v := reflect.ValueOf(obj)
+	endpoints := map[string]endpoint{}
+	for i := range v.NumMethod() {
+		name, m := v.Type().Method(i).Name, v.Method(i)
+		t := m.Type()
+		if t.NumIn() == 0 || t.In(0) != typeContext {
+			continue
+		}
+		if t.NumIn() != 2 || t.NumOut() != 2 || t.Out(1) != typeError {
+			return fmt.Errorf("method %s of %T: expected "+
+				"func(context.Context, Req) (Resp, error), got %v", name, obj, t)
+		}
+		endpoints[name] = func(
+			ctx context.Context, _ RequestMeta, raw json.RawMessage, _ func(any) error,
+		) (any, error) {
+			req := reflect.New(t.In(1))
+			err := unmarshalType(raw, t.In(1), req.Interface(), p.useNumber)
+			if err != nil {
+				return nil, err
+			}
+			out := m.Call([]reflect.Value{reflect.ValueOf(ctx), req.Elem()})
+			err, _ = out[1].Interface().(error)
+			return out[0].Interface(), err
+		}
+	}
+	if len(endpoints) == 0 {
+		return fmt.Errorf("%T has no exported methods "+
+			"shaped like func(context.Context, Req) (Resp, error)", obj)
+	}
+	for name, fn := range endpoints {
+		p.handle(name, fn)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package plugger_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/romshark/plugger"
+	"github.com/romshark/plugger/pluggertest"
+)
+
+func TestReplaceHandlers(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_replace_handlers",
+		"testdata/treplace_plugin_main.go.txt")
+
+	version := func(method string) string {
+		t.Helper()
+		v, err := plugger.Call[struct{}, string](t.Context(), h, method, struct{}{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return v
+	}
+	if v := version("version"); v != "v1" {
+		t.Fatalf("expected v1, got %q", v)
+	}
+	if _, err := plugger.Call[struct{}, struct{}](
+		t.Context(), h, "initial", struct{}{},
+	); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Requests in progress complete against their handler set.
+	slow := make(chan string, 1)
+	go func() {
+		v, _ := plugger.Call[struct{}, string](
+			t.Context(), h, "slow_version", struct{}{},
+		)
+		slow <- v
+	}()
+	// Requests are dispatched in the order they're sent.
+	if !eventually(func() bool { return h.DebugStats().PendingCalls == 1 }) {
+		t.Fatal("call wasn't sent")
+	}
+	if _, err := plugger.Call[string, struct{}](
+		t.Context(), h, "reload", "v2",
+	); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if v := version("version"); v != "v2" {
+		t.Fatalf("expected v2, got %q", v)
+	}
+	if v := <-slow; v != "v1" {
+		t.Fatalf("expected v1 from the request in progress, got %q", v)
+	}
+
+	// Endpoints not registered again are gone.
+	_, err := plugger.Call[struct{}, struct{}](t.Context(), h, "initial", struct{}{})
+	if !errors.Is(err, plugger.ErrorResponse("unknown method: initial")) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestReplaceHandlersConcurrent(t *testing.T) {
+	p := plugger.NewPlugin()
+	fn := func(context.Context, struct{}) (struct{}, error) { return struct{}{}, nil }
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		for range 100 {
+			p.ReplaceHandlers(func(p *plugger.Plugin) { plugger.Handle(p, "a", fn) })
+		}
+	})
+	for range 100 {
+		plugger.Handle(p, "b", fn)
+	}
+	wg.Wait()
+}
+
+func TestHandleWithLimits(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_handle_with_limits",
+		"testdata/tlimits_plugin_main.go.txt")
+
+	resp, err := plugger.Call[string, string](t.Context(), h, "lookup", "42")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp != "found 42" {
+		t.Fatalf("unexpected response: %q", resp)
+	}
+
+	_, err = plugger.Call[string, string](
+		t.Context(), h, "lookup", strings.Repeat("x", 15),
+	)
+	const expect = `payload too large: 17 bytes exceed the limit of 16`
+	if !errors.Is(err, plugger.ErrorResponse(expect)) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !errors.Is(err, plugger.ErrPayloadTooLarge) {
+		t.Fatalf("expected ErrPayloadTooLarge, got: %v", err)
+	}
+
+	n, err := plugger.Call[[]byte, int](
+		t.Context(), h, "upload", make([]byte, 512<<10),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n != 512<<10 {
+		t.Fatalf("unexpected size: %d", n)
+	}
+}
+
+type badService struct{}
+
+func (badService) Add(_ context.Context, a, b int) (int, error) { return a + b, nil }
+
+func TestRegisterStruct(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_register_struct",
+		"testdata/tregister_plugin_main.go.txt")
+
+	resp, err := plugger.Call[AddReq, AddResp](
+		t.Context(), h, "Add", AddReq{A: 1, B: 2},
+	)
+	if err != nil || resp.Sum != 3 {
+		t.Fatalf("unexpected result: %#v, %v", resp, err)
+	}
+	greeting, err := plugger.Call[string, string](t.Context(), h, "Greet", "world")
+	if err != nil || greeting != "hello, world" {
+		t.Fatalf("unexpected result: %q, %v", greeting, err)
+	}
+	_, err = plugger.Call[string, string](t.Context(), h, "Greet", "")
+	if !errors.Is(err, plugger.ErrorResponse("missing name")) {
+		t.Fatalf("expected error response, got: %v", err)
+	}
+	_, err = plugger.Call[struct{}, string](t.Context(), h, "Name", struct{}{})
+	if err == nil || !strings.Contains(err.Error(), "unknown method") {
+		t.Fatalf("expected unknown method, got: %v", err)
+	}
+
+	p := plugger.NewPlugin(plugger.WithCallTracking())
+	err = plugger.RegisterStruct(p, badService{})
+	if err == nil || !strings.Contains(err.Error(), "method Add") {
+		t.Fatalf("expected error naming the method, got: %v", err)
+	}
+	if err := plugger.RegisterStruct(p, struct{}{}); err == nil {
+		t.Fatal("expected error for a struct without endpoints")
+	}
+	if m := p.UncalledMethods(); len(m) != 0 {
+		t.Fatalf("unexpected registered methods: %q", m)
+	}
+}
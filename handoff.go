@@ -0,0 +1,188 @@
+package plugger
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// HostState is the connection state of a running plugin exported by
+// Host.ExportState, which lets another host adopt the plugin using
+// AdoptHost without restarting it, for example during a deploy of the
+// host. All fields but the pipes are serializable as JSON.
+type HostState struct {
+	PID      int        `json:"pid"`
+	Version  string     `json:"version"`  // Negotiated protocol version.
+	Features []string   `json:"features"` // Negotiated features.
+	Build    *BuildInfo `json:"build,omitempty"`
+	LastID   uint64     `json:"lastId"`             // Last request ID used.
+	Buffered []byte     `json:"buffered,omitempty"` // Responses read but not decoded yet.
+
+	// Requests and Responses are the pipes the protocol is spoken over.
+	// Pass them to the adopting process, for example through
+	// exec.Cmd.ExtraFiles, and set them again before calling AdoptHost.
+	Requests  *os.File `json:"-"`
+	Responses *os.File `json:"-"`
+}
+
+// ExportState hands the running plugin over to another host: it stops
+// reading responses and closes the host without stopping the plugin.
+// Calls awaiting their response are canceled and fail with ErrHandedOff,
+// so they can be retried on the adopting host. RunPlugin returns
+// ErrHandedOff.
+// The plugin's stderr remains connected to this host, use a file such as
+// os.Stderr with WithStderr to keep it valid after this process exits.
+// Only supported on Unix for plugins launched without WithFDPassing
+// and WithPTY, returns ErrHandoffUnsupported otherwise.
+// Returns ErrClosed if the plugin isn't running.
+func (h *Host) ExportState(ctx context.Context) (*HostState, error) {
+	h.lock.Lock()
+	p := h.proc
+	h.lock.Unlock()
+	switch {
+	case p == nil:
+		return nil, ErrClosed
+	case !handoffSupported || p.fdConn != nil || p.pty != nil:
+		return nil, ErrHandoffUnsupported
+	}
+
+	h.lock.Lock()
+	if h.proc != p {
+		h.lock.Unlock()
+		return nil, ErrClosed
+	}
+	h.proc, h.closed = nil, true // Calls from now on fail.
+	if h.idleTimer != nil {
+		h.idleTimer.Stop()
+	}
+	h.lock.Unlock()
+
+	// Read responses until the one to the marker request. Responses
+	// to calls canceled in the meantime go to the adopting host,
+	// which discards them.
+	id := fmt.Sprintf("%x", h.idCounter.Add(1))
+	p.lock.Lock()
+	p.handoffID = id
+	err := p.sendCancelsLocked()
+	for pendingID := range p.pending {
+		if err != nil {
+			break
+		}
+		err = p.send(envelope{Cancel: pendingID}) // Retried on the adopting host.
+	}
+	if err == nil {
+		err = p.send(envelope{ID: id, Method: methodEcho})
+	}
+	if err == nil {
+		err = p.flushLocked()
+	}
+	if p.flushTimer != nil {
+		p.flushTimer.Stop()
+	}
+	p.lock.Unlock()
+	if err != nil {
+		go func() { _ = p.close() }()
+		return nil, fmt.Errorf("writing handoff request: %w", err)
+	}
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		go func() { _ = p.close() }()
+		return nil, causeErr(ctx)
+	}
+
+	p.lock.Lock()
+	stopErr := p.stopErr
+	s := &HostState{
+		PID: p.osProc.Pid, Version: p.version, Features: p.features.list(),
+		Build: p.build, LastID: h.idCounter.Load(), Buffered: p.leftover,
+	}
+	p.lock.Unlock()
+	if !errors.Is(stopErr, ErrHandedOff) {
+		go func() { _ = p.close() }()
+		return nil, fmt.Errorf("plugin stopped responding: %w", cmp.Or(stopErr, ErrClosed))
+	}
+	if s.Requests, err = dupFile(p.stdin, "plugger-requests"); err == nil {
+		if s.Responses, err = dupFile(p.output, "plugger-responses"); err != nil {
+			_ = s.Requests.Close()
+		}
+	}
+	if err != nil {
+		go func() { _ = p.close() }()
+		return nil, err
+	}
+
+	// The duplicates keep the pipes open.
+	_ = p.stdin.Close()
+	p.closeFiles()
+	p.release()
+	go func() { _ = p.wait() }() // Reap the plugin once it exits.
+	return s, nil
+}
+
+// AdoptHost creates a host for the plugin exported by Host.ExportState,
+// possibly in another process. Responses are read in the background
+// like for plugins launched lazily (see Configure), Host.Err returns
+// why the plugin stopped responding. opts configure the connection,
+// options affecting the launch are ignored. Closing the host closes
+// the plugin's stdin but its exit code is unknown, since the plugin
+// isn't a child process of the adopting host.
+// Returns ErrHandoffUnsupported on platforms other than Unix.
+func AdoptHost(state *HostState, opts ...RunOption) (*Host, error) {
+	if !handoffSupported {
+		return nil, ErrHandoffUnsupported
+	}
+	if state.Requests == nil || state.Responses == nil {
+		return nil, errors.New("missing protocol pipes")
+	}
+	proc, err := os.FindProcess(state.PID)
+	if err != nil {
+		return nil, fmt.Errorf("finding plugin process: %w", err)
+	}
+	cfg := newRunConfig("", nil, opts)
+	var w io.Writer = state.Requests
+	var bufw *bufio.Writer
+	if cfg.flushDelay > 0 {
+		bufw = bufio.NewWriterSize(state.Requests, bufferSize(cfg.writeBufferSize))
+		w = bufw
+	}
+	responses := io.MultiReader(bytes.NewReader(state.Buffered), state.Responses)
+	p := &process{
+		osProc:     proc,
+		wait:       waitOnce(waitExited(proc)),
+		dec:        newDecoder(responses, cfg.ndjson, cfg.readBufferSize),
+		stdin:      state.Requests,
+		stdout:     state.Responses,
+		output:     state.Responses,
+		release:    func() {},
+		done:       make(chan struct{}),
+		enc:        json.NewEncoder(w),
+		bufw:       bufw,
+		flushDelay: cfg.flushDelay,
+		pending:    map[string]*pendingCall{},
+		features:   negotiate(state.Features),
+		version:    state.Version,
+		build:      state.Build,
+
+		maxCancelBatch: cfg.cancelBatch,
+		readTimeout:    cfg.readTimeout,
+	}
+
+	if p.features.has(FeatureBinaryFrames) {
+		p.dec = binaryFrames(p.dec)
+	}
+
+	h := NewHost()
+	h.idCounter.Store(state.LastID)
+	h.proc = p
+	h.useNumber.Store(cfg.useNumber)
+	h.signalReady()
+	go func() { _ = h.run(context.Background(), p) }()
+	return h, nil
+}
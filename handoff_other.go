@@ -0,0 +1,11 @@
+//go:build !unix
+
+package plugger
+
+import "os"
+
+const handoffSupported = false
+
+func dupFile(any, string) (*os.File, error) { return nil, ErrHandoffUnsupported }
+
+func waitExited(*os.Process) func() error { return func() error { return nil } }
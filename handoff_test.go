@@ -0,0 +1,74 @@
+package plugger_test
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"runtime"
+	"slices"
+	"testing"
+
+	"github.com/romshark/plugger"
+	"github.com/romshark/plugger/pluggertest"
+)
+
+func TestHandoff(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("not supported on windows")
+	}
+	f := pluggertest.MakeModule(t, "test_handoff", "testdata/tcount_plugin_main.go.txt")
+	old := plugger.NewHost()
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- old.RunPlugin(t.Context(), f, nil, plugger.WithStderr(os.Stderr))
+	}()
+	waitActive(t, old, 0) // Wait for the plugin to start.
+	features := old.Features()
+
+	// Calls in progress fail with a retriable error.
+	inProgress := make(chan error, 1)
+	go func() {
+		_, err := plugger.Call[struct{}, struct{}](t.Context(), old, "wait", struct{}{})
+		inProgress <- err
+	}()
+	waitActive(t, old, 1)
+
+	state, err := old.ExportState(t.Context())
+	if err != nil {
+		t.Fatalf("exporting state: %v", err)
+	}
+	if err := <-inProgress; !errors.Is(err, plugger.ErrHandedOff) {
+		t.Fatalf("expected ErrHandedOff, got: %v", err)
+	}
+	if err := <-runErr; !errors.Is(err, plugger.ErrHandedOff) {
+		t.Fatalf("expected RunPlugin to return ErrHandedOff, got: %v", err)
+	}
+	if _, err := plugger.Call[struct{}, int64](
+		t.Context(), old, "active", struct{}{},
+	); !errors.Is(err, plugger.ErrClosed) {
+		t.Fatalf("expected ErrClosed, got: %v", err)
+	}
+
+	// The state survives serialization apart from the pipes.
+	raw, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var adopted plugger.HostState
+	if err := json.Unmarshal(raw, &adopted); err != nil {
+		t.Fatal(err)
+	}
+	adopted.Requests, adopted.Responses = state.Requests, state.Responses
+
+	h, err := plugger.AdoptHost(&adopted)
+	if err != nil {
+		t.Fatalf("adopting host: %v", err)
+	}
+	if f := h.Features(); !slices.Equal(f, features) {
+		t.Fatalf("expected features %q, got %q", features, f)
+	}
+	waitActive(t, h, 0) // The call in progress was canceled.
+	if err := h.Close(); err != nil {
+		t.Fatalf("closing host: %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+//go:build unix
+
+package plugger
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+const handoffSupported = true
+
+// dupFile duplicates the file descriptor of f, which must be a file.
+func dupFile(f any, name string) (*os.File, error) {
+	c, ok := f.(syscall.Conn)
+	if !ok {
+		return nil, ErrHandoffUnsupported
+	}
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var dup int
+	var errDup error
+	err = raw.Control(func(fd uintptr) {
+		syscall.ForkLock.RLock()
+		defer syscall.ForkLock.RUnlock()
+		if dup, errDup = syscall.Dup(int(fd)); errDup == nil {
+			syscall.CloseOnExec(dup)
+		}
+	})
+	if err == nil {
+		err = errDup
+	}
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(dup), name), nil
+}
+
+// waitExited returns a function waiting for proc to exit. proc may not
+// be a child process, so its exit is polled and its exit code unknown.
+func waitExited(proc *os.Process) func() error {
+	return func() error {
+		for proc.Signal(syscall.Signal(0)) == nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return nil
+	}
+}
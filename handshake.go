@@ -0,0 +1,255 @@
+package plugger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// methodHandshake is the reserved method the host calls right after
+// launching the plugin.
+const methodHandshake = "__handshake"
+
+// ProtocolVersion is the version of the wire protocol ("major.minor")
+// exchanged in the handshake. Peers of different major versions are
+// incompatible and refuse each other, minor versions are compatible.
+// Peers not reporting a version speak version 1.0.
+const ProtocolVersion = "1.0"
+
+// Protocol features negotiated in the handshake.
+// Each peer announces the features it supports and only uses those
+// supported by both. Peers unaware of the handshake support none.
+const (
+	// FeatureStream allows stream item envelopes ("chunk").
+	FeatureStream = "stream"
+	// FeatureVariant allows response variant tags ("variant").
+	FeatureVariant = "variant"
+	// FeatureDeadline allows request deadlines ("deadline").
+	FeatureDeadline = "deadline"
+	// FeatureCancelBatch allows canceling multiple requests at once ("cancels").
+	FeatureCancelBatch = "cancel_batch"
+	// FeatureErrorStack allows stack traces of error responses ("stack").
+	FeatureErrorStack = "error_stack"
+	// FeatureCallLog allows streaming logs of a call ("logs" and "log").
+	FeatureCallLog = "call_log"
+	// FeatureSharedFile allows passing request data in files ("file").
+	FeatureSharedFile = "shared_file"
+	// FeatureCompression allows compressed response data ("compressed").
+	FeatureCompression = "compression"
+	// FeatureRetryAfter allows back off hints of error responses ("retry").
+	FeatureRetryAfter = "retry_after"
+	// FeatureFDPassing allows passing file descriptors ("fd"),
+	// see WithFDPassing.
+	FeatureFDPassing = "fd_passing"
+	// FeatureCancelReason allows reasons of cancels ("reason").
+	FeatureCancelReason = "cancel_reason"
+	// FeatureCrashReport allows reporting panics before exiting ("__crash").
+	FeatureCrashReport = "crash_report"
+	// FeatureHeaders allows call headers ("headers").
+	FeatureHeaders = "headers"
+	// FeatureTiming allows reporting the time requests spent
+	// in the plugin ("timing").
+	FeatureTiming = "timing"
+	// FeatureBinaryFrames ("binary_frames") allows stream items of raw data
+	// sent in binary frames with the length of the data in "binary",
+	// see CallBinaryStream.
+	FeatureBinaryFrames = "binary_frames"
+	// FeatureFlowControl allows credit based flow control of streams
+	// ("credits" and "credit"), see WithFlowControl.
+	FeatureFlowControl = "flow_control"
+	// FeatureCallback allows calls of the plugin to the host ("callback"),
+	// see CallHost.
+	FeatureCallback = "callback"
+	// FeatureErrorCode allows codes identifying errors of error responses
+	// ("code"), such as ErrPaused.
+	FeatureErrorCode = "error_code"
+)
+
+// supportedFeatures lists all features this version of plugger supports.
+var supportedFeatures = []string{
+	FeatureStream, FeatureVariant, FeatureDeadline, FeatureCancelBatch,
+	FeatureErrorStack, FeatureCallLog, FeatureSharedFile, FeatureCompression,
+	FeatureRetryAfter, FeatureFDPassing, FeatureCancelReason, FeatureCrashReport,
+	FeatureHeaders, FeatureTiming, FeatureBinaryFrames, FeatureFlowControl,
+	FeatureCallback, FeatureErrorCode,
+}
+
+// handshake is the data of both handshake requests and responses.
+type handshake struct {
+	Version     string       `json:"version,omitempty"`
+	Features    []string     `json:"features,omitempty"`
+	Build       *BuildInfo   `json:"build,omitempty"`       // Response side only
+	Compression *compression `json:"compression,omitempty"` // Requested or accepted
+}
+
+// featureSet is a set of negotiated features.
+type featureSet map[string]struct{}
+
+// negotiate returns the features supported by both peers.
+func negotiate(theirs []string) featureSet {
+	s := featureSet{}
+	for _, f := range theirs {
+		if slices.Contains(supportedFeatures, f) {
+			s[f] = struct{}{}
+		}
+	}
+	return s
+}
+
+func (s featureSet) has(feature string) bool {
+	_, ok := s[feature]
+	return ok
+}
+
+func (s featureSet) list() []string {
+	l := make([]string, 0, len(s))
+	for f := range s {
+		l = append(l, f)
+	}
+	slices.Sort(l)
+	return l
+}
+
+// WithoutHandshake makes the host skip the handshake, which is required
+// for plugins that don't respond to requests of unknown methods and thus
+// never complete it. The plugin is assumed to speak protocol version 1.0
+// and to support no features, and is used right after it was started
+// since no handshake confirms that it is up.
+func WithoutHandshake() RunOption {
+	return func(c *runConfig) { c.skipHandshake = true }
+}
+
+// skipHandshake sets up p like a plugin unaware of the handshake,
+// see WithoutHandshake.
+func (p *process) skipHandshake() {
+	p.version, p.features = "1.0", featureSet{}
+}
+
+// handshake sends the handshake request and waits for the response
+// confirming that the plugin is up and speaking the protocol.
+// Plugins unaware of the handshake respond with an error response,
+// which confirms it just as well, and are assumed to support no features.
+func (p *process) handshake(ctx context.Context, id string) error {
+	req, err := json.Marshal(handshake{
+		Version:  ProtocolVersion,
+		Features: supportedFeatures, Compression: p.compression,
+	})
+	if err != nil {
+		return fmt.Errorf("marshaling handshake: %w", err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		p.lock.Lock()
+		err := p.send(envelope{ID: id, Method: methodHandshake, Data: req})
+		if err == nil {
+			err = p.flushLocked()
+		}
+		p.lock.Unlock()
+		if err != nil {
+			errc <- fmt.Errorf("sending handshake: %w", err)
+			return
+		}
+		var ev envelope
+		if err := p.dec.Decode(&ev); err != nil {
+			errc <- fmt.Errorf("awaiting handshake: %w", err)
+			return
+		}
+		if ev.ID != id {
+			errc <- fmt.Errorf("%w: unexpected handshake response id: %q",
+				ErrMalformedResponse, ev.ID)
+			return
+		}
+		if strings.HasPrefix(ev.Error, ErrProtocolVersion.Error()) {
+			// Refused by the plugin.
+			errc <- fmt.Errorf("%w%s", ErrProtocolVersion,
+				strings.TrimPrefix(ev.Error, ErrProtocolVersion.Error()))
+			return
+		}
+		var resp handshake
+		if ev.Error == "" {
+			// Tolerate malformed responses of plugins unaware of the handshake.
+			_ = json.Unmarshal(ev.Data, &resp)
+		}
+		version, err := negotiateVersion(resp.Version)
+		if err != nil {
+			errc <- err
+			return
+		}
+		p.version = version
+		p.features = negotiate(resp.Features)
+		if p.features.has(FeatureBinaryFrames) {
+			p.dec = binaryFrames(p.dec)
+		}
+		p.build = resp.Build
+		errc <- nil
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return causeErr(ctx) // The caller kills the process unblocking the goroutine.
+	}
+}
+
+// handshake is the endpoint of the handshake method.
+// Exits if the host speaks an incompatible protocol version.
+func (p *Plugin) handshake(
+	_ context.Context, meta RequestMeta, raw json.RawMessage, _ func(any) error,
+) (any, error) {
+	var req handshake
+	_ = json.Unmarshal(raw, &req) // Tolerate malformed requests.
+	if _, err := negotiateVersion(req.Version); err != nil {
+		const exitCode = 2
+		p.exitCode.Store(exitCode) // In case Run returns first.
+		fmt.Fprintln(os.Stderr, "plugger: "+err.Error())
+		p.lockEnc.Lock() // Held until exit, no more responses.
+		_ = p.enc.Encode(envelope{ID: meta.ID, Error: err.Error()})
+		p.flush()
+		os.Exit(exitCode)
+	}
+	f := negotiate(req.Features)
+	p.features.Store(&f)
+	resp := handshake{
+		Version:  ProtocolVersion,
+		Features: p.supportedFeatures(), Build: readBuildInfo(),
+	}
+	if f.has(FeatureCompression) {
+		resp.Compression = req.Compression.accept()
+		p.compression.Store(resp.Compression)
+	}
+	return resp, nil
+}
+
+// negotiateVersion returns the protocol version spoken with a peer
+// of version theirs, which is the older one of both.
+// Returns ErrProtocolVersion if the major versions differ.
+func negotiateVersion(theirs string) (string, error) {
+	if theirs == "" {
+		theirs = "1.0" // Peer predates versioning.
+	}
+	major, minor, ok := parseVersion(theirs)
+	ownMajor, ownMinor, _ := parseVersion(ProtocolVersion)
+	if !ok || major != ownMajor {
+		return "", fmt.Errorf("%w: %q, supported: %q",
+			ErrProtocolVersion, theirs, ProtocolVersion)
+	}
+	return fmt.Sprintf("%d.%d", major, min(minor, ownMinor)), nil
+}
+
+// parseVersion parses a "major.minor" protocol version.
+func parseVersion(v string) (major, minor int, ok bool) {
+	ma, mi, found := strings.Cut(v, ".")
+	if !found {
+		return 0, 0, false
+	}
+	major, errMajor := strconv.Atoi(ma)
+	minor, errMinor := strconv.Atoi(mi)
+	if errMajor != nil || errMinor != nil || major < 0 || minor < 0 {
+		return 0, 0, false
+	}
+	return major, minor, true
+}
@@ -0,0 +1,170 @@
+package plugger_test
+
+import (
+	"errors"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/romshark/plugger"
+	"github.com/romshark/plugger/pluggertest"
+)
+
+func TestFeatureNegotiation(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_feature_negotiation",
+		"testdata/t1_plugin_main.go.txt")
+	testPlugin(t, h) // Wait for the handshake.
+
+	expect := []string{
+		plugger.FeatureBinaryFrames, plugger.FeatureCallLog, plugger.FeatureCallback,
+		plugger.FeatureCancelBatch, plugger.FeatureCancelReason,
+		plugger.FeatureCompression, plugger.FeatureCrashReport, plugger.FeatureDeadline,
+		plugger.FeatureErrorCode, plugger.FeatureErrorStack,
+		plugger.FeatureFlowControl, plugger.FeatureHeaders, plugger.FeatureRetryAfter, plugger.FeatureSharedFile,
+		plugger.FeatureStream, plugger.FeatureTiming, plugger.FeatureVariant,
+	}
+	if f := h.Features(); !slices.Equal(f, expect) {
+		t.Fatalf("unexpected features: %q", f)
+	}
+}
+
+func TestFeatureNegotiationLegacyPlugin(t *testing.T) {
+	h := plugger.NewHost()
+	go func() {
+		err := h.RunPlugin(t.Context(), "testdata/test_executable.sh", pluggertest.NewLogWriter(t))
+		if err != nil && !errors.Is(err, io.EOF) {
+			t.Errorf("RunPlugin error: %v", err)
+		}
+	}()
+	defer func() { _ = h.Close() }()
+	testPlugin(t, h) // Wait for the handshake.
+
+	if f := h.Features(); len(f) != 0 {
+		t.Fatalf("expected no features, got: %q", f)
+	}
+	if b := h.BuildInfo(); b != nil {
+		t.Fatalf("expected no build info, got: %#v", b)
+	}
+	if m, ok := h.ModulePath(); ok {
+		t.Fatalf("expected no module path, got: %q", m)
+	}
+	if v := h.NegotiatedVersion(); v != "1.0" {
+		t.Fatalf("expected version 1.0, got: %q", v)
+	}
+}
+
+func TestWithoutHandshake(t *testing.T) {
+	h := plugger.NewHost()
+	go func() {
+		err := h.RunPlugin(t.Context(), "testdata/test_silent_executable.sh",
+			pluggertest.NewLogWriter(t), plugger.WithoutHandshake())
+		if err != nil && !errors.Is(err, io.EOF) {
+			t.Errorf("RunPlugin error: %v", err)
+		}
+	}()
+	defer func() { _ = h.Close() }()
+
+	got, err := plugger.Call[AddReq, AddResp](t.Context(), h, "add", AddReq{A: 2, B: 3})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.Sum != 5 {
+		t.Fatalf("unexpected result: %d", got.Sum)
+	}
+	if f := h.Features(); len(f) != 0 {
+		t.Fatalf("expected no features, got: %q", f)
+	}
+	if v := h.NegotiatedVersion(); v != "1.0" {
+		t.Fatalf("expected version 1.0, got: %q", v)
+	}
+}
+
+func TestProtocolVersion(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_protocol_version",
+		"testdata/t1_plugin_main.go.txt")
+	testPlugin(t, h) // Wait for the handshake.
+
+	if v := h.NegotiatedVersion(); v != plugger.ProtocolVersion {
+		t.Fatalf("expected version %q, got: %q", plugger.ProtocolVersion, v)
+	}
+}
+
+func TestProtocolVersionMismatch(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("not supported on windows")
+	}
+
+	t.Run("plugin", func(t *testing.T) {
+		// Responds to the handshake of a fresh host as a future plugin.
+		script := filepath.Join(t.TempDir(), "plugin.sh")
+		writeFile(t, script, `
+			#!/bin/sh
+			read -r line
+			echo '{"id":"1","data":{"version":"2.0"}}'
+			cat > /dev/null
+		`)
+		h := plugger.NewHost()
+		defer func() { _ = h.Close() }()
+		err := h.RunPlugin(t.Context(), script, pluggertest.NewLogWriter(t))
+		if !errors.Is(err, plugger.ErrProtocolVersion) {
+			t.Fatalf("expected ErrProtocolVersion, got: %v", err)
+		}
+	})
+
+	t.Run("host", func(t *testing.T) {
+		// Talk to the plugin directly as a future host.
+		bin := pluggertest.BuildModule(t, "test_protocol_version_host",
+			"testdata/t1_plugin_main.go.txt")
+		cmd := exec.Command(bin)
+		var out strings.Builder
+		cmd.Stdout = &out
+		cmd.Stderr = pluggertest.NewLogWriter(t)
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = stdin.Close() }() // Left open, the plugin must exit.
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("starting plugin: %v", err)
+		}
+		_, err = io.WriteString(stdin,
+			`{"id":"1","method":"__handshake","data":{"version":"2.0"}}`+"\n")
+		if err != nil {
+			t.Fatalf("writing handshake: %v", err)
+		}
+		err = cmd.Wait()
+		var errExit *exec.ExitError
+		if !errors.As(err, &errExit) || errExit.ExitCode() != 2 {
+			t.Fatalf("expected exit code 2, got: %v", err)
+		}
+		const expect = `{"id":"1","err":"incompatible protocol version: \"2.0\", ` +
+			`supported: \"1.0\""}` + "\n"
+		if out.String() != expect {
+			t.Fatalf("expected response %q, got %q", expect, out.String())
+		}
+	})
+}
+
+func TestBuildInfo(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_build_info",
+		"testdata/t1_plugin_main.go.txt")
+	testPlugin(t, h) // Wait for the handshake.
+
+	b := h.BuildInfo()
+	if b == nil {
+		t.Fatal("expected build info")
+	}
+	if b.GoVersion != runtime.Version() {
+		t.Fatalf("expected go version %q, got %q", runtime.Version(), b.GoVersion)
+	}
+	if b.Path != "exampleplugin" {
+		t.Fatalf("unexpected path: %q", b.Path)
+	}
+	if m, ok := h.ModulePath(); !ok || m != "exampleplugin" {
+		t.Fatalf("unexpected module path: %q, %t", m, ok)
+	}
+}
@@ -0,0 +1,14 @@
+package plugger
+
+import "maps"
+
+// WithHeaders attaches headers to the call, which the handler receives
+// as RequestMeta.Headers. Unlike the request, headers are meant for
+// transport concerns such as routing and authorization by proxies
+// between the host and the plugin. Calls with headers are never
+// cached or coalesced since their response may depend on the headers.
+// Plugins not supporting FeatureHeaders receive no headers.
+func WithHeaders(headers map[string]string) CallOption {
+	headers = maps.Clone(headers)
+	return func(c *callConfig) { c.headers = headers }
+}
@@ -0,0 +1,87 @@
+package plugger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// methodHealth is the reserved method answered with the HealthReport.
+const methodHealth = "__health"
+
+// HealthStatus is the overall status of a plugin.
+type HealthStatus string
+
+const (
+	// HealthOK means all health checks passed.
+	HealthOK HealthStatus = "ok"
+	// HealthDegraded means at least one health check failed.
+	HealthDegraded HealthStatus = "degraded"
+)
+
+// HealthReport describes the health of a plugin.
+type HealthReport struct {
+	Status  HealthStatus  `json:"status"`
+	Checks  []HealthCheck `json:"checks,omitempty"`  // In order of registration.
+	Version string        `json:"version,omitempty"` // Main module version.
+	Uptime  time.Duration `json:"uptime"`            // Since Run was invoked.
+}
+
+// HealthCheck is the result of a health check registered with
+// Plugin.AddHealthCheck.
+type HealthCheck struct {
+	Name  string `json:"name"`
+	Error string `json:"error,omitempty"` // Empty if the check passed.
+}
+
+// Health returns the health report of the plugin, which is HealthOK
+// unless a health check registered with Plugin.AddHealthCheck failed.
+// Plugins not built with this package may not support it
+// and respond with an ErrorResponse.
+func (h *Host) Health(ctx context.Context) (HealthReport, error) {
+	resp, err := h.call(ctx, methodHealth, nil, newCallConfig(nil), nil)
+	if err != nil {
+		return HealthReport{}, err
+	}
+	var r HealthReport
+	if err := json.Unmarshal(resp.Data, &r); err != nil {
+		return HealthReport{}, fmt.Errorf("%w: %w", ErrMalformedResponse, err)
+	}
+	return r, nil
+}
+
+// healthCheck is a check registered with AddHealthCheck.
+type healthCheck struct {
+	name string
+	fn   func(context.Context) error
+}
+
+// AddHealthCheck registers a check contributing to the health report.
+// The plugin is reported degraded if fn returns an error.
+// Must be used before Run is invoked!
+func (p *Plugin) AddHealthCheck(name string, fn func(ctx context.Context) error) {
+	if p.running.Load() {
+		panic("add health checks before invoking Run")
+	}
+	p.healthChecks = append(p.healthChecks, healthCheck{name: name, fn: fn})
+}
+
+// health is the endpoint of the health method.
+func (p *Plugin) health(
+	ctx context.Context, _ RequestMeta, _ json.RawMessage, _ func(any) error,
+) (any, error) {
+	r := HealthReport{Status: HealthOK, Uptime: time.Since(p.started)}
+	if b := readBuildInfo(); b != nil {
+		r.Version = b.Version
+	}
+	for _, c := range p.healthChecks {
+		check := HealthCheck{Name: c.name}
+		if err := c.fn(ctx); err != nil {
+			check.Error = err.Error()
+			r.Status = HealthDegraded
+		}
+		r.Checks = append(r.Checks, check)
+	}
+	return r, nil
+}
@@ -0,0 +1,42 @@
+package plugger_test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/romshark/plugger"
+	"github.com/romshark/plugger/pluggertest"
+)
+
+func TestHealth(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_health",
+		"testdata/thealth_plugin_main.go.txt")
+
+	r, err := h.Health(t.Context())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expect := []plugger.HealthCheck{{Name: "cache"}, {Name: "db"}}
+	if r.Status != plugger.HealthOK || !slices.Equal(r.Checks, expect) {
+		t.Fatalf("unexpected report: %#v", r)
+	}
+	if r.Uptime <= 0 {
+		t.Fatalf("unexpected uptime: %v", r.Uptime)
+	}
+
+	if _, err := plugger.Call[struct{}, struct{}](
+		t.Context(), h, "db_down", struct{}{},
+	); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r, err = h.Health(t.Context())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expect = []plugger.HealthCheck{
+		{Name: "cache"}, {Name: "db", Error: "connection refused"},
+	}
+	if r.Status != plugger.HealthDegraded || !slices.Equal(r.Checks, expect) {
+		t.Fatalf("unexpected report: %#v", r)
+	}
+}
@@ -0,0 +1,77 @@
+package plugger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// SetInitCall makes the host call method with req right after every
+// launch of the plugin, for example to pass configuration the plugin
+// needs before it can serve other methods. The plugin is only considered
+// ready once the call succeeded, calls made in the meantime wait for it.
+// Launching the plugin fails with ErrInitFailed wrapping the error of
+// the call if it fails, and the plugin is stopped. Stream items and logs
+// sent for the call are ignored and its response data is discarded.
+// An empty method disables the call. Returns an error if req can't be
+// marshaled. Must be used before the plugin is launched to apply to it.
+func (h *Host) SetInitCall(method string, req any) error {
+	var raw json.RawMessage
+	if method != "" {
+		var err error
+		if raw, err = marshal(req); err != nil {
+			return fmt.Errorf("marshaling init request: %w", err)
+		}
+	}
+	h.lock.Lock()
+	h.initMethod, h.initReq = method, raw
+	h.lock.Unlock()
+	return nil
+}
+
+// initCall sends the init request and awaits its final response
+// before run() started reading responses.
+func (p *process) initCall(
+	ctx context.Context, id, method string, req json.RawMessage,
+	serveCallback func(envelope),
+) error {
+	errc := make(chan error, 1)
+	go func() {
+		p.lock.Lock()
+		err := p.send(envelope{ID: id, Method: method, Data: req})
+		if err == nil {
+			err = p.flushLocked()
+		}
+		p.lock.Unlock()
+		if err != nil {
+			errc <- fmt.Errorf("sending init request: %w", err)
+			return
+		}
+		for {
+			var ev envelope
+			if err := p.dec.Decode(&ev); err != nil {
+				errc <- fmt.Errorf("awaiting init response: %w", err)
+				return
+			}
+			if ev.Callback && ev.Method != "" {
+				serveCallback(ev) // The init handler may call the host.
+				continue
+			}
+			if ev.ID != id || ev.Chunk || ev.Log != nil {
+				continue
+			}
+			if ev.Error != "" {
+				errc <- responseError(ev)
+				return
+			}
+			errc <- nil
+			return
+		}
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return causeErr(ctx) // The caller kills the process unblocking the goroutine.
+	}
+}
@@ -0,0 +1,32 @@
+package plugger
+
+import (
+	"os/exec"
+	"slices"
+)
+
+// WithLauncherPrefix runs the plugin's command prefixed by prefix,
+// for example []string{"strace", "-f"} or []string{"perf", "record", "--"},
+// to trace or profile the plugin in situ without changing it.
+// The prefix command inherits the environment and the working directory
+// of the plugin's command, so it composes with options such as
+// WithContextEnvMapping. OnSpawn reports the prefixed command.
+// Meant for development and diagnostics only: the prefix command
+// must pass the protocol pipes through and not write to stdout.
+func WithLauncherPrefix(prefix []string) RunOption {
+	prefix = slices.Clone(prefix)
+	return func(c *runConfig) { c.launcherPrefix = prefix }
+}
+
+// prefixCommand returns cmd run by the command prefix.
+// Returns cmd if prefix is empty.
+func prefixCommand(cmd *exec.Cmd, prefix []string) *exec.Cmd {
+	if len(prefix) == 0 {
+		return cmd
+	}
+	args := append(slices.Clone(prefix[1:]), cmd.Args...)
+	prefixed := exec.Command(prefix[0], args...)
+	prefixed.Dir = cmd.Dir
+	prefixed.Env = cmd.Env
+	return prefixed
+}
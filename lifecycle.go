@@ -0,0 +1,87 @@
+package plugger
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// SetContext sets the parent context of all request contexts,
+// which makes the values of base, such as shared dependencies,
+// available to all handlers. Canceling base cancels all requests
+// and stops Run just like canceling the context passed to Run.
+// Must be used before Run is invoked!
+func (p *Plugin) SetContext(base context.Context) {
+	if p.running.Load() {
+		panic("set the context before invoking Run")
+	}
+	p.base = base
+}
+
+// OnShutdown registers fn to be invoked when Run returns,
+// for example to release resources shared by handlers.
+// Functions are invoked in reverse order of registration.
+// Before invoking them Run cancels all requests in progress and waits
+// for their handlers to return, unless the EOF policy drains them
+// instead, at most for the timeout of the policy (see SetEOFPolicy).
+// Must be used before Run is invoked!
+func (p *Plugin) OnShutdown(fn func()) {
+	if p.running.Load() {
+		panic("add shutdown hooks before invoking Run")
+	}
+	p.onShutdown = append(p.onShutdown, fn)
+}
+
+// shutdown invokes the shutdown hooks once all handlers returned.
+// No-op if there are no hooks.
+func (p *Plugin) shutdown() {
+	if len(p.onShutdown) == 0 {
+		return
+	}
+	p.settle(true) // No-op if the EOF policy was applied.
+	for i := len(p.onShutdown) - 1; i >= 0; i-- {
+		p.onShutdown[i]()
+	}
+}
+
+// methodPrepareShutdown is the reserved method announcing an imminent
+// shutdown.
+const methodPrepareShutdown = "__shutdown_soon"
+
+// PrepareShutdown tells the plugin that it's about to be closed and
+// waits until it's prepared, which gives it the chance to stop taking
+// new work and checkpoint its state while calls are still served.
+// Close the host afterwards to complete the shutdown.
+// Plugins not built with this package may not support it
+// and respond with an ErrorResponse.
+func (h *Host) PrepareShutdown(ctx context.Context) error {
+	_, err := h.call(ctx, methodPrepareShutdown, nil, newCallConfig(nil), nil)
+	return err
+}
+
+// OnPrepareShutdown registers fn to be invoked when the host announces
+// the shutdown with Host.PrepareShutdown. Functions are invoked once
+// in order of registration, the host waits for them to return.
+// Must be used before Run is invoked!
+func (p *Plugin) OnPrepareShutdown(fn func()) {
+	if p.running.Load() {
+		panic("add shutdown hooks before invoking Run")
+	}
+	p.onPrepareShutdown = append(p.onPrepareShutdown, fn)
+}
+
+// ShuttingDown reports whether the host announced the shutdown
+// with Host.PrepareShutdown. Handlers can use it to reject new work.
+func (p *Plugin) ShuttingDown() bool { return p.shuttingDown.Load() }
+
+// prepareShutdown is the endpoint of the prepare shutdown method.
+func (p *Plugin) prepareShutdown(
+	_ context.Context, _ RequestMeta, _ json.RawMessage, _ func(any) error,
+) (any, error) {
+	p.prepareOnce.Do(func() {
+		p.shuttingDown.Store(true)
+		for _, fn := range p.onPrepareShutdown {
+			fn()
+		}
+	})
+	return nil, nil
+}
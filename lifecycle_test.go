@@ -0,0 +1,458 @@
+package plugger_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/romshark/plugger"
+	"github.com/romshark/plugger/pluggertest"
+)
+
+func TestPluginLifecycle(t *testing.T) {
+	bin := pluggertest.BuildModule(t, "test_plugin_lifecycle",
+		"testdata/tlifecycle_plugin_main.go.txt")
+	h := plugger.NewHost()
+	var stderr syncBuffer
+	go func() { _ = h.RunPlugin(t.Context(), bin, nil, plugger.WithStderr(&stderr)) }()
+
+	dep, err := plugger.Call[struct{}, string](t.Context(), h, "dep", struct{}{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if dep != "db" {
+		t.Fatalf("unexpected dependency: %q", dep)
+	}
+
+	// Leave a call in progress.
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	logs, _ := plugger.CallWithLogs[struct{}, struct{}](ctx, h, "wait", struct{}{})
+	<-logs // The call reached the plugin.
+	go func() {
+		for range logs {
+		}
+	}()
+
+	if err := h.Close(); err != nil {
+		t.Fatalf("closing host: %v", err)
+	}
+	const expect = "wait canceled\nshutdown 2\nshutdown 1\n"
+	if s := stderr.String(); s != expect {
+		t.Fatalf("expected stderr %q, got %q", expect, s)
+	}
+}
+
+func TestPrepareShutdown(t *testing.T) {
+	bin := pluggertest.BuildModule(t, "test_prepare_shutdown",
+		"testdata/tlifecycle_plugin_main.go.txt")
+	h := plugger.NewHost()
+	var stderr syncBuffer
+	go func() { _ = h.RunPlugin(t.Context(), bin, nil, plugger.WithStderr(&stderr)) }()
+	defer func() { _ = h.Close() }()
+
+	_, err := plugger.Call[struct{}, struct{}](t.Context(), h, "work", struct{}{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for range 2 { // Hooks are invoked once only.
+		if err := h.PrepareShutdown(t.Context()); err != nil {
+			t.Fatalf("preparing shutdown: %v", err)
+		}
+	}
+	if s := stderr.String(); s != "prepare shutdown\n" {
+		t.Fatalf("unexpected stderr: %q", s)
+	}
+
+	// Calls are still served.
+	_, err = plugger.Call[struct{}, struct{}](t.Context(), h, "work", struct{}{})
+	if !errors.Is(err, plugger.ErrorResponse("shutting down")) {
+		t.Fatalf("expected shutting down error, got: %v", err)
+	}
+}
+
+func TestShutdownTriggers(t *testing.T) {
+	bin := pluggertest.BuildModule(t, "test_shutdown_triggers",
+		"testdata/tlifecycle_plugin_main.go.txt")
+
+	for _, tc := range []struct {
+		name     string
+		shutdown func(h *plugger.Host, cancel context.CancelFunc)
+	}{
+		{"cancel", func(_ *plugger.Host, cancel context.CancelFunc) { cancel() }},
+		{"close", func(h *plugger.Host, _ context.CancelFunc) {
+			if err := h.Close(); err != nil {
+				t.Errorf("closing host: %v", err)
+			}
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := plugger.NewHost()
+			var stderr syncBuffer
+			ctx, cancel := context.WithCancel(t.Context())
+			defer cancel()
+			stopped := make(chan error, 1)
+			go func() {
+				stopped <- h.RunPlugin(ctx, bin, nil, plugger.WithStderr(&stderr))
+			}()
+
+			if _, err := plugger.Call[struct{}, string](
+				t.Context(), h, "dep", struct{}{},
+			); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// Leave a call in progress.
+			logs, result := plugger.CallWithLogs[struct{}, struct{}](
+				t.Context(), h, "wait", struct{}{},
+			)
+			<-logs // The call reached the plugin.
+			pending := make(chan error, 1)
+			go func() {
+				for range logs {
+				}
+				_, err := result()
+				pending <- err
+			}()
+
+			tc.shutdown(h, cancel)
+
+			select {
+			case err := <-stopped:
+				if !errors.Is(err, io.EOF) {
+					t.Fatalf("expected RunPlugin to return io.EOF, got: %v", err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("RunPlugin didn't return")
+			}
+			// The plugin exited cleanly before RunPlugin returned.
+			const expect = "wait canceled\nshutdown 2\nshutdown 1\n"
+			if s := stderr.String(); s != expect {
+				t.Fatalf("expected stderr %q, got %q", expect, s)
+			}
+			if err := <-pending; err == nil {
+				t.Fatal("expected the pending call to fail")
+			}
+			_, err := plugger.Call[struct{}, string](t.Context(), h, "dep", struct{}{})
+			if !errors.Is(err, plugger.ErrClosed) {
+				t.Fatalf("expected ErrClosed, got: %v", err)
+			}
+			if err := h.Close(); err != nil {
+				t.Fatalf("closing closed host: %v", err)
+			}
+		})
+	}
+}
+
+func TestEOFPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		policy  plugger.EOFPolicy
+		timeout time.Duration
+		expect  string // how the handler ended once Run returned
+		hook    bool   // register a shutdown hook
+	}{
+		{"return", plugger.EOFReturn, 0, "running", false},
+		{"return_hook", plugger.EOFReturn, 0, "canceled", true},
+		{"drain", plugger.EOFDrain, 0, "completed", false},
+		{"drain_hook", plugger.EOFDrain, 0, "completed", true},
+		{"drain_timeout", plugger.EOFDrain, 50 * time.Millisecond, "running", false},
+		{"drain_timeout_hook", plugger.EOFDrain, 50 * time.Millisecond, "running", true},
+		{"cancel", plugger.EOFCancel, 0, "canceled", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			reqR, reqW := io.Pipe()
+			p := plugger.NewPlugin(plugger.WithPluginIO(reqR, io.Discard))
+			p.SetEOFPolicy(tc.policy, tc.timeout)
+			started := make(chan struct{})
+			var ended atomic.Value
+			ended.Store("running")
+			plugger.Handle(p, "work", func(ctx context.Context, _ struct{}) (struct{}, error) {
+				close(started)
+				select {
+				case <-ctx.Done():
+					ended.Store("canceled")
+				case <-time.After(300 * time.Millisecond):
+					ended.Store("completed")
+				}
+				return struct{}{}, nil
+			})
+			var atHook atomic.Value // how the handler ended once the hook ran
+			if tc.hook {
+				p.OnShutdown(func() { atHook.Store(ended.Load()) })
+			}
+			done := make(chan int, 1)
+			go func() { done <- p.Run(t.Context()) }()
+
+			_, err := io.WriteString(reqW, `{"id":"1","method":"work","data":{}}`+"\n")
+			if err != nil {
+				t.Fatalf("writing request: %v", err)
+			}
+			<-started
+			_ = reqW.Close()
+			if code := <-done; code != 0 {
+				t.Fatalf("unexpected exit code: %d", code)
+			}
+			if s := ended.Load(); s != tc.expect {
+				t.Fatalf("expected handler %s, got %s", tc.expect, s)
+			}
+			if s := atHook.Load(); tc.hook && s != tc.expect {
+				t.Fatalf("expected handler %s at the shutdown hook, got %v", tc.expect, s)
+			}
+		})
+	}
+}
+
+func TestInitCall(t *testing.T) {
+	bin := pluggertest.BuildModule(t, "test_init_call",
+		"testdata/tlifecycle_plugin_main.go.txt")
+
+	t.Run("ok", func(t *testing.T) {
+		h := plugger.NewHost()
+		if err := h.SetInitCall("configure", "cfg"); err != nil {
+			t.Fatalf("setting init call: %v", err)
+		}
+		go func() { _ = h.RunPlugin(t.Context(), bin, pluggertest.NewLogWriter(t)) }()
+		defer func() { _ = h.Close() }()
+
+		c, err := plugger.Call[struct{}, string](t.Context(), h, "config", struct{}{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if c != "cfg" {
+			t.Fatalf("unexpected config: %q", c)
+		}
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		h := plugger.NewHost()
+		if err := h.SetInitCall("configure", ""); err != nil {
+			t.Fatalf("setting init call: %v", err)
+		}
+		err := h.RunPlugin(t.Context(), bin, pluggertest.NewLogWriter(t))
+		if !errors.Is(err, plugger.ErrInitFailed) ||
+			!errors.Is(err, plugger.ErrorResponse("missing config")) {
+			t.Fatalf("expected ErrInitFailed, got: %v", err)
+		}
+		_, err = plugger.Call[struct{}, string](t.Context(), h, "config", struct{}{})
+		if !errors.Is(err, plugger.ErrClosed) {
+			t.Fatalf("expected ErrClosed, got: %v", err)
+		}
+		if !errors.Is(err, plugger.ErrStartFailed) {
+			t.Fatalf("expected ErrStartFailed, got: %v", err)
+		}
+	})
+
+	t.Run("lazy", func(t *testing.T) {
+		h := plugger.NewHost()
+		if err := h.SetInitCall("configure", "lazy"); err != nil {
+			t.Fatalf("setting init call: %v", err)
+		}
+		h.Configure(bin, plugger.WithStderr(pluggertest.NewLogWriter(t)))
+		defer func() { _ = h.Close() }()
+
+		c, err := plugger.Call[struct{}, string](t.Context(), h, "config", struct{}{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if c != "lazy" {
+			t.Fatalf("unexpected config: %q", c)
+		}
+	})
+}
+
+func TestPause(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	var plugin *plugger.Plugin
+	conn := pluggertest.Serve(t, func(p *plugger.Plugin) {
+		plugin = p
+		plugger.Handle(p, "block", func(_ context.Context, _ struct{}) (string, error) {
+			select {
+			case started <- struct{}{}:
+			default:
+			}
+			<-release
+			return "done", nil
+		})
+	})
+	conn.Send(`{"id":"0","method":"__handshake","data":{"features":["error_code"]}}`)
+	_ = conn.Receive()
+
+	conn.Send(`{"id":"1","method":"block","data":{}}`)
+	<-started // Passed the pause check.
+	plugin.Pause()
+	if !plugin.Paused() {
+		t.Fatal("expected the plugin to be paused")
+	}
+	conn.Send(`{"id":"2","method":"block","data":{}}`)
+	if resp := string(conn.Receive()); resp != `{"id":"2","err":"plugin paused","code":"paused"}` {
+		t.Fatalf("unexpected response: %s", resp)
+	}
+	// Built-in methods are served.
+	conn.Send(`{"id":"3","method":"__echo","data":"ok"}`)
+	if resp := string(conn.Receive()); resp != `{"id":"3","data":"ok"}` {
+		t.Fatalf("unexpected response: %s", resp)
+	}
+	// Requests in progress are unaffected.
+	close(release)
+	if resp := string(conn.Receive()); resp != `{"id":"1","data":"done"}` {
+		t.Fatalf("unexpected response: %s", resp)
+	}
+
+	plugin.Resume()
+	conn.Send(`{"id":"4","method":"block","data":{}}`)
+	if resp := string(conn.Receive()); resp != `{"id":"4","data":"done"}` {
+		t.Fatalf("unexpected response: %s", resp)
+	}
+}
+
+func TestPauseHost(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_pause",
+		"testdata/tlifecycle_plugin_main.go.txt")
+
+	// Errors are identified by their code, not their message.
+	_, err := plugger.Call[string, struct{}](t.Context(), h, "fail", "plugin paused")
+	if err == nil || errors.Is(err, plugger.ErrPaused) {
+		t.Fatalf("expected an error other than ErrPaused, got: %v", err)
+	}
+
+	_, err = plugger.Call[struct{}, struct{}](t.Context(), h, "pause", struct{}{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = plugger.Call[struct{}, string](t.Context(), h, "dep", struct{}{})
+	if !errors.Is(err, plugger.ErrPaused) {
+		t.Fatalf("expected ErrPaused, got: %v", err)
+	}
+	// Resumed once received, see the plugin's events.
+	_, err = plugger.Call[struct{}, struct{}](t.Context(), h, "resume", struct{}{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	dep, err := plugger.Call[struct{}, string](t.Context(), h, "dep", struct{}{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if dep != "db" {
+		t.Fatalf("unexpected dependency: %q", dep)
+	}
+}
+
+func TestExitError(t *testing.T) {
+	// Built, since go run doesn't preserve the exit code.
+	bin := pluggertest.BuildModule(t, "test_exit_error",
+		"testdata/tcrash_plugin_main.go.txt")
+	h := plugger.NewHost()
+	h.Configure(bin, plugger.WithStderr(pluggertest.NewLogWriter(t)))
+	t.Cleanup(func() { _ = h.Close() })
+
+	_, err := plugger.Call[int, struct{}](t.Context(), h, "exit", 3)
+	var errExit *plugger.ExitError
+	if !errors.As(err, &errExit) || errExit.ExitCode() != 3 {
+		t.Fatalf("expected exit code 3, got: %v", err)
+	}
+	if !errors.Is(err, plugger.ErrClosed) {
+		t.Fatalf("expected the error to wrap ErrClosed, got: %v", err)
+	}
+	if !strings.Contains(errExit.Stderr, "exiting with 3") {
+		t.Fatalf("expected the stderr of the plugin, got: %q", errExit.Stderr)
+	}
+	if err := h.Err(); err != errExit {
+		t.Fatalf("expected Err to return the exit error, got: %v", err)
+	}
+	if err := h.ExitError(); err != errExit {
+		t.Fatalf("expected ExitError to return the exit error, got: %v", err)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	bin := pluggertest.BuildModule(t, "test_restart",
+		"testdata/tcrash_plugin_main.go.txt")
+	h := plugger.NewHost()
+	errRun := make(chan error, 1)
+	go func() {
+		errRun <- h.RunPlugin(t.Context(), bin, nil,
+			plugger.WithStderr(pluggertest.NewLogWriter(t)),
+			plugger.WithRestart(plugger.RestartPolicy{
+				MaxRestarts: 2, Backoff: 10 * time.Millisecond,
+			}))
+	}()
+	t.Cleanup(func() { _ = h.Close() })
+
+	// The call in progress fails, the next one uses the relaunched plugin.
+	marker := filepath.Join(t.TempDir(), "marker")
+	_, err := plugger.Call[string, string](t.Context(), h, "crash_once", marker)
+	if !errors.Is(err, plugger.ErrClosed) {
+		t.Fatalf("expected ErrClosed, got: %v", err)
+	}
+	resp, err := plugger.Call[string, string](t.Context(), h, "crash_once", marker)
+	if err != nil || resp != "ok" {
+		t.Fatalf("unexpected result: %q, %v", resp, err)
+	}
+
+	// Retries wait for the relaunch.
+	marker = filepath.Join(t.TempDir(), "marker")
+	resp, err = plugger.Call[string, string](
+		t.Context(), h, "crash_once", marker, plugger.WithRestartRetry(1),
+	)
+	if err != nil || resp != "ok" {
+		t.Fatalf("unexpected result: %q, %v", resp, err)
+	}
+
+	// RunPlugin returns once the restarts are used up.
+	_, err = plugger.Call[int, struct{}](t.Context(), h, "exit", 3)
+	var errExit *plugger.ExitError
+	if !errors.As(err, &errExit) {
+		t.Fatalf("expected ExitError, got: %v", err)
+	}
+	if err := <-errRun; !errors.As(err, &errExit) {
+		t.Fatalf("expected RunPlugin to return ExitError, got: %v", err)
+	}
+}
+
+func TestRestartClosed(t *testing.T) {
+	bin := pluggertest.BuildModule(t, "test_restart_closed",
+		"testdata/tcrash_plugin_main.go.txt")
+	h := plugger.NewHost()
+	errRun := make(chan error, 1)
+	go func() {
+		errRun <- h.RunPlugin(t.Context(), bin, nil,
+			plugger.WithStderr(pluggertest.NewLogWriter(t)),
+			plugger.WithRestart(plugger.RestartPolicy{
+				MaxRestarts: 1, Backoff: time.Hour,
+			}))
+	}()
+
+	_, err := plugger.Call[int, struct{}](t.Context(), h, "exit", 3)
+	var errExit *plugger.ExitError
+	if !errors.As(err, &errExit) {
+		t.Fatalf("expected ExitError, got: %v", err)
+	}
+	// Closing the host stops waiting for the backoff.
+	if err := h.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := <-errRun; !errors.As(err, &errExit) {
+		t.Fatalf("expected RunPlugin to return ExitError, got: %v", err)
+	}
+	_, err = plugger.Call[string, string](t.Context(), h, "crash_once", "")
+	if !errors.Is(err, plugger.ErrClosed) {
+		t.Fatalf("expected ErrClosed, got: %v", err)
+	}
+}
+
+func TestRestartConfigure(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected Configure to panic")
+		}
+	}()
+	plugger.NewHost().Configure("plugin",
+		plugger.WithRestart(plugger.RestartPolicy{MaxRestarts: 1}))
+}
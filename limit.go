@@ -0,0 +1,64 @@
+package plugger
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ProcessLimit caps the number of plugin processes running at once
+// across all hosts launching plugins with WithProcessLimit.
+// A process occupies its slot from launch until it exits or is closed.
+type ProcessLimit struct {
+	slots   chan struct{}
+	timeout time.Duration
+}
+
+// NewProcessLimit creates a limit of n processes. Launches beyond
+// the limit wait up to timeout for a slot to free up and fail with
+// ErrProcessLimit afterwards. Launches are rejected right away
+// if timeout is zero and wait indefinitely if it's negative.
+// n is clamped to at least 1 since no process could ever be launched
+// otherwise, so zero and negative limits allow a single process.
+func NewProcessLimit(n int, timeout time.Duration) *ProcessLimit {
+	return &ProcessLimit{slots: make(chan struct{}, max(n, 1)), timeout: timeout}
+}
+
+// WithProcessLimit makes the plugin process count against l.
+func WithProcessLimit(l *ProcessLimit) RunOption {
+	return func(c *runConfig) { c.limit = l }
+}
+
+// Running returns the number of processes occupying a slot.
+func (l *ProcessLimit) Running() int { return len(l.slots) }
+
+// acquire occupies a slot and returns the function releasing it.
+// Safe to call nil receivers, which impose no limit.
+func (l *ProcessLimit) acquire(ctx context.Context) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	release = sync.OnceFunc(func() { <-l.slots })
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	if l.timeout == 0 {
+		return nil, ErrProcessLimit
+	}
+	var timeout <-chan time.Time
+	if l.timeout > 0 {
+		t := time.NewTimer(l.timeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	case <-timeout:
+		return nil, ErrProcessLimit
+	case <-ctx.Done():
+		return nil, causeErr(ctx)
+	}
+}
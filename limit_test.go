@@ -0,0 +1,146 @@
+package plugger_test
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/romshark/plugger"
+	"github.com/romshark/plugger/pluggertest"
+)
+
+func TestProcessLimit(t *testing.T) {
+	f := pluggertest.MakeModule(t, "test_process_limit", "testdata/t1_plugin_main.go.txt")
+
+	t.Run("reject", func(t *testing.T) {
+		l := plugger.NewProcessLimit(1, 0)
+		a := plugger.NewHost()
+		go func() { _ = a.RunPlugin(t.Context(), f, nil, plugger.WithProcessLimit(l)) }()
+		defer func() { _ = a.Close() }()
+		testPlugin(t, a)
+
+		b := plugger.NewHost()
+		err := b.RunPlugin(t.Context(), f, nil, plugger.WithProcessLimit(l))
+		if !errors.Is(err, plugger.ErrProcessLimit) {
+			t.Fatalf("expected ErrProcessLimit, got: %v", err)
+		}
+
+		if err := a.Close(); err != nil {
+			t.Fatalf("closing host: %v", err)
+		}
+		if n := l.Running(); n != 0 {
+			t.Fatalf("expected no running processes, got %d", n)
+		}
+	})
+
+	t.Run("wait", func(t *testing.T) {
+		l := plugger.NewProcessLimit(1, -1)
+		a := plugger.NewHost()
+		go func() { _ = a.RunPlugin(t.Context(), f, nil, plugger.WithProcessLimit(l)) }()
+		defer func() { _ = a.Close() }()
+		testPlugin(t, a)
+
+		b := plugger.NewHost()
+		go func() { _ = b.RunPlugin(t.Context(), f, nil, plugger.WithProcessLimit(l)) }()
+		defer func() { _ = b.Close() }()
+		// b waits for a slot, whether or not it's already waiting.
+		if n := l.Running(); n != 1 {
+			t.Fatalf("expected 1 running process, got %d", n)
+		}
+
+		if err := a.Close(); err != nil {
+			t.Fatalf("closing host: %v", err)
+		}
+		testPlugin(t, b)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		l := plugger.NewProcessLimit(1, 20*time.Millisecond)
+		a := plugger.NewHost()
+		go func() { _ = a.RunPlugin(t.Context(), f, nil, plugger.WithProcessLimit(l)) }()
+		defer func() { _ = a.Close() }()
+		testPlugin(t, a)
+
+		b := plugger.NewHost()
+		err := b.RunPlugin(t.Context(), f, nil, plugger.WithProcessLimit(l))
+		if !errors.Is(err, plugger.ErrProcessLimit) {
+			t.Fatalf("expected ErrProcessLimit, got: %v", err)
+		}
+	})
+	t.Run("exited", func(t *testing.T) {
+		f := pluggertest.MakeModule(t, "test_process_limit_exited",
+			"testdata/tcrash_plugin_main.go.txt")
+		l := plugger.NewProcessLimit(1, 0)
+		a := plugger.NewHost()
+		defer func() { _ = a.Close() }()
+		done := make(chan error, 1)
+		go func() { done <- a.RunPlugin(t.Context(), f, nil, plugger.WithProcessLimit(l)) }()
+		_, _ = plugger.Call[int, struct{}](t.Context(), a, "exit", 0)
+		<-done
+
+		// The plugin exited on its own, a isn't closed.
+		awaitRunning(t, l, 0)
+	})
+
+	t.Run("malformed_frame", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("not supported on windows")
+		}
+		l := plugger.NewProcessLimit(1, 0)
+		a := plugger.NewHost()
+		defer func() { _ = a.Close() }()
+		errs := make(chan error, 1)
+		go func() {
+			errs <- a.RunPlugin(t.Context(), "testdata/test_multiline_executable.sh",
+				pluggertest.NewLogWriter(t), plugger.WithProcessLimit(l),
+				plugger.WithoutHandshake(), plugger.WithNDJSON())
+		}()
+		if _, err := plugger.Call[struct{}, string](
+			t.Context(), a, "hello", struct{}{},
+		); err == nil {
+			t.Fatal("expected an error")
+		}
+		if err := <-errs; !errors.Is(err, plugger.ErrInvalidFrame) {
+			t.Fatalf("expected ErrInvalidFrame, got: %v", err)
+		}
+
+		// The plugin is still running.
+		if n := l.Running(); n != 1 {
+			t.Fatalf("expected 1 running process, got %d", n)
+		}
+		if err := a.Close(); err != nil {
+			t.Fatalf("closing host: %v", err)
+		}
+		awaitRunning(t, l, 0)
+	})
+}
+
+func TestProcessLimitClamped(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("not supported on windows")
+	}
+	for _, n := range []int{0, -1} {
+		l := plugger.NewProcessLimit(n, 0)
+		h := plugger.NewHost()
+		go func() {
+			_ = h.RunPlugin(t.Context(), "testdata/test_executable.sh",
+				pluggertest.NewLogWriter(t), plugger.WithProcessLimit(l))
+		}()
+		testPlugin(t, h)
+		if n := l.Running(); n != 1 {
+			t.Fatalf("expected 1 running process, got %d", n)
+		}
+		if err := h.Close(); err != nil {
+			t.Fatalf("closing host: %v", err)
+		}
+	}
+}
+
+// awaitRunning fails t unless l has n running processes within 5 seconds.
+func awaitRunning(t *testing.T, l *plugger.ProcessLimit, n int) {
+	t.Helper()
+	if !eventually(func() bool { return l.Running() == n }) {
+		t.Fatalf("expected %d running processes, got %d", n, l.Running())
+	}
+}
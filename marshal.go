@@ -0,0 +1,116 @@
+package plugger
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sync"
+)
+
+// RegisterMarshaler registers functions used instead of encoding/json
+// to marshal and unmarshal values of type T when T is the request,
+// response or stream item type of a call or handler.
+// marshal must produce valid JSON. Nested values of type T aren't affected,
+// use the json.Marshaler and json.Unmarshaler interfaces for those.
+//
+// Both the host and the plugin must register the same functions,
+// for example in the init function of a package shared by both.
+func RegisterMarshaler[T any](
+	marshal func(T) ([]byte, error), unmarshal func([]byte, *T) error,
+) {
+	marshalers.Store(reflect.TypeFor[T](), typeMarshaler{
+		marshal:   func(v any) ([]byte, error) { return marshal(v.(T)) },
+		unmarshal: func(data []byte, v any) error { return unmarshal(data, v.(*T)) },
+	})
+}
+
+type typeMarshaler struct {
+	marshal   func(any) ([]byte, error)
+	unmarshal func([]byte, any) error
+}
+
+var marshalers sync.Map // reflect.Type → typeMarshaler
+
+// marshal encodes v using the marshaler registered for its type
+// falling back to encoding/json.
+func marshal(v any) ([]byte, error) {
+	if v != nil {
+		if m, ok := marshalers.Load(reflect.TypeOf(v)); ok {
+			return m.(typeMarshaler).marshal(v)
+		}
+	}
+	return json.Marshal(v)
+}
+
+// pooledEncoder is an encoder writing to a reusable buffer.
+type pooledEncoder struct {
+	buf bytes.Buffer
+	enc *json.Encoder
+}
+
+var encoderPool = sync.Pool{New: func() any {
+	e := new(pooledEncoder)
+	e.enc = json.NewEncoder(&e.buf)
+	return e
+}}
+
+// marshalPooled is like marshal but encodes into a pooled buffer,
+// which saves allocating the result on hot paths. The buffer must be
+// released after which data must no longer be used.
+func marshalPooled(v any) (data []byte, buf *pooledEncoder, err error) {
+	if v != nil {
+		if m, ok := marshalers.Load(reflect.TypeOf(v)); ok {
+			data, err = m.(typeMarshaler).marshal(v)
+			return data, nil, err
+		}
+	}
+	e := encoderPool.Get().(*pooledEncoder)
+	e.buf.Reset()
+	if err := e.enc.Encode(v); err != nil {
+		e.release()
+		return nil, nil, err
+	}
+	return bytes.TrimSuffix(e.buf.Bytes(), []byte("\n")), e, nil
+}
+
+// release returns e to the pool. No-op if e is nil.
+func (e *pooledEncoder) release() {
+	if e != nil && e.buf.Cap() <= 64<<10 { // Don't hold on to large buffers.
+		encoderPool.Put(e)
+	}
+}
+
+// WithUseNumber makes the host decode numbers of responses and stream
+// items into interface values as json.Number instead of float64,
+// which preserves the precision of large integers and decimals.
+// Values of types registered with RegisterMarshaler aren't affected.
+func WithUseNumber() RunOption {
+	return func(c *runConfig) { c.useNumber = true }
+}
+
+// WithPluginUseNumber is like WithUseNumber but makes the plugin
+// decode numbers of requests into interface values as json.Number.
+func WithPluginUseNumber() PluginOption {
+	return func(c *pluginConfig) { c.useNumber = true }
+}
+
+// unmarshal decodes data into v using the unmarshaler registered for T
+// falling back to encoding/json, which decodes numbers into interface
+// values as json.Number if useNumber is set.
+func unmarshal[T any](data []byte, v *T, useNumber bool) error {
+	return unmarshalType(data, reflect.TypeFor[T](), v, useNumber)
+}
+
+// unmarshalType is like unmarshal for v pointing to a value of type t
+// known only at runtime.
+func unmarshalType(data []byte, t reflect.Type, v any, useNumber bool) error {
+	if m, ok := marshalers.Load(t); ok {
+		return m.(typeMarshaler).unmarshal(data, v)
+	}
+	if !useNumber {
+		return json.Unmarshal(data, v)
+	}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	return d.Decode(v)
+}
@@ -0,0 +1,214 @@
+package plugger_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/romshark/plugger"
+	"github.com/romshark/plugger/pluggertest"
+)
+
+// Celsius is encoded as a JSON string like "21.5C".
+type Celsius float64
+
+func init() {
+	plugger.RegisterMarshaler(
+		func(c Celsius) ([]byte, error) {
+			return json.Marshal(strconv.FormatFloat(float64(c), 'f', -1, 64) + "C")
+		},
+		func(data []byte, c *Celsius) error {
+			var s string
+			if err := json.Unmarshal(data, &s); err != nil {
+				return err
+			}
+			f, err := strconv.ParseFloat(strings.TrimSuffix(s, "C"), 64)
+			if err != nil {
+				return fmt.Errorf("parsing celsius: %w", err)
+			}
+			*c = Celsius(f)
+			return nil
+		},
+	)
+}
+
+func TestRegisterMarshaler(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_register_marshaler",
+		"testdata/tmarshal_plugin_main.go.txt")
+
+	raw, err := plugger.Call[Celsius, string](t.Context(), h, "raw", 21.5)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if raw != `"21.5C"` {
+		t.Fatalf("unexpected request encoding: %s", raw)
+	}
+
+	c, err := plugger.Call[Celsius, Celsius](t.Context(), h, "warmer", 21.5)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c != 22.5 {
+		t.Fatalf("unexpected result: %v", c)
+	}
+}
+
+func TestUseNumber(t *testing.T) {
+	bin := pluggertest.BuildModule(t, "test_use_number",
+		"testdata/tnumber_plugin_main.go.txt")
+	const n = json.Number("9007199254740993") // Not representable as float64.
+
+	launch := func(t *testing.T, opts ...plugger.RunOption) *plugger.Host {
+		t.Helper()
+		h := plugger.NewHost()
+		go func() { _ = h.RunPlugin(t.Context(), bin, pluggertest.NewLogWriter(t), opts...) }()
+		t.Cleanup(func() { _ = h.Close() })
+		return h
+	}
+
+	t.Run("plugin", func(t *testing.T) {
+		h := launch(t)
+		typ, err := plugger.Call[any, string](t.Context(), h, "type", n)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if typ != "json.Number" {
+			t.Fatalf("unexpected request type: %s", typ)
+		}
+	})
+
+	t.Run("host", func(t *testing.T) {
+		h := launch(t, plugger.WithUseNumber())
+		v, err := plugger.Call[any, any](t.Context(), h, "echo", n)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if v != n {
+			t.Fatalf("expected %v, got: %#v", n, v)
+		}
+	})
+
+	t.Run("default", func(t *testing.T) {
+		h := launch(t)
+		v, err := plugger.Call[any, any](t.Context(), h, "echo", n)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, ok := v.(float64); !ok {
+			t.Fatalf("expected float64, got: %#v", v)
+		}
+	})
+}
+
+func TestCallWithDecoder(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_with_decoder",
+		"testdata/t1_plugin_main.go.txt")
+
+	errOdd := errors.New("odd sum")
+	decode := func(data json.RawMessage) (AddResp, error) {
+		var r AddResp
+		if err := json.Unmarshal(data, &r); err != nil {
+			return r, err
+		}
+		if r.Sum%2 != 0 {
+			return r, errOdd
+		}
+		r.Sum *= 10
+		return r, nil
+	}
+	resp, err := plugger.CallWithDecoder(t.Context(), h, "add",
+		AddReq{A: 1, B: 3}, decode)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.Sum != 40 {
+		t.Fatalf("unexpected sum: %d", resp.Sum)
+	}
+
+	_, err = plugger.CallWithDecoder(t.Context(), h, "add",
+		AddReq{A: 1, B: 2}, decode)
+	if !errors.Is(err, plugger.ErrMalformedResponse) || !errors.Is(err, errOdd) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Opaque has no exported fields, encoding/json marshals it as {}.
+type Opaque struct{ v int }
+
+type LossyReq struct {
+	A      int       `json:"a"`
+	B      int       `json:"b"`
+	Token  string    `json:"-"`
+	Time   time.Time `json:"time"`
+	Opaque Opaque    `json:"opaque"`
+}
+
+func TestStrictMarshal(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_strict_marshal",
+		"testdata/t1_plugin_main.go.txt")
+	h.SetStrictMarshal(true)
+
+	testPlugin(t, h) // Requests that round-trip are sent.
+
+	// Fields tagged "-" are ignored, times are compared by Equal
+	// since the monotonic clock reading never round-trips.
+	req := LossyReq{A: 1, B: 2, Token: "secret", Time: time.Now()}
+	resp, err := plugger.Call[LossyReq, AddResp](t.Context(), h, "add", req)
+	if err != nil || resp.Sum != 3 {
+		t.Fatalf("unexpected result: %#v, %v", resp, err)
+	}
+
+	req.Opaque = Opaque{v: 1}
+	_, err = plugger.Call[LossyReq, AddResp](t.Context(), h, "add", req)
+	if !errors.Is(err, plugger.ErrNonRoundTrippable) {
+		t.Fatalf("expected ErrNonRoundTrippable, got: %v", err)
+	}
+	if !strings.Contains(err.Error(), "Opaque differ") {
+		t.Fatalf("error doesn't name the differing field: %v", err)
+	}
+
+	h.SetStrictMarshal(false)
+	resp, err = plugger.Call[LossyReq, AddResp](t.Context(), h, "add", req)
+	if err != nil || resp.Sum != 3 {
+		t.Fatalf("unexpected result: %#v, %v", resp, err)
+	}
+}
+
+func TestCallArgs(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_call_args",
+		"testdata/t1_plugin_main.go.txt")
+
+	resp, err := plugger.CallArgs[[]any](t.Context(), h, "__echo",
+		1, "two", Celsius(21.5), []int{3}, nil,
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expect := []any{1.0, "two", "21.5C", []any{3.0}, nil}
+	if !reflect.DeepEqual(resp, expect) {
+		t.Fatalf("unexpected response: %#v", resp)
+	}
+
+	resp, err = plugger.CallArgs[[]any](t.Context(), h, "__echo")
+	if err != nil || resp == nil || len(resp) != 0 {
+		t.Fatalf("expected an empty array, got: %#v, %v", resp, err)
+	}
+
+	_, err = plugger.CallArgs[[]any](t.Context(), h, "__echo", 1, func() {})
+	if err == nil || !strings.Contains(err.Error(), "argument 1") {
+		t.Fatalf("expected error naming the argument, got: %v", err)
+	}
+
+	var g plugger.CallGroup
+	g.Cancel()
+	_, err = plugger.CallArgsWith[[]any](t.Context(), h, "__echo",
+		[]plugger.CallOption{plugger.WithCallGroup(&g)}, 1)
+	if !errors.Is(err, plugger.ErrCanceledByHost) {
+		t.Fatalf("expected ErrCanceledByHost, got: %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package plugger
+
+import "time"
+
+// CallStats describes a completed plugin call.
+type CallStats struct {
+	ID       string
+	Method   string
+	Duration time.Duration
+
+	// RequestBytes and ResponseBytes are the sizes of the JSON encoded
+	// request and response data. ResponseBytes includes stream items.
+	RequestBytes  int
+	ResponseBytes int
+
+	// QueueWait is how long the request waited in the plugin before
+	// its handler started and ExecTime is how long the handler ran.
+	// High queue waits indicate a saturated plugin rather than a slow
+	// handler. Zero unless the plugin supports FeatureTiming.
+	QueueWait time.Duration
+	ExecTime  time.Duration
+
+	// Attempt is the 1-based attempt of the call the request was sent
+	// for, which is more than 1 for calls retried with WithRestartRetry.
+	Attempt int
+
+	// MarshalTime is how long marshaling the request data and encoding
+	// the request took, WaitTime is how long the call waited for the
+	// final response afterwards, including decoding the responses, and
+	// UnmarshalTime is how long unmarshaling the response data took.
+	// They tell the serialization overhead apart from the time spent
+	// in the plugin, see Host.SetSerializationTiming.
+	MarshalTime   time.Duration
+	WaitTime      time.Duration
+	UnmarshalTime time.Duration
+
+	Err error // nil if the call succeeded
+}
+
+// timing is the time a request spent in the plugin in microseconds.
+type timing struct {
+	Queue int64 `json:"queue"` // Since it was received until the handler started.
+	Exec  int64 `json:"exec"`  // Since the handler started until it returned.
+}
+
+// PayloadSizes aggregates the payload sizes of the calls of a method.
+type PayloadSizes struct {
+	Calls            int
+	RequestBytes     int64 // Total
+	ResponseBytes    int64 // Total
+	MaxRequestBytes  int
+	MaxResponseBytes int
+}
+
+// AvgRequestBytes returns the average request size.
+func (s PayloadSizes) AvgRequestBytes() float64 {
+	if s.Calls == 0 {
+		return 0
+	}
+	return float64(s.RequestBytes) / float64(s.Calls)
+}
+
+// AvgResponseBytes returns the average response size.
+func (s PayloadSizes) AvgResponseBytes() float64 {
+	if s.Calls == 0 {
+		return 0
+	}
+	return float64(s.ResponseBytes) / float64(s.Calls)
+}
+
+// OnCallEnd sets fn to be called whenever a call sent to the plugin
+// completed, which excludes calls served from the cache and calls
+// failing before the request was sent. Coalesced calls are reported once.
+// fn is invoked synchronously and must not block.
+func (h *Host) OnCallEnd(fn func(CallStats)) {
+	h.lock.Lock()
+	h.onCallEnd = fn
+	h.lock.Unlock()
+}
+
+// SetSerializationTiming makes the stats reported to OnCallEnd include
+// the time spent marshaling and unmarshaling (see CallStats.MarshalTime),
+// which helps to quantify the gains of custom marshalers and decoders
+// (see RegisterMarshaler and CallWithDecoder). Marshaling is only measured
+// for calls marshaling a typed request and unmarshaling for calls
+// returning a typed response that weren't coalesced, such as Call.
+// Calls are reported after the response was unmarshaled then.
+func (h *Host) SetSerializationTiming(enable bool) { h.serialTiming.Store(enable) }
+
+// PayloadSizes returns the payload sizes of the calls sent to the plugin
+// by method, counting the same calls as OnCallEnd.
+func (h *Host) PayloadSizes() map[string]PayloadSizes {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	m := make(map[string]PayloadSizes, len(h.sizes))
+	for method, s := range h.sizes {
+		m[method] = s
+	}
+	return m
+}
+
+func (h *Host) callEnded(s CallStats) {
+	h.lock.Lock()
+	if h.sizes == nil {
+		h.sizes = map[string]PayloadSizes{}
+	}
+	sizes := h.sizes[s.Method]
+	sizes.Calls++
+	sizes.RequestBytes += int64(s.RequestBytes)
+	sizes.ResponseBytes += int64(s.ResponseBytes)
+	sizes.MaxRequestBytes = max(sizes.MaxRequestBytes, s.RequestBytes)
+	sizes.MaxResponseBytes = max(sizes.MaxResponseBytes, s.ResponseBytes)
+	h.sizes[s.Method] = sizes
+	fn := h.onCallEnd
+	h.lock.Unlock()
+	if fn != nil {
+		fn(s)
+	}
+}
@@ -0,0 +1,122 @@
+package plugger_test
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/romshark/plugger"
+	"github.com/romshark/plugger/pluggertest"
+)
+
+func TestPayloadSizes(t *testing.T) {
+	modDir := pluggertest.MakeModule(t, "test_payload_sizes",
+		"testdata/t1_plugin_main.go.txt")
+	h := plugger.NewHost()
+	var lock sync.Mutex
+	var stats []plugger.CallStats
+	h.OnCallEnd(func(s plugger.CallStats) {
+		lock.Lock()
+		stats = append(stats, s)
+		lock.Unlock()
+	})
+	h.Configure(modDir, plugger.WithStderr(pluggertest.NewLogWriter(t)))
+	defer func() { _ = h.Close() }()
+
+	for _, r := range []AddReq{{A: 2, B: 3}, {A: 200, B: 300}} {
+		if _, err := plugger.Call[AddReq, AddResp](
+			t.Context(), h, "add", r,
+		); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// {"a":2,"b":3} → {"sum":5}
+	// {"a":200,"b":300} → {"sum":500}
+	expect := plugger.PayloadSizes{
+		Calls:            2,
+		RequestBytes:     13 + 17,
+		ResponseBytes:    9 + 11,
+		MaxRequestBytes:  17,
+		MaxResponseBytes: 11,
+	}
+	s := h.PayloadSizes()["add"]
+	if s != expect {
+		t.Fatalf("expected %#v, got %#v", expect, s)
+	}
+	if avg := s.AvgRequestBytes(); avg != 15 {
+		t.Fatalf("unexpected average request size: %v", avg)
+	}
+	if avg := s.AvgResponseBytes(); avg != 10 {
+		t.Fatalf("unexpected average response size: %v", avg)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(stats) != 2 {
+		t.Fatalf("expected 2 calls, got %d", len(stats))
+	}
+	last := stats[1]
+	if last.Method != "add" || last.ID == "" || last.Err != nil ||
+		last.RequestBytes != 17 || last.ResponseBytes != 11 {
+		t.Fatalf("unexpected call stats: %#v", last)
+	}
+}
+
+func TestCallTiming(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_call_timing",
+		"testdata/tcount_plugin_main.go.txt")
+	stats := make(chan plugger.CallStats, 1)
+	h.OnCallEnd(func(s plugger.CallStats) { stats <- s })
+
+	_, err := plugger.Call[struct{}, struct{}](t.Context(), h, "slow_count", struct{}{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s := <-stats
+	if s.ExecTime < 200*time.Millisecond || s.ExecTime > s.Duration {
+		t.Fatalf("unexpected execution time %v of call taking %v", s.ExecTime, s.Duration)
+	}
+	if s.QueueWait < 0 || s.QueueWait+s.ExecTime > s.Duration {
+		t.Fatalf("unexpected queue wait %v of call taking %v", s.QueueWait, s.Duration)
+	}
+}
+
+func TestSerializationTiming(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_serialization_timing",
+		"testdata/t1_plugin_main.go.txt")
+	var stats []plugger.CallStats // Reported synchronously.
+	h.OnCallEnd(func(s plugger.CallStats) { stats = append(stats, s) })
+	slowDecode := func(data json.RawMessage) (AddResp, error) {
+		time.Sleep(20 * time.Millisecond)
+		var r AddResp
+		return r, json.Unmarshal(data, &r)
+	}
+
+	for _, enabled := range []bool{false, true} {
+		h.SetSerializationTiming(enabled)
+		if _, err := plugger.CallWithDecoder(
+			t.Context(), h, "add", AddReq{A: 1, B: 2}, slowDecode,
+		); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if len(stats) != 2 {
+		t.Fatalf("expected 2 calls, got %d", len(stats))
+	}
+	if s := stats[0]; s.MarshalTime != 0 || s.WaitTime != 0 || s.UnmarshalTime != 0 {
+		t.Fatalf("expected no timing when disabled, got: %#v", s)
+	}
+	s := stats[1]
+	if s.MarshalTime <= 0 || s.WaitTime <= 0 {
+		t.Fatalf("expected marshal and wait times, got: %#v", s)
+	}
+	if s.UnmarshalTime < 20*time.Millisecond {
+		t.Fatalf("expected unmarshal time of at least 20ms, got %s", s.UnmarshalTime)
+	}
+	if s.WaitTime > s.Duration {
+		t.Fatalf("wait time %s exceeds duration %s", s.WaitTime, s.Duration)
+	}
+}
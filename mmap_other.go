@@ -0,0 +1,14 @@
+//go:build !unix
+
+package plugger
+
+import "os"
+
+// mapFile reads the file since memory mapping isn't supported.
+func mapFile(path string) (data []byte, unmap func(), err error) {
+	data, err = os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() {}, nil
+}
@@ -0,0 +1,31 @@
+//go:build unix
+
+package plugger
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps the file into memory read-only.
+func mapFile(path string) (data []byte, unmap func(), err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.Size() == 0 {
+		return []byte{}, func() {}, nil // Empty files can't be mapped.
+	}
+	data, err = syscall.Mmap(
+		int(f.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() { _ = syscall.Munmap(data) }, nil
+}
@@ -0,0 +1,15 @@
+package plugger
+
+// Pause makes the plugin reject new requests with ErrPaused until Resume
+// is invoked, for example to quiesce the plugin for a migration without
+// stopping it. Requests in progress are unaffected and built-in methods,
+// such as health checks, are still served. Hosts supporting
+// FeatureErrorCode receive ErrPaused and may back off and retry.
+func (p *Plugin) Pause() { p.paused.Store(true) }
+
+// Resume makes the paused plugin serve new requests again.
+// No-op if the plugin isn't paused.
+func (p *Plugin) Resume() { p.paused.Store(false) }
+
+// Paused reports whether the plugin was paused by Pause.
+func (p *Plugin) Paused() bool { return p.paused.Load() }
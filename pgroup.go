@@ -0,0 +1,29 @@
+package plugger
+
+// WithProcessGroup starts the plugin in a new process group and kills the
+// whole group whenever the plugin is killed, for example once it stopped
+// responding (see WithReadTimeout). This is meant for launcher plugins
+// starting the actual plugin as a child process, which would otherwise
+// outlive the launcher and keep running. Go source plugins are launchers
+// too, the go command runs the compiled plugin as its child process.
+//
+// The host tracks the plugin by the protocol rather than the launched
+// process: the handshake and all calls are answered by whichever process
+// ends up speaking the protocol and the plugin stopped once the protocol
+// output was closed by all processes holding it. So launchers must pass
+// stdin and stdout (or the pipes of WithStdio) to the actual plugin
+// unchanged and not use them themselves. Launchers replacing themselves
+// with syscall.Exec keep their process and need no process group.
+// Ignored on platforms other than Unix.
+func WithProcessGroup() RunOption {
+	return func(c *runConfig) { c.processGroup = true }
+}
+
+// killProcess kills the plugin process
+// and its process group if launched with WithProcessGroup.
+func (p *process) killProcess() {
+	if p.group {
+		killGroup(p.osProc)
+	}
+	_ = p.osProc.Kill()
+}
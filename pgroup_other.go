@@ -0,0 +1,12 @@
+//go:build !unix
+
+package plugger
+
+import (
+	"os"
+	"os/exec"
+)
+
+func setProcessGroup(*exec.Cmd) {}
+
+func killGroup(*os.Process) {}
@@ -0,0 +1,24 @@
+//go:build unix
+
+package plugger
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup makes cmd start in a new process group.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	if !cmd.SysProcAttr.Setsid { // A new session is a new group already.
+		cmd.SysProcAttr.Setpgid = true
+	}
+}
+
+// killGroup kills the process group led by proc.
+func killGroup(proc *os.Process) {
+	_ = syscall.Kill(-proc.Pid, syscall.SIGKILL)
+}
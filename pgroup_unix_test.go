@@ -0,0 +1,56 @@
+//go:build unix
+
+package plugger_test
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/romshark/plugger"
+	"github.com/romshark/plugger/pluggertest"
+)
+
+func TestProcessGroup(t *testing.T) {
+	bin := pluggertest.BuildModule(t, "test_process_group", "testdata/tfd_plugin_main.go.txt")
+	h := plugger.NewHost()
+	errs := make(chan error, 1)
+	go func() {
+		// The shell is a launcher running the plugin as its child.
+		errs <- h.RunPlugin(t.Context(), bin, pluggertest.NewLogWriter(t),
+			plugger.WithLauncherPrefix([]string{"sh", "-c", `"$0"; exit $?`}),
+			plugger.WithReadTimeout(100*time.Millisecond),
+			plugger.WithProcessGroup())
+	}()
+
+	pid, err := plugger.Call[struct{}, int](t.Context(), h, "pid", struct{}{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The stopped plugin no longer responds and is killed.
+	if err := syscall.Kill(pid, syscall.SIGSTOP); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = syscall.Kill(pid, syscall.SIGKILL) }()
+	_, err = plugger.Call[struct{}, int](t.Context(), h, "pid", struct{}{})
+	if !errors.Is(err, plugger.ErrReadTimeout) {
+		t.Fatalf("expected ErrReadTimeout, got: %v", err)
+	}
+	if err := <-errs; !errors.Is(err, plugger.ErrReadTimeout) {
+		t.Fatalf("expected RunPlugin to return ErrReadTimeout, got: %v", err)
+	}
+
+	// Close waits for the plugin's stderr to be closed,
+	// which it never would be if the plugin survived the launcher.
+	closed := make(chan struct{})
+	go func() {
+		_ = h.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the plugin survived the launcher")
+	}
+}
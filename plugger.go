@@ -2,229 +2,1985 @@ package plugger
 
 import (
 	"bufio"
+	"bytes"
+	"cmp"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // envelope defines the JSON based wire format.
+// Unknown fields are ignored by both the host and the plugin,
+// which allows extending the envelope without breaking older peers.
+// Extensions are only used if negotiated in the handshake.
 type envelope struct {
-	Cancel string          `json:"cancel,omitempty"` // Request ID to cancel
-	ID     string          `json:"id,omitempty"`     // Unique per request
-	Method string          `json:"method,omitempty"` // Request side only
-	Error  string          `json:"err,omitempty"`    // Set on error responses
-	Data   json.RawMessage `json:"data,omitempty"`   // Payload
+	Cancel   string          `json:"cancel,omitempty"`  // Request ID to cancel
+	Cancels  []string        `json:"cancels,omitempty"` // Request IDs to cancel
+	ID       string          `json:"id,omitempty"`      // Unique per request
+	Method   string          `json:"method,omitempty"`  // Request side only
+	Error    string          `json:"err,omitempty"`     // Set on error responses
+	Data     json.RawMessage `json:"data,omitempty"`    // Payload
+	Chunk    bool            `json:"chunk,omitempty"`   // Set on stream items
+	Variant  string          `json:"variant,omitempty"` // Response data variant tag
+	Deadline time.Time       `json:"deadline,omitzero"` // Caller deadline, request side only
+	Stack    string          `json:"stack,omitempty"`   // Stack trace of the error, response side only
+	Logs     bool            `json:"logs,omitempty"`    // Set if the caller receives logs, request side only
+	Log      *string         `json:"log,omitempty"`     // Log message of the request, response side only
+	File     string          `json:"file,omitempty"`    // Path of the shared request data, request side only
+	FD       bool            `json:"fd,omitempty"`      // A file descriptor was passed, request side only
+
+	Headers map[string]string `json:"headers,omitempty"` // Set by WithHeaders, request side only
+
+	Compressed bool    `json:"compressed,omitempty"` // Data is compressed, response side only
+	Retry      int64   `json:"retry,omitempty"`      // Milliseconds to back off, response side only
+	Timing     *timing `json:"timing,omitempty"`     // Time spent in the plugin, response side only
+	Binary     int     `json:"binary,omitempty"`     // Length of the binary frame data, response side only
+	Credits    int     `json:"credits,omitempty"`    // Stream items the plugin may send ahead, request and credit only
+	Credit     string  `json:"credit,omitempty"`     // Request ID granted more credits, credit only
+	Callback   bool    `json:"callback,omitempty"`   // Call of the plugin to the host or its response
+	Code       string  `json:"code,omitempty"`       // Identifies the error, response side only
+	Reason     string  `json:"reason,omitempty"`     // Why the request was canceled, cancel only
+
+	bin []byte // Data of a binary frame, see frameBinary
+}
+
+type Host struct {
+	idCounter   atomic.Uint64
+	readyOnce   sync.Once
+	ready       chan struct{} // closed once the plugin may be launched or used
+	launchLock  sync.Mutex    // serializes plugin launches
+	callTimeout time.Duration // set by WithCallTimeout
+	lock        sync.Mutex    // protects all fields below
+	proc        *process      // nil if the plugin isn't running
+	closed      bool          // set by Close
+	stopped     chan struct{} // closed once the plugin closed by Close exited
+	restarted   chan struct{} // closed once relaunched, nil unless relaunching, see WithRestart
+	stopRestart func(error)   // stops relaunching, nil unless relaunching, see Close
+	err         error         // the last plugin process stopped with, see Err
+	startErr    error         // RunPlugin failed to launch the plugin with
+	lazy        *runConfig    // set by Configure
+	initMethod  string        // set by SetInitCall
+	initReq     json.RawMessage
+	handlers    map[string]hostHandler // set by HandleHost
+	coalescer   coalescer
+	cache       responseCache
+
+	onProgress    func(ctx context.Context, msg string)
+	onSpawn       func(ctx context.Context, kind SpawnKind, cmd string, args []string)
+	onCallEnd     func(CallStats)
+	sizes         map[string]PayloadSizes // by method
+	useNumber     atomic.Bool             // set by WithUseNumber
+	strictMarshal atomic.Bool             // set by SetStrictMarshal
+	serialTiming  atomic.Bool             // set by SetSerializationTiming
+	buffered      bufferBudget            // see SetMaxBufferedBytes
+
+	idleTimeout time.Duration
+	idleTimer   *time.Timer
+	inflight    int // number of calls currently in progress
+}
+
+// process is a single launched plugin process.
+type process struct {
+	cmd            *exec.Cmd   // nil if adopted, see AdoptHost
+	osProc         *os.Process // cmd.Process unless adopted
+	wait           func() error
+	kind           SpawnKind
+	module         string // module path of local packages, see ModulePath
+	stderr         *phaseWriter
+	buildLog       *tailBuffer // stderr until confirmed running, nil if not captured
+	stderrTail     *tailBuffer // see ExitError, nil if adopted
+	dec            decoder
+	stdin          io.Closer
+	stdout         io.Closer     // closed once exited, nil if owned by cmd
+	output         io.Closer     // protocol output, closed to abort reading
+	release        func()        // frees the ProcessLimit slot
+	lazy           bool          // launched by a call
+	compression    *compression  // requested in the handshake, nil if disabled
+	fdConn         *net.UnixConn // nil unless launched with WithFDPassing
+	fdWriteTimeout time.Duration // zero if passing files never times out
+	pty            *os.File      // nil unless launched with WithPTY
+	group          bool          // killed as a process group, see WithProcessGroup
+	restart        bool          // relaunched once exited unexpectedly, see WithRestart
+	done           chan struct{} // closed when run() returns
+	queued         atomic.Int32  // calls waiting for lock to send a request
+	lock           sync.Mutex    // protects all fields below
+	enc            *json.Encoder
+	pending        map[string]*pendingCall
+	closed         bool       // set once run() stops reading responses
+	closing        bool       // set by close
+	features       featureSet // negotiated in the handshake
+	version        string     // negotiated in the handshake
+	build          *BuildInfo // nil if unknown
+
+	bufw         *bufio.Writer // nil if writes aren't buffered
+	flushDelay   time.Duration
+	flushTimer   *time.Timer
+	flushPending bool
+
+	maxCancelBatch int      // cancels are sent individually if < 2
+	cancels        []string // request IDs queued for a batched cancel
+
+	readTimeout time.Duration // zero if reads never time out
+	readTimer   *time.Timer
+	lastRead    time.Time // or when the first pending call was sent
+	stopErr     error     // returned to pending calls instead of ErrClosed
+
+	handoffID string // ID of the last response read before a handoff
+	leftover  []byte // read but not decoded before the handoff
+}
+
+// pendingCall is a call awaiting response envelopes.
+type pendingCall struct {
+	ch       chan envelope // closed if the plugin stops responding
+	done     chan struct{} // closed once the caller stops receiving
+	canceled chan struct{} // closed by Host.CancelCall and CallGroup.Cancel
+	info     CallInfo
+
+	remoteCanceled atomic.Bool // set once the plugin was asked to cancel
+
+	lockDeliver sync.Mutex // serializes delivering and abandoning
+	abandoned   bool       // set once the caller stopped receiving
+}
+
+// HostOption configures a host.
+type HostOption func(*Host)
+
+// WithCallTimeout makes every non-streaming call, which includes Call,
+// SendFD, CallShared and the built-in methods such as Host.Echo,
+// Host.Health and Host.PrepareShutdown, time out after d unless
+// the caller's context has a deadline already.
+// Timed out calls are canceled on the plugin and return
+// context.DeadlineExceeded just like calls whose context timed out.
+// The timeout starts once the plugin is running, so launching the plugin,
+// which includes compiling Go source plugins, doesn't count towards it.
+// Retries (see WithRestartRetry) share the timeout. Streaming calls,
+// which may run for any amount of time, don't time out. Non-positive
+// durations disable the timeout.
+func WithCallTimeout(d time.Duration) HostOption {
+	return func(h *Host) { h.callTimeout = d }
+}
+
+// NewHost creates an empty host. Call RunPlugin or Configure afterwards.
+func NewHost(opts ...HostOption) *Host {
+	h := &Host{ready: make(chan struct{})}
+	for _, o := range opts {
+		o(h)
+	}
+	return h
+}
+
+var (
+	ErrInvalidPluginPath    = errors.New("invalid plugin path")
+	ErrAlreadyRunning       = errors.New("plugin already running")
+	ErrGoToolchainNotFound  = errors.New("go toolchain not in PATH")
+	ErrClosed               = errors.New("closed")
+	ErrMalformedResponse    = errors.New("malformed response")
+	ErrModuleResolution     = errors.New("resolving module")
+	ErrUnknownVariant       = errors.New("unknown response variant")
+	ErrStreamUnsupported    = errors.New("host doesn't support streams")
+	ErrStdioUnsupported     = errors.New("stdio passthrough not supported")
+	ErrProcessLimit         = errors.New("plugin process limit reached")
+	ErrCanceledByHost       = errors.New("canceled by host")
+	ErrTimeout              = errors.New("plugin timed out")
+	ErrReadTimeout          = fmt.Errorf("%w: stopped responding", ErrTimeout)
+	ErrWriteTimeout         = fmt.Errorf("%w: stopped receiving", ErrTimeout)
+	ErrInvalidFrame         = errors.New("invalid NDJSON frame")
+	ErrBuildDir             = errors.New("build directory not writable")
+	ErrFDPassingUnsupported = errors.New("file descriptor passing not supported")
+	ErrPTYUnsupported       = errors.New("pseudo-terminals not supported")
+	ErrPluginPanic          = errors.New("plugin panicked")
+	ErrEmptyMethod          = errors.New("empty method name")
+	ErrPluginBuildFailed    = errors.New("plugin build failed")
+	ErrProtocolVersion      = errors.New("incompatible protocol version")
+	ErrReentrantCall        = errors.New("call from a callback blocking the plugin launch")
+	ErrPayloadTooLarge      = errors.New("payload too large")
+	ErrHandedOff            = errors.New("plugin handed off to another host")
+	ErrHandoffUnsupported   = errors.New("plugin handoff not supported")
+	ErrNonRoundTrippable    = errors.New("request doesn't survive marshaling")
+	ErrInitFailed           = errors.New("plugin init call failed")
+	ErrPaused               = errors.New("plugin paused")
+	ErrStartFailed          = errors.New("plugin failed to start")
+	ErrCallbackUnsupported  = errors.New("host doesn't support callbacks")
+)
+
+// ErrorResponse is a copy of the "err" field in the plugin response JSON.
+type ErrorResponse string
+
+func (e ErrorResponse) Error() string { return string(e) }
+
+// RunOption configures how a plugin is launched.
+type RunOption func(*runConfig)
+
+type runConfig struct {
+	plugin      string
+	buildStderr io.Writer // stderr until the plugin is confirmed running
+	stderr      io.Writer
+	flushDelay  time.Duration // zero if writes aren't buffered
+	cancelBatch int
+
+	readBufferSize  int // set by WithReadBufferSize
+	writeBufferSize int // set by WithWriteBufferSize
+
+	stdio  bool // protocol over extra pipes, set by WithStdio
+	stdin  io.Reader
+	stdout io.Writer
+
+	limit *ProcessLimit // nil if unlimited
+
+	readTimeout time.Duration
+	ndjson      bool
+	useNumber   bool
+
+	compression         *compression  // set by WithAdaptiveCompression
+	maxDecompressedSize int64         // set by WithMaxDecompressedSize
+	fdPassing           bool          // set by WithFDPassing
+	fdWriteTimeout      time.Duration // set by WithFDWriteTimeout
+	pty                 bool          // set by WithPTY
+
+	contextEnv map[any]string // set by WithContextEnvMapping
+	prebuilt   string         // set by WithPrebuilt
+
+	launcherPrefix []string       // set by WithLauncherPrefix
+	processGroup   bool           // set by WithProcessGroup
+	restart        *RestartPolicy // set by WithRestart
+	skipHandshake  bool           // set by WithoutHandshake
+
+	goTmpDir string // GOTMPDIR of the go toolchain, set by WithGoBuildDirs
+	goCache  string // GOCACHE of the go toolchain, set by WithGoBuildDirs
+}
+
+func newRunConfig(plugin string, stderr io.Writer, opts []RunOption) *runConfig {
+	c := &runConfig{
+		plugin:      plugin,
+		buildStderr: stderr,
+		stderr:      stderr,
+		cancelBatch: 64,
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+// WithStderr forwards the plugin's stderr to w instead of os.Stderr.
+// Unlike the pluginStderr argument of RunPlugin, w is never closed.
+func WithStderr(w io.Writer) RunOption {
+	return func(c *runConfig) { c.buildStderr, c.stderr = w, w }
+}
+
+// WithBuildStderr forwards the plugin's stderr to w until the plugin
+// is confirmed running, which includes the output of the go toolchain
+// compiling Go source plugins. The stderr writer is used afterwards.
+func WithBuildStderr(w io.Writer) RunOption {
+	return func(c *runConfig) { c.buildStderr = w }
+}
+
+// WithRuntimeStderr forwards the plugin's stderr to w once the plugin
+// is confirmed running. The stderr writer is used until then.
+func WithRuntimeStderr(w io.Writer) RunOption {
+	return func(c *runConfig) { c.stderr = w }
+}
+
+// WithWriteBuffer buffers requests written to the plugin reducing the
+// number of syscalls at high call rates. Buffered requests are written
+// once no other call is about to send a request, the buffer is full,
+// delay after the first request was buffered or when Host.Flush is
+// called, whichever comes first, so calls never wait for delay
+// while the plugin didn't receive their request.
+func WithWriteBuffer(delay time.Duration) RunOption {
+	return func(c *runConfig) { c.flushDelay = delay }
+}
+
+// WithCancelBatch limits the number of queued request cancelations sent
+// to the plugin in a single message, 64 by default.
+// Cancelations are queued while one is being written, which keeps
+// cancelation cheap when many calls are canceled at once.
+// Cancelations are sent one at a time if max < 2 or the plugin
+// doesn't support FeatureCancelBatch.
+func WithCancelBatch(max int) RunOption {
+	return func(c *runConfig) { c.cancelBatch = max }
+}
+
+// WithReadTimeout declares the plugin dead if no response arrives within d
+// while calls are awaiting responses, which catches plugins that are
+// stuck without exiting. The plugin is killed and calls awaiting
+// responses return ErrReadTimeout, which wraps ErrTimeout like
+// ErrWriteTimeout does. Disabled by default.
+// Long running calls must stream items more often than d to keep
+// the plugin alive.
+func WithReadTimeout(d time.Duration) RunOption {
+	return func(c *runConfig) { c.readTimeout = d }
+}
+
+// WithGoBuildDirs makes the go toolchain compiling Go source plugins
+// write temporary build artifacts to tmpDir (GOTMPDIR) and cache them in
+// cacheDir (GOCACHE), which is useful where the default locations aren't
+// writable. Empty directories keep the defaults. Launching the plugin fails
+// with ErrBuildDir if a directory isn't writable. Plugin executables
+// are unaffected.
+func WithGoBuildDirs(tmpDir, cacheDir string) RunOption {
+	return func(c *runConfig) { c.goTmpDir, c.goCache = tmpDir, cacheDir }
+}
+
+// RunPlugin executes a plugin executable or Go file/package/module
+// and blocks until the plugin stops responding.
+// Canceling ctx and Close shut the plugin down the same way:
+// the host stops accepting calls, the plugin's stdin is closed making it
+// exit, pending calls fail with ErrClosed once the plugin's stdout closed
+// and the process is awaited. RunPlugin returns once the process exited,
+// usually with io.EOF.
+// If it fails to launch the plugin it may be called again,
+// possibly concurrently, to retry. Calls made in the meantime return
+// ErrStartFailed wrapping ErrClosed and the error RunPlugin returned.
+// Returns ErrAlreadyRunning if the plugin is running.
+// An error closing pluginStderr, which may mean that logs were lost,
+// is joined with the returned error.
+func (h *Host) RunPlugin(
+	ctx context.Context, plugin string, pluginStderr io.WriteCloser,
+	opts ...RunOption,
+) (err error) {
+	h.lock.Lock()
+	running := h.proc != nil
+	h.lock.Unlock()
+	if running {
+		return ErrAlreadyRunning
+	}
+	defer h.signalReady() // Unblock Call waiters even if the launch fails.
+	var stderr io.Writer = os.Stderr
+	if pluginStderr != nil {
+		stderr = pluginStderr
+		defer func() {
+			// Signal no more logs.
+			if errClose := pluginStderr.Close(); errClose != nil {
+				err = errors.Join(err,
+					fmt.Errorf("closing plugin stderr: %w", errClose))
+			}
+		}()
+	}
+	cfg := newRunConfig(plugin, stderr, opts)
+
+	h.launchLock.Lock()
+	p, err := h.launch(ctx, cfg)
+	if err != nil && !errors.Is(err, ErrAlreadyRunning) {
+		h.lock.Lock()
+		h.startErr = err
+		h.lock.Unlock()
+	}
+	h.launchLock.Unlock()
+	if err != nil {
+		return err
+	}
+	h.signalReady() // Signal Call waiters that the plugin is ready.
+	// Canceling ctx closes the host just like Close.
+	stop := context.AfterFunc(ctx, func() { h.CloseAsync() })
+	defer stop()
+	for n := 0; ; n++ {
+		p.restart = cfg.restart != nil && n < cfg.restart.MaxRestarts
+		if err = h.run(ctx, p); !h.relaunching() {
+			break
+		}
+		_ = p.close() // Reap the exited process.
+		next, errLaunch := h.relaunch(ctx, cfg, n)
+		if errLaunch != nil {
+			if !errors.Is(errLaunch, ErrClosed) {
+				err = errLaunch
+			} // Otherwise return why the plugin exited.
+			break
+		}
+		p = next
+	}
+	h.awaitStopped()
+	return err
+}
+
+// Configure sets up the plugin without launching it.
+// The plugin is launched by the first Call and relaunched by the first
+// Call after it was shut down by the idle timeout.
+// The plugin's stderr is forwarded to os.Stderr unless WithStderr is used.
+// Panics if opts include WithRestart.
+func (h *Host) Configure(plugin string, opts ...RunOption) {
+	cfg := newRunConfig(plugin, os.Stderr, opts)
+	if cfg.restart != nil {
+		panic("WithRestart is unsupported for lazily launched plugins")
+	}
+	h.lock.Lock()
+	h.lazy = cfg
+	h.lock.Unlock()
+	h.signalReady()
+}
+
+// Startup progress messages passed to the OnStartupProgress callback.
+const (
+	StartupCompiling         = "compiling"
+	StartupProcessStarted    = "process started"
+	StartupHandshakeComplete = "handshake complete"
+)
+
+// OnStartupProgress sets fn to be called at every startup milestone
+// of the plugin, which is useful for giving feedback while the go
+// toolchain compiles Go source plugins. Go source plugins report
+// StartupCompiling when the go command starts, other executables report
+// StartupProcessStarted instead. StartupHandshakeComplete is reported
+// once the plugin is ready. fn is invoked synchronously and must not block.
+// Calls made by fn with ctx fail with ErrReentrantCall since they would
+// wait for the launch fn is blocking, make them once fn returned.
+// Calls of other goroutines aren't affected.
+func (h *Host) OnStartupProgress(fn func(ctx context.Context, msg string)) {
+	h.lock.Lock()
+	h.onProgress = fn
+	h.lock.Unlock()
+}
+
+// OnSpawn sets fn to be called whenever a plugin process is started
+// with how the plugin path was classified (see SpawnKind) and the command
+// and arguments it was started with. Commands of SpawnLocalPackage run
+// in the plugin directory. fn is invoked synchronously and must not block.
+// Calls made by fn with ctx fail with ErrReentrantCall just like
+// for OnStartupProgress.
+func (h *Host) OnSpawn(
+	fn func(ctx context.Context, kind SpawnKind, cmd string, args []string),
+) {
+	h.lock.Lock()
+	h.onSpawn = fn
+	h.lock.Unlock()
+}
+
+func (h *Host) signalReady() { h.readyOnce.Do(func() { close(h.ready) }) }
+
+// launch starts the plugin process, waits for the handshake
+// and makes it the current process. h.launchLock must be held.
+func (h *Host) launch(ctx context.Context, cfg *runConfig) (*process, error) {
+	h.lock.Lock()
+	closed, running := h.closed, h.proc != nil
+	h.lock.Unlock()
+	switch {
+	case closed:
+		return nil, ErrClosed
+	case running:
+		return nil, ErrAlreadyRunning
+	}
+
+	h.lock.Lock()
+	onProgress, onSpawn := h.onProgress, h.onSpawn
+	initMethod, initReq := h.initMethod, h.initReq
+	h.lock.Unlock()
+	launchCtx := launchContext(ctx)
+	progress := func(msg string) {
+		if onProgress != nil {
+			onProgress(launchCtx, msg)
+		}
+	}
+
+	release, err := cfg.limit.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p, err := start(cfg, contextEnv(ctx, cfg.contextEnv))
+	if err != nil {
+		release()
+		return nil, err
+	}
+	p.release = release
+	if onSpawn != nil {
+		onSpawn(launchCtx, p.kind, p.cmd.Path, p.cmd.Args[1:])
+	}
+	if p.kind == SpawnExecutable {
+		progress(StartupProcessStarted)
+	} else {
+		progress(StartupCompiling)
+	}
+	if cfg.skipHandshake {
+		p.skipHandshake()
+	} else if err := p.handshake(ctx, fmt.Sprintf("%x", h.idCounter.Add(1))); err != nil {
+		p.kill()
+		if p.buildLog != nil && ctx.Err() == nil {
+			if msg := moduleResolutionError(p.buildLog.String()); msg != "" {
+				return nil, fmt.Errorf("%w: %s", ErrModuleResolution, msg)
+			}
+		}
+		return nil, err
+	}
+	if p.build == nil && p.kind != SpawnExecutable {
+		p.build = toolchainBuildInfo(p.cmd)
+	}
+	p.stderr.set(cfg.stderr)
+	progress(StartupHandshakeComplete)
+	if initMethod != "" {
+		id := fmt.Sprintf("%x", h.idCounter.Add(1))
+		serve := func(ev envelope) {
+			go h.serveCallback(launchCtx, p, ev)
+		}
+		if err := p.initCall(ctx, id, initMethod, initReq, serve); err != nil {
+			p.kill()
+			return nil, fmt.Errorf("%w: %w", ErrInitFailed, err)
+		}
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closed {
+		// Host was closed while the plugin was starting.
+		p.kill()
+		return nil, ErrClosed
+	}
+	h.proc, h.err, h.startErr = p, nil, nil
+	h.useNumber.Store(cfg.useNumber)
+	h.armIdleTimer()
+	return p, nil
+}
+
+// acquire returns the running plugin process,
+// launching it first if the host was configured for lazy launch.
+func (h *Host) acquire(ctx context.Context) (*process, error) {
+	if reentrant(ctx) {
+		return nil, ErrReentrantCall // Would wait for itself.
+	}
+	// Wait for the plugin to start.
+	<-h.ready
+
+	h.lock.Lock()
+	p, closed, lazy, errStart := h.proc, h.closed, h.lazy, h.startErr
+	restarted := h.restarted
+	h.lock.Unlock()
+	switch {
+	case closed:
+		return nil, ErrClosed
+	case p != nil:
+		return p, nil
+	case restarted != nil:
+		select {
+		case <-restarted:
+			return h.acquire(ctx)
+		case <-ctx.Done():
+			return nil, causeErr(ctx)
+		}
+	case lazy == nil && errStart != nil:
+		return nil, fmt.Errorf("%w: %w: %w", ErrStartFailed, ErrClosed, errStart)
+	case lazy == nil:
+		return nil, ErrClosed
+	}
+
+	h.launchLock.Lock()
+	defer h.launchLock.Unlock()
+	h.lock.Lock()
+	p = h.proc
+	h.lock.Unlock()
+	if p != nil {
+		return p, nil // Launched by a concurrent call.
+	}
+	p, err := h.launch(ctx, lazy)
+	if err != nil {
+		return nil, err
+	}
+	p.lazy = true
+	go func() { _ = h.run(context.Background(), p) }()
+	return p, nil
+}
+
+// start launches the plugin with env added to its environment.
+func start(cfg *runConfig, env []string) (*process, error) {
+	cmd, kind, module, err := spawnPrebuilt(cfg)
+	if err != nil {
+		return nil, err
+	}
+	cmd = prefixCommand(cmd, cfg.launcherPrefix)
+	var goEnv []string
+	if kind != SpawnExecutable {
+		if goEnv, err = goBuildEnv(cfg); err != nil {
+			return nil, err
+		}
+	}
+	var stdin io.WriteCloser
+	var stdout io.ReadCloser
+	var ownedStdout io.Closer
+	var pty *os.File
+	closeChildEnds := func() {}
+	if cfg.pty {
+		var tty *os.File
+		if pty, tty, err = openPTY(); err != nil {
+			return nil, err
+		}
+		setControllingTTY(cmd)
+		stdin, stdout, closeChildEnds, err = protocolPipes(cmd, tty, tty)
+		if err != nil {
+			_, _ = pty.Close(), tty.Close()
+			return nil, err
+		}
+		closePipes := closeChildEnds
+		closeChildEnds = func() { closePipes(); _ = tty.Close() }
+		ownedStdout = stdout
+	} else if cfg.stdio {
+		stdin, stdout, closeChildEnds, err = protocolPipes(cmd, cfg.stdin, cfg.stdout)
+		if err != nil {
+			return nil, err
+		}
+		ownedStdout = stdout
+	} else {
+		if stdin, err = cmd.StdinPipe(); err != nil {
+			return nil, fmt.Errorf("getting stdin pipe: %w", err)
+		}
+		if stdout, err = cmd.StdoutPipe(); err != nil {
+			return nil, fmt.Errorf("getting stdout pipe: %w", err)
+		}
+	}
+	var fdConn *net.UnixConn
+	if cfg.fdPassing {
+		var child *os.File
+		if fdConn, child, err = fdSocketPair(); err != nil {
+			closeChildEnds()
+			_, _ = stdin.Close(), stdout.Close()
+			if pty != nil {
+				_ = pty.Close()
+			}
+			return nil, err
+		}
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		cmd.Env = append(cmd.Env,
+			fmt.Sprintf("%s=%d", envFDSocket, 3+len(cmd.ExtraFiles)))
+		cmd.ExtraFiles = append(cmd.ExtraFiles, child)
+		closePipes := closeChildEnds
+		closeChildEnds = func() { closePipes(); _ = child.Close() }
+	}
+	var buildLog *tailBuffer
+	stderr := &phaseWriter{w: cfg.buildStderr}
+	if kind == SpawnModule {
+		// Capture go toolchain errors, see moduleResolutionError.
+		buildLog = &tailBuffer{max: 4 << 10}
+		stderr.w = io.MultiWriter(buildLog, cfg.buildStderr)
+		cmd.Stderr = stderr
+	} else if cfg.buildStderr == cfg.stderr {
+		cmd.Stderr = cfg.stderr // Avoid the indirection if there are no phases.
+	} else {
+		cmd.Stderr = stderr
+	}
+	stderrTail := &tailBuffer{max: stderrTailSize}
+	cmd.Stderr = io.MultiWriter(stderrTail, cmd.Stderr)
+
+	if len(goEnv) > 0 || len(env) > 0 {
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		cmd.Env = append(append(cmd.Env, goEnv...), env...)
+	}
+	if cfg.processGroup {
+		setProcessGroup(cmd) // After setControllingTTY, which replaces SysProcAttr.
+	}
+	err = cmd.Start()
+	closeChildEnds()
+	if err != nil {
+		if ownedStdout != nil {
+			_, _ = stdin.Close(), stdout.Close()
+		}
+		if fdConn != nil {
+			_ = fdConn.Close()
+		}
+		if pty != nil {
+			_ = pty.Close()
+		}
+		return nil, err
+	}
+
+	var w io.Writer = stdin
+	var bufw *bufio.Writer
+	if cfg.flushDelay > 0 {
+		bufw = bufio.NewWriterSize(stdin, bufferSize(cfg.writeBufferSize))
+		w = bufw
+	}
+
+	return &process{
+		cmd:        cmd,
+		osProc:     cmd.Process,
+		wait:       waitOnce(cmd.Wait),
+		kind:       kind,
+		module:     module,
+		stderr:     stderr,
+		buildLog:   buildLog,
+		stderrTail: stderrTail,
+		dec:        newDecoder(stdout, cfg.ndjson, cfg.readBufferSize),
+		stdin:      stdin,
+		stdout:     ownedStdout,
+		output:     stdout,
+		done:       make(chan struct{}),
+		enc:        json.NewEncoder(w),
+		bufw:       bufw,
+		flushDelay: cfg.flushDelay,
+		pending:    map[string]*pendingCall{},
+
+		maxCancelBatch: cfg.cancelBatch,
+		readTimeout:    cfg.readTimeout,
+		compression:    cfg.compression.withMaxSize(cfg.maxDecompressedSize),
+		fdConn:         fdConn,
+		fdWriteTimeout: cfg.fdWriteTimeout,
+		pty:            pty,
+		group:          cfg.processGroup,
+	}, nil
+}
+
+// CallOption configures a single call.
+type CallOption func(*callConfig)
+
+type callConfig struct {
+	coalesce       bool
+	receiveBuffer  int
+	restartRetries int
+	noRemoteCancel bool
+	cancelReason   string
+	handle         *CallHandle            // set by CallH
+	onLog          func(msg string) error // set by CallWithLogs
+	shared         []byte                 // set by CallShared
+	fd             *uintptr               // set by SendFD
+	headers        map[string]string      // set by WithHeaders
+	group          *CallGroup             // set by WithCallGroup
+	decode         any                    // set by CallWithDecoder
+	onBinary       func([]byte) error     // set by CallBinaryStream
+	attempt        int                    // 1-based, set by invoke
+	cancelGrace    time.Duration          // set by WithCancelGrace
+	credits        int                    // set by WithFlowControl
+	lowWater       int                    // set by WithFlowControl
+	marshalTime    time.Duration          // set by callTyped
+	held           *CallStats             // reported after unmarshaling, see callRawTyped
+	timeout        time.Duration          // set by call, see WithCallTimeout
+	deadline       time.Time              // of timeout, shared by retries
+}
+
+func newCallConfig(opts []CallOption) *callConfig {
+	c := &callConfig{receiveBuffer: 1}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+// WithReceiveBuffer sets the number of response envelopes buffered for
+// the call before they're received by the caller. Defaults to 1.
+// Responses to all calls are read by a single loop which blocks when the
+// buffer is full until the caller receives, stalling all other calls.
+// This matters for streaming calls, where a larger buffer allows a slow
+// consumer to fall behind by n stream items without stalling other calls.
+// Negative values are ignored.
+func WithReceiveBuffer(n int) CallOption {
+	return func(c *callConfig) {
+		if n >= 0 {
+			c.receiveBuffer = n
+		}
+	}
+}
+
+// WithRestartRetry retries the call up to n times if the plugin stopped
+// responding before the call completed, which relaunches plugins
+// configured with Configure, or asked to retry after backing off
+// (see RetryAfter). All attempts share the deadline of the call's context,
+// so retries never extend the total latency of the call and aren't
+// attempted if the back off exceeds the deadline.
+// Only use it for idempotent methods, since the plugin may have processed
+// the request before it stopped responding.
+func WithRestartRetry(n int) CallOption {
+	return func(c *callConfig) { c.restartRetries = n }
+}
+
+// WithoutRemoteCancel makes the call not notify the plugin when it's
+// canceled. The call still returns immediately but the plugin keeps
+// processing the request and its response is discarded. Use it for plugins
+// mishandling cancellation only, since the plugin wastes work otherwise.
+func WithoutRemoteCancel() CallOption {
+	return func(c *callConfig) { c.noRemoteCancel = true }
+}
+
+// WithCancelReason sets the reason sent to the plugin if the call is
+// canceled, which the handler receives as CancelReason through
+// context.Cause of its context. Defaults to the cause of the call's
+// context (see context.WithCancelCause) or ErrCanceledByHost.
+// Plugins not supporting FeatureCancelReason receive no reason.
+func WithCancelReason(reason string) CallOption {
+	return func(c *callConfig) { c.cancelReason = reason }
+}
+
+// WithCancelGrace makes the call wait up to d for the response after
+// its context is canceled before canceling the request on the plugin,
+// which keeps near-complete work from being wasted. The response is
+// returned if it arrives in time, otherwise the call fails with the
+// context's error as without grace period. Defaults to zero, which
+// cancels the request immediately.
+func WithCancelGrace(d time.Duration) CallOption {
+	return func(c *callConfig) { c.cancelGrace = d }
+}
+
+// Call sends a typed request and waits for the typed response.
+// Returns ErrMalformedResponse if plugin returns a malformed JSON response.
+// Returns ErrClosed if the plugin is closed.
+func Call[Req any, Resp any](
+	ctx context.Context, h *Host, method string, req Req, opts ...CallOption,
+) (Resp, error) {
+	return callTyped[Req, Resp](ctx, h, method, req, newCallConfig(opts))
+}
+
+// CallWithDecoder is like Call but decodes the response data using
+// decode instead of json.Unmarshal, for example to validate the response,
+// apply defaults or decode polymorphic responses. Errors returned by
+// decode are wrapped by ErrMalformedResponse.
+func CallWithDecoder[Req any, Resp any](
+	ctx context.Context, h *Host, method string, req Req,
+	decode func(data json.RawMessage) (Resp, error), opts ...CallOption,
+) (Resp, error) {
+	c := newCallConfig(opts)
+	c.decode = decode
+	return callTyped[Req, Resp](ctx, h, method, req, c)
+}
+
+// CallRawReq is like Call but sends raw as the request as is instead of
+// marshaling a typed request, which avoids decoding and re-encoding
+// requests relayed from elsewhere. raw must be valid JSON.
+func CallRawReq[Resp any](
+	ctx context.Context, h *Host, method string, raw json.RawMessage,
+	opts ...CallOption,
+) (Resp, error) {
+	if !json.Valid(raw) {
+		var zero Resp
+		return zero, errors.New("marshaling request: invalid JSON")
+	}
+	c := newCallConfig(opts)
+	if c.coalesce {
+		// Shared calls may outlive this call and raw is owned by the caller.
+		raw = bytes.Clone(raw)
+	}
+	return callRawTyped[Resp](ctx, h, method, raw, c)
+}
+
+// CallArgs is like Call but sends args as a JSON array of positional
+// arguments, which saves defining a request type for dynamically invoked
+// methods, for example CallArgs[int](ctx, h, "add", 1, 2).
+// Each argument is marshaled like a request, so it must be marshalable by
+// encoding/json or have a marshaler registered with RegisterMarshaler:
+// functions, channels and complex numbers fail the call with an error
+// naming the argument, and so do call options mistakenly passed as
+// arguments, use CallArgsWith to pass options. A nil argument is sent as
+// null. The handler receives the arguments as a slice, typically
+// []json.RawMessage to decode each argument into its own type, or as
+// a fixed-size array. Arguments decoded into any lose their Go type,
+// numbers become float64 for example. No arguments are sent as
+// an empty array.
+func CallArgs[Resp any](
+	ctx context.Context, h *Host, method string, args ...any,
+) (Resp, error) {
+	return CallArgsWith[Resp](ctx, h, method, nil, args...)
+}
+
+// CallArgsWith is like CallArgs but applies opts to the call.
+func CallArgsWith[Resp any](
+	ctx context.Context, h *Host, method string, opts []CallOption,
+	args ...any,
+) (Resp, error) {
+	raw := make([]json.RawMessage, len(args))
+	for i, arg := range args {
+		var err error
+		if raw[i], err = marshal(arg); err != nil {
+			var zero Resp
+			return zero, fmt.Errorf("marshaling argument %d: %w", i, err)
+		}
+	}
+	req, err := json.Marshal(raw)
+	if err != nil {
+		var zero Resp
+		return zero, fmt.Errorf("marshaling request: %w", err)
+	}
+	return callRawTyped[Resp](ctx, h, method, req, newCallConfig(opts))
+}
+
+// CallHandle identifies the plugin call made by CallH.
+type CallHandle struct {
+	id        string
+	cached    bool
+	attempts  int
+	retryErrs []error
+}
+
+// ID returns the request ID of the call, which is what RequestMeta.ID
+// is set to on the plugin side. Coalesced calls share the ID of the
+// shared call. Empty if the response was cached or the call failed
+// before the request was sent.
+func (c CallHandle) ID() string { return c.id }
+
+// Cached reports whether the response was served from the cache.
+func (c CallHandle) Cached() bool { return c.cached }
+
+// Attempts returns the number of requests sent for the call, which is
+// more than 1 if it was retried (see WithRestartRetry). Zero if the
+// response was cached.
+func (c CallHandle) Attempts() int { return c.attempts }
+
+// RetryErrors returns the errors of the attempts that were retried
+// in the order they occurred. The error of the last attempt is the one
+// returned by the call.
+func (c CallHandle) RetryErrors() []error { return c.retryErrs }
+
+// CallH is like Call but also returns the handle of the call,
+// which allows correlating host logs with the request on the plugin side
+// and tells whether the call was retried.
+func CallH[Req any, Resp any](
+	ctx context.Context, h *Host, method string, req Req, opts ...CallOption,
+) (Resp, CallHandle, error) {
+	var handle CallHandle
+	c := newCallConfig(opts)
+	c.handle = &handle
+	resp, err := callTyped[Req, Resp](ctx, h, method, req, c)
+	return resp, handle, err
+}
+
+func callTyped[Req any, Resp any](
+	ctx context.Context, h *Host, method string, req Req, c *callConfig,
+) (Resp, error) {
+	var zero Resp
+	var raw json.RawMessage
+	var err error
+	start := time.Now()
+	if c.coalesce {
+		// Shared calls may outlive this call, so raw can't be reused.
+		raw, err = marshal(req)
+	} else {
+		var buf *pooledEncoder
+		raw, buf, err = marshalPooled(req)
+		defer buf.release()
+	}
+	if err != nil {
+		return zero, fmt.Errorf("marshaling request: %w", err)
+	}
+	c.marshalTime = time.Since(start)
+	if h.strictMarshal.Load() {
+		if err := checkRoundTrip(req, raw); err != nil {
+			return zero, err
+		}
+	}
+	return callRawTyped[Resp](ctx, h, method, raw, c)
+}
+
+// callRawTyped calls the plugin and unmarshals the response.
+func callRawTyped[Resp any](
+	ctx context.Context, h *Host, method string, raw json.RawMessage,
+	c *callConfig,
+) (Resp, error) {
+	var zero Resp
+	decode, _ := c.decode.(func(json.RawMessage) (Resp, error))
+	var held CallStats
+	if h.serialTiming.Load() && !c.coalesce {
+		c.held = &held // Coalesced calls are unmarshaled by every caller.
+	}
+	resp, err := h.invoke(ctx, method, raw, c)
+	if err != nil {
+		return zero, err
+	}
+	if held.ID != "" {
+		start := time.Now()
+		defer func() {
+			held.UnmarshalTime = time.Since(start)
+			h.callEnded(held)
+		}()
+	}
+	if decode != nil {
+		v, err := decode(resp.Data)
+		if err != nil {
+			return zero, fmt.Errorf("%w: %w", ErrMalformedResponse, err)
+		}
+		return v, nil
+	}
+	if err := unmarshal(resp.Data, &zero, h.useNumber.Load()); err != nil {
+		return zero, fmt.Errorf("%w: %w", ErrMalformedResponse, err)
+	}
+	return zero, nil
+}
+
+// invoke returns the response to the request
+// either from the cache or by calling the plugin.
+func (h *Host) invoke(
+	ctx context.Context, method string, raw json.RawMessage, c *callConfig,
+) (resp envelope, err error) {
+	// Responses may depend on headers, which aren't part of the key.
+	cacheable := len(c.headers) == 0
+	if cacheable {
+		if resp, ok := h.cache.get(method, raw); ok {
+			if c.handle != nil {
+				c.handle.cached = true
+			}
+			return resp, nil
+		}
+	}
+	for attempt := 1; ; attempt++ {
+		c.attempt = attempt
+		if c.handle != nil {
+			c.handle.attempts = attempt
+		}
+		if c.coalesce && cacheable {
+			resp, err = h.coalescer.call(ctx, h, method, raw, c)
+		} else {
+			resp, err = h.call(ctx, method, raw, c, nil)
+		}
+		if attempt > c.restartRetries || !awaitRetry(ctx, err) {
+			break
+		}
+		if c.handle != nil {
+			c.handle.retryErrs = append(c.handle.retryErrs, err)
+		}
+		if ctx.Err() != nil {
+			// No time left for another attempt.
+			return envelope{}, causeErr(ctx)
+		}
+	}
+	if err == nil && cacheable {
+		h.cache.put(method, raw, resp)
+	}
+	return resp, err
+}
+
+// call sends the request and waits for the final response.
+// onChunk is invoked for every stream item received before the final
+// response, the call is canceled if it returns an error.
+// Stream items are ignored if onChunk is nil.
+func (h *Host) call(
+	ctx context.Context, method string, raw json.RawMessage, c *callConfig,
+	onChunk func(json.RawMessage) error,
+) (resp envelope, err error) {
+	if method == "" {
+		return envelope{}, ErrEmptyMethod
+	}
+	// Counted before acquiring the plugin, which keeps the idle timeout
+	// from closing it until the call is registered (see closeIdle).
+	h.callStarted()
+	defer h.callFinished()
+
+	if _, ok := ctx.Deadline(); !ok && onChunk == nil && c.timeout == 0 {
+		c.timeout = h.callTimeout // Not applied to launching the plugin.
+	}
+	p, err := h.acquire(ctx)
+	if err != nil {
+		return envelope{}, err
+	}
+	if c.timeout > 0 {
+		if c.deadline.IsZero() {
+			c.deadline = time.Now().Add(c.timeout)
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+	var file string
+	if c.shared != nil {
+		var cleanup func()
+		if raw, file, cleanup, err = sharedRequest(p, c.shared); err != nil {
+			return envelope{}, err
+		}
+		defer cleanup()
+	}
+
+	id := fmt.Sprintf("%x", h.idCounter.Add(1))
+	pc := &pendingCall{
+		ch:       make(chan envelope, c.receiveBuffer),
+		done:     make(chan struct{}),
+		canceled: make(chan struct{}),
+		info:     CallInfo{ID: id, Method: method, Started: time.Now()},
+	}
+	p.queued.Add(1)
+	p.lock.Lock()
+	p.queued.Add(-1)
+	if p.closed {
+		p.lock.Unlock()
+		return envelope{}, ErrClosed
+	}
+	if c.group != nil && !c.group.add(pc, p, c) {
+		p.lock.Unlock()
+		return envelope{}, ErrCanceledByHost
+	}
+	if len(p.pending) == 0 {
+		p.lastRead = time.Now() // Don't count the time the plugin was idle.
+	}
+	p.pending[id] = pc
+	if c.handle != nil {
+		c.handle.id = id
+	}
+	if c.fd != nil {
+		// Passed once the call is registered on a live process
+		// but before the request, which makes the plugin await it.
+		p.lock.Unlock()
+		err := p.sendFD(id, *c.fd)
+		p.lock.Lock()
+		if err == nil && p.closed {
+			err = ErrClosed
+		}
+		if err != nil {
+			delete(p.pending, id)
+			p.lock.Unlock()
+			if c.group != nil {
+				c.group.remove(pc)
+			}
+			return envelope{}, err
+		}
+	}
+	req := envelope{ID: id, Method: method, Data: raw, File: file, FD: c.fd != nil}
+	if d, ok := ctx.Deadline(); ok && p.features.has(FeatureDeadline) {
+		req.Deadline = d
+	}
+	req.Logs = c.onLog != nil && p.features.has(FeatureCallLog)
+	flow := c.credits > 0 && p.features.has(FeatureFlowControl)
+	if flow {
+		req.Credits = c.credits
+	}
+	if p.features.has(FeatureHeaders) {
+		req.Headers = c.headers
+	}
+	measure := h.serialTiming.Load()
+	encodeStart := time.Now()
+	err = p.send(req)
+	if err == nil && p.queued.Load() == 0 {
+		// Flush before awaiting the response unless
+		// another call is about to send a request.
+		err = p.flushLocked()
+	}
+	sent := time.Now()
+	p.lock.Unlock()
+	defer func() {
+		p.lock.Lock()
+		delete(p.pending, id)
+		p.lock.Unlock()
+		if c.group != nil {
+			c.group.remove(pc)
+		}
+		close(pc.done)
+		pc.abandon(&h.buffered)
+	}()
+	if err != nil {
+		return envelope{}, err
+	}
+	reqBytes, chunkBytes := len(raw), 0
+	if file != "" {
+		reqBytes = len(c.shared)
+	}
+	var timed *timing        // Reported with the final response.
+	outstanding := c.credits // Stream items the plugin may still send.
+	defer func() {
+		s := CallStats{
+			ID: id, Method: method, Duration: time.Since(pc.info.Started),
+			RequestBytes: reqBytes, ResponseBytes: chunkBytes + len(resp.Data),
+			Attempt: max(c.attempt, 1), Err: err,
+		}
+		if timed != nil {
+			s.QueueWait = time.Duration(timed.Queue) * time.Microsecond
+			s.ExecTime = time.Duration(timed.Exec) * time.Microsecond
+		}
+		if measure {
+			s.MarshalTime = c.marshalTime + sent.Sub(encodeStart)
+			s.WaitTime = time.Since(sent)
+		}
+		if c.held != nil && err == nil {
+			*c.held = s // Reported once the response was unmarshaled.
+			return
+		}
+		h.callEnded(s)
+	}()
+	cancel := func(reason string) error {
+		if c.noRemoteCancel || pc.remoteCanceled.Load() {
+			return nil
+		}
+		if c.cancelReason != "" {
+			reason = c.cancelReason
+		}
+		return p.cancel(id, reason)
+	}
+
+	done := ctx.Done()
+	var grace <-chan time.Time // Set once ctx is done, see WithCancelGrace.
+	for {
+		select {
+		case ev, ok := <-pc.ch:
+			if !ok {
+				return envelope{}, p.closedErr()
+			}
+			h.buffered.release(ev.bufferedSize())
+			if err := p.compression.decompress(&ev); err != nil {
+				if errCancel := cancel(err.Error()); errCancel != nil {
+					return envelope{}, errCancel
+				}
+				return envelope{}, err
+			}
+			if ev.Log != nil { // Messages may be empty.
+				if c.onLog == nil {
+					continue
+				}
+				if err := c.onLog(*ev.Log); err != nil {
+					if errCancel := cancel(err.Error()); errCancel != nil {
+						return envelope{}, errCancel
+					}
+					return envelope{}, err
+				}
+				continue
+			}
+			if ev.Chunk {
+				chunkBytes += len(ev.Data) + len(ev.bin)
+				var err error
+				switch {
+				case ev.bin != nil && c.onBinary != nil:
+					err = c.onBinary(ev.bin)
+				case ev.bin == nil && onChunk != nil:
+					err = onChunk(ev.Data)
+				}
+				if err != nil {
+					if errCancel := cancel(err.Error()); errCancel != nil {
+						return envelope{}, errCancel
+					}
+					return envelope{}, err
+				}
+				if outstanding--; flow && outstanding <= c.lowWater {
+					// The caller processed the item, grant more.
+					if err := p.grantCredits(id, c.credits-outstanding); err != nil {
+						return envelope{}, err
+					}
+					outstanding = c.credits
+				}
+				continue
+			}
+			timed = ev.Timing
+			if ev.Error != "" {
+				return envelope{}, responseError(ev)
+			}
+			return ev, nil
+		case <-done:
+			if c.cancelGrace > 0 {
+				t := time.NewTimer(c.cancelGrace)
+				defer t.Stop()
+				done, grace = nil, t.C
+				continue
+			}
+			if err := cancel(cancelReason(ctx)); err != nil {
+				return envelope{}, err
+			}
+			return envelope{}, causeErr(ctx)
+		case <-grace:
+			if err := cancel(cancelReason(ctx)); err != nil {
+				return envelope{}, err
+			}
+			return envelope{}, causeErr(ctx)
+		case <-pc.canceled:
+			if err := cancel(ErrCanceledByHost.Error()); err != nil {
+				return envelope{}, err
+			}
+			return envelope{}, ErrCanceledByHost
+		}
+	}
+}
+
+// CallInfo describes a call awaiting its response.
+type CallInfo struct {
+	ID      string // Request ID, unique per call.
+	Method  string
+	Started time.Time
+}
+
+// Calls returns the calls awaiting their response ordered by ID.
+// Coalesced callers share a single call.
+func (h *Host) Calls() []CallInfo {
+	h.lock.Lock()
+	p := h.proc
+	h.lock.Unlock()
+	if p == nil {
+		return nil
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	calls := make([]CallInfo, 0, len(p.pending))
+	for _, pc := range p.pending {
+		calls = append(calls, pc.info)
+	}
+	slices.SortFunc(calls, func(a, b CallInfo) int {
+		return cmp.Or(
+			cmp.Compare(len(a.ID), len(b.ID)), // IDs are hexadecimal numbers.
+			strings.Compare(a.ID, b.ID),
+		)
+	})
+	return calls
+}
+
+// CancelCall cancels the call with the given ID (see Calls) as if its
+// context was canceled, except that Call returns ErrCanceledByHost.
+// Returns false if no such call is awaiting its response.
+func (h *Host) CancelCall(id string) bool {
+	h.lock.Lock()
+	p := h.proc
+	h.lock.Unlock()
+	if p == nil {
+		return false
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	pc, ok := p.pending[id]
+	if !ok {
+		return false
+	}
+	select {
+	case <-pc.canceled: // Already canceled.
+	default:
+		close(pc.canceled)
+	}
+	return true
+}
+
+// Close closes stdin (signals EOF) and waits for plugin exit.
+// A closed host can't be used anymore, even if it was configured
+// for lazy launch. See RunPlugin for the shutdown sequence.
+// If already closed, Close only waits for the plugin to exit.
+func (h *Host) Close() error { return <-h.CloseAsync() }
+
+// CloseAsync is like Close but doesn't wait for the plugin to exit.
+// The host and the plugin's stdin are closed once CloseAsync returns.
+// The returned channel receives the result of waiting for the plugin
+// to exit and is closed afterwards, it doesn't need to be read.
+func (h *Host) CloseAsync() <-chan error {
+	h.lock.Lock()
+	p, stopped := h.proc, h.stopped
+	h.proc, h.closed = nil, true
+	if h.idleTimer != nil {
+		h.idleTimer.Stop()
+	}
+	if h.stopRestart != nil {
+		h.stopRestart(ErrClosed)
+	}
+	if p != nil {
+		stopped = make(chan struct{})
+		h.stopped = stopped
+	}
+	h.lock.Unlock()
+	c := make(chan error, 1)
+	if p == nil {
+		go func() {
+			if stopped != nil {
+				<-stopped // Closed before, wait for the plugin to exit.
+			}
+			c <- nil
+			close(c)
+		}()
+		return c
+	}
+	p.closeStdin()
+	go func() {
+		err := p.awaitExit()
+		close(stopped)
+		c <- err
+		close(c)
+	}()
+	return c
+}
+
+// awaitStopped blocks until the plugin closed by Close exited.
+func (h *Host) awaitStopped() {
+	h.lock.Lock()
+	stopped := h.stopped
+	h.lock.Unlock()
+	if stopped != nil {
+		<-stopped
+	}
+}
+
+// Features returns the protocol features negotiated with the plugin
+// in the handshake, which are the FeatureX constants both sides support.
+// Returns nil if the plugin isn't running.
+func (h *Host) Features() []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.proc == nil {
+		return nil
+	}
+	return h.proc.features.list()
+}
+
+// NegotiatedVersion returns the protocol version spoken with the plugin,
+// which is the older one of ProtocolVersion and the plugin's version.
+// Returns "" if the plugin isn't running.
+func (h *Host) NegotiatedVersion() string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.proc == nil {
+		return ""
+	}
+	return h.proc.version
+}
+
+// DebugStats is a snapshot of the host's internal bookkeeping.
+// All counters return to zero once all calls completed or were canceled,
+// which tests can use to detect leaks.
+type DebugStats struct {
+	ActiveCalls    int // Calls in progress, including shared coalesced calls.
+	PendingCalls   int // Requests sent to the plugin awaiting a response.
+	CoalescedCalls int // Shared calls of WithCoalescing callers.
+	CoalescedWaits int // WithCoalescing callers waiting for shared calls.
+}
+
+// DebugStats returns a snapshot of the host's internal bookkeeping.
+func (h *Host) DebugStats() DebugStats {
+	h.lock.Lock()
+	s := DebugStats{ActiveCalls: h.inflight}
+	p := h.proc
+	h.lock.Unlock()
+	if p != nil {
+		p.lock.Lock()
+		s.PendingCalls = len(p.pending)
+		p.lock.Unlock()
+	}
+	h.coalescer.lock.Lock()
+	s.CoalescedCalls = len(h.coalescer.flights)
+	for _, f := range h.coalescer.flights {
+		s.CoalescedWaits += f.waiters
+	}
+	h.coalescer.lock.Unlock()
+	return s
+}
+
+// Flush writes requests buffered due to WithWriteBuffer to the plugin.
+// No-op if the plugin isn't running or writes aren't buffered.
+func (h *Host) Flush() error {
+	h.lock.Lock()
+	p := h.proc
+	h.lock.Unlock()
+	if p == nil {
+		return nil
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.flushLocked()
+}
+
+// SetIdleTimeout makes the host close the plugin once it hasn't received
+// any calls for d. Calls in progress keep the plugin alive.
+// Zero (default) disables the idle timeout.
+func (h *Host) SetIdleTimeout(d time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.idleTimeout = d
+	if h.idleTimer != nil {
+		h.idleTimer.Stop()
+		h.idleTimer = nil
+	}
+	if h.proc != nil {
+		h.armIdleTimer()
+	}
+}
+
+// armIdleTimer (re)starts the idle timer unless calls are in progress.
+// h.lock must be held.
+func (h *Host) armIdleTimer() {
+	if h.idleTimeout <= 0 || h.inflight > 0 {
+		return
+	}
+	if h.idleTimer != nil {
+		h.idleTimer.Reset(h.idleTimeout)
+		return
+	}
+	h.idleTimer = time.AfterFunc(h.idleTimeout, h.closeIdle)
+}
+
+func (h *Host) callStarted() {
+	h.lock.Lock()
+	h.inflight++
+	if h.idleTimer != nil {
+		h.idleTimer.Stop()
+	}
+	h.lock.Unlock()
+}
+
+func (h *Host) callFinished() {
+	h.lock.Lock()
+	h.inflight--
+	if h.proc != nil {
+		h.armIdleTimer()
+	}
+	h.lock.Unlock()
+}
+
+// closeIdle is invoked by the idle timer. Unlike Close it only shuts down
+// the current plugin process, a lazily launched plugin is relaunched
+// on the next call.
+func (h *Host) closeIdle() {
+	h.lock.Lock()
+	p := h.proc
+	if h.inflight > 0 || p == nil {
+		// A call started right before the timer fired.
+		h.lock.Unlock()
+		return
+	}
+	h.proc = nil
+	h.lock.Unlock()
+	_ = p.close()
 }
 
-type Host struct {
-	idCounter atomic.Uint64
-	running   atomic.Bool
-	wgRun     sync.WaitGroup
-	enc       *json.Encoder
-	dec       *json.Decoder
-	cmd       *exec.Cmd
-	closer    io.Closer     // plugin stdin
-	done      chan struct{} // closed when run() returns
-	lock      sync.Mutex    // protects pending and enc
-	pending   map[string]chan envelope
-}
-
-// NewHost creates an empty host. Call RunPlugin afterwards.
-func NewHost() *Host {
-	h := &Host{
-		pending: map[string]chan envelope{},
-		done:    make(chan struct{}),
-	}
-	h.wgRun.Add(1)
-	return h
+func (h *Host) run(ctx context.Context, p *process) (err error) {
+	defer close(p.done)
+	defer h.recordStopErr(p)
+	defer p.closePending()
+	defer h.detachLazy(p) // Before failing pending calls, which may retry.
+	defer func() { h.detachExited(ctx, p, err) }()
+	ctxCallbacks, cancelCallbacks := context.WithCancel(ctx)
+	defer cancelCallbacks()
+	p.startReadTimer()
+	for {
+		var ev envelope
+		if err := p.dec.Decode(&ev); err != nil {
+			p.exited(err)
+			// Free the slot once the process exited, a plugin that exited
+			// on its own may not be closed before the host is, and one
+			// that wrote a malformed frame may still be running.
+			go func() {
+				_ = p.wait()
+				p.release()
+			}()
+			if errStop := p.closedErr(); errStop != ErrClosed {
+				return errStop
+			}
+			return err
+		}
+		if ev.Method == methodCrash {
+			p.crashed(ev) // The plugin exits right after.
+			continue
+		}
+		p.lock.Lock()
+		p.lastRead = time.Now()
+		if ev.Callback {
+			p.lock.Unlock()
+			if ev.Method != "" {
+				go h.serveCallback(ctxCallbacks, p, ev)
+			}
+			continue
+		}
+		pc := p.pending[ev.ID]
+		if ev.ID != "" && ev.ID == p.handoffID {
+			// Stop reading, the remaining responses go to the adopting host.
+			p.stopErr, p.leftover = ErrHandedOff, p.dec.buffered()
+			p.lock.Unlock()
+			return ErrHandedOff
+		}
+		p.lock.Unlock()
+		if pc != nil {
+			// Responses are dropped once ctx is canceled, keep reading
+			// until the plugin exits so it doesn't block writing.
+			_ = pc.deliver(ctx, &h.buffered, ev)
+		}
+	}
 }
 
-var (
-	ErrInvalidPluginPath   = errors.New("invalid plugin path")
-	ErrAlreadyRunning      = errors.New("plugin already running")
-	ErrGoToolchainNotFound = errors.New("go toolchain not in PATH")
-	ErrClosed              = errors.New("closed")
-	ErrMalformedResponse   = errors.New("malformed response")
-)
+// recordStopErr makes the error p stopped with available to Host.Err.
+func (h *Host) recordStopErr(p *process) {
+	p.lock.Lock()
+	err := p.stopErr
+	p.lock.Unlock()
+	if err != nil {
+		h.lock.Lock()
+		h.err = err
+		h.lock.Unlock()
+	}
+}
 
-// ErrorResponse is a copy of the "err" field in the plugin response JSON.
-type ErrorResponse string
+// detachLazy makes the next call relaunch the lazily launched plugin
+// once it stopped responding.
+func (h *Host) detachLazy(p *process) {
+	if !p.lazy {
+		return
+	}
+	h.lock.Lock()
+	current := h.proc == p
+	if current {
+		h.proc = nil
+	}
+	h.lock.Unlock()
+	if current {
+		go func() { _ = p.close() }() // Reap the process.
+	}
+}
 
-func (e ErrorResponse) Error() string { return string(e) }
+// phaseWriter forwards plugin stderr to the writer of the current phase.
+type phaseWriter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
 
-// RunPlugin executes a plugin executable or Go file/package/module.
-func (h *Host) RunPlugin(
-	ctx context.Context, plugin string, pluginStderr io.WriteCloser,
-) error {
-	if h.running.Load() {
-		return ErrAlreadyRunning
+func (w *phaseWriter) Write(b []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.w.Write(b)
+}
+
+func (w *phaseWriter) set(writer io.Writer) {
+	w.lock.Lock()
+	w.w = writer
+	w.lock.Unlock()
+}
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	lock sync.Mutex
+	max  int
+	b    []byte
+}
+
+func (t *tailBuffer) Write(b []byte) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.b = append(t.b, b...)
+	if len(t.b) > t.max {
+		t.b = t.b[len(t.b)-t.max:]
 	}
-	unblock := sync.OnceFunc(h.wgRun.Done)
-	defer unblock()
-	defer close(h.done)
-	cmd, err := spawn(plugin)
-	if err != nil {
-		return err
+	return len(b), nil
+}
+
+func (t *tailBuffer) String() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return string(t.b)
+}
+
+// causeErr returns the cause of ctx's cancelation.
+// The cause is wrapped with ctx.Err() unless it already wraps it
+// to keep errors.Is(err, context.Canceled) working.
+func causeErr(ctx context.Context) error {
+	err, cause := ctx.Err(), context.Cause(ctx)
+	if cause == nil || errors.Is(cause, err) {
+		return cause
 	}
-	stdin, err := cmd.StdinPipe()
-	if err != nil {
-		return fmt.Errorf("getting stdin pipe: %w", err)
+	return fmt.Errorf("%w: %w", err, cause)
+}
+
+// cancelReason returns the reason for canceling a call sent to the
+// plugin, which is the cause of ctx unless it was canceled without one.
+func cancelReason(ctx context.Context) string {
+	cause := context.Cause(ctx)
+	if cause == nil || cause == context.Canceled {
+		return ""
 	}
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return fmt.Errorf("getting stdout pipe: %w", err)
+	return cause.Error()
+}
+
+// cancel asks the plugin to abort the request.
+// Cancels with a reason are never batched.
+func (p *process) cancel(id, reason string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.features.has(FeatureCancelReason) {
+		reason = ""
 	}
-	if pluginStderr != nil {
-		cmd.Stderr = pluginStderr
-		defer func() {
-			_ = pluginStderr.Close() // Signal no more logs.
+	if reason != "" || p.maxCancelBatch < 2 ||
+		!p.features.has(FeatureCancelBatch) {
+		return p.send(envelope{Cancel: id, Reason: reason})
+	}
+	p.cancels = append(p.cancels, id)
+	if len(p.cancels) >= p.maxCancelBatch {
+		return p.sendCancelsLocked()
+	}
+	if len(p.cancels) == 1 {
+		// Cancels queued until the goroutine acquires the lock
+		// share a single envelope.
+		go func() {
+			p.lock.Lock()
+			defer p.lock.Unlock()
+			_ = p.sendCancelsLocked() // Failed writes surface as EOF in run().
 		}()
-	} else {
-		cmd.Stderr = os.Stderr
 	}
+	return nil
+}
+
+// sendCancelsLocked sends all queued cancels in a single envelope.
+// p.lock must be held.
+func (p *process) sendCancelsLocked() error {
+	if len(p.cancels) == 0 {
+		return nil
+	}
+	ev := envelope{Cancels: p.cancels}
+	p.cancels = nil
+	return p.send(ev)
+}
 
-	if err := cmd.Start(); err != nil {
+// send writes ev to the plugin scheduling a flush if writes are buffered.
+// p.lock must be held.
+func (p *process) send(ev envelope) error {
+	if err := p.enc.Encode(ev); err != nil {
 		return err
 	}
+	if p.bufw == nil || p.flushPending {
+		return nil
+	}
+	p.flushPending = true
+	if p.flushTimer == nil {
+		p.flushTimer = time.AfterFunc(p.flushDelay, func() {
+			p.lock.Lock()
+			defer p.lock.Unlock()
+			_ = p.flushLocked() // Failed writes surface as EOF in run().
+		})
+	} else {
+		p.flushTimer.Reset(p.flushDelay)
+	}
+	return nil
+}
 
-	h.enc = json.NewEncoder(stdin)
-	h.dec = json.NewDecoder(bufio.NewReader(stdout))
-	h.cmd = cmd
-	h.closer = stdin
-	h.running.Store(true)
-	unblock() // Signal Call waiters that the plugin is ready.
-	return h.run(ctx)
+// flushLocked writes buffered requests to the plugin.
+// p.lock must be held.
+func (p *process) flushLocked() error {
+	if p.bufw == nil {
+		return nil
+	}
+	p.flushPending = false
+	return p.bufw.Flush()
 }
 
-// Call sends a typed request and waits for the typed response.
-// Returns ErrMalformedResponse if plugin returns a malformed JSON response.
-// Returns ErrClosed if the plugin is closed.
-func Call[Req any, Resp any](
-	ctx context.Context, h *Host, method string, req Req,
-) (Resp, error) {
-	// Wait for the plugin to start.
-	h.wgRun.Wait()
+// close closes stdin (signals EOF) and waits for the process to exit.
+func (p *process) close() error {
+	p.closeStdin()
+	return p.awaitExit()
+}
 
-	var zero Resp
-	if !h.running.Load() {
-		return zero, ErrClosed
+// closeStdin writes the requests still buffered and closes stdin,
+// which signals EOF to the plugin.
+func (p *process) closeStdin() {
+	p.lock.Lock()
+	p.closing = true
+	_ = p.sendCancelsLocked()
+	_ = p.flushLocked()
+	if p.flushTimer != nil {
+		p.flushTimer.Stop()
 	}
+	p.lock.Unlock()
+	_ = p.stdin.Close()
+}
 
-	id := fmt.Sprintf("%x", h.idCounter.Add(1))
-	raw, err := json.Marshal(req)
-	if err != nil {
-		return zero, fmt.Errorf("marshaling request: %w", err)
-	}
+// awaitExit waits for the process closed by closeStdin to exit.
+func (p *process) awaitExit() error {
+	<-p.done // Wait for run() to finish reading stdout.
+	err := p.wait()
+	p.closeFiles()
+	p.release()
+	return err
+}
 
-	wait := make(chan envelope, 1)
-	h.lock.Lock()
-	h.pending[id] = wait
-	err = h.enc.Encode(envelope{ID: id, Method: method, Data: raw})
-	h.lock.Unlock()
-	if err != nil {
-		return zero, err
-	}
+// kill terminates a process that run() was never started for.
+func (p *process) kill() {
+	_ = p.stdin.Close()
+	p.killProcess()
+	_ = p.wait()
+	p.closeFiles()
+	p.release()
+}
 
-	select {
-	case ev, ok := <-wait:
-		h.lock.Lock()
-		delete(h.pending, id)
-		h.lock.Unlock()
-		if !ok {
-			return zero, ErrClosed
-		}
-		if ev.Error != "" {
-			return zero, ErrorResponse(ev.Error)
-		}
-		if err := json.Unmarshal(ev.Data, &zero); err != nil {
-			return zero, fmt.Errorf("%w: %w", ErrMalformedResponse, err)
-		}
-		return zero, nil
-	case <-ctx.Done():
-		h.lock.Lock()
-		delete(h.pending, id)
-		err := h.enc.Encode(envelope{Cancel: id})
-		h.lock.Unlock()
-		if err != nil {
-			return zero, err
-		}
-		return zero, ctx.Err()
+// closeFiles closes the files owned by the host,
+// which includes stdout unless cmd closes it.
+func (p *process) closeFiles() {
+	if p.stdout != nil {
+		_ = p.stdout.Close()
+	}
+	if p.fdConn != nil {
+		_ = p.fdConn.Close()
+	}
+	if p.pty != nil {
+		_ = p.pty.Close()
 	}
 }
 
-// Close closes stdin (signals EOF) and waits for plugin exit.
-// No-op if already closed.
-func (h *Host) Close() error {
-	wasRunning := h.running.Swap(false)
-	if !wasRunning {
-		return nil
+func (p *process) closePending() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.closed = true
+	if p.readTimer != nil {
+		p.readTimer.Stop()
 	}
-	if h.closer != nil {
-		_ = h.closer.Close()
+	for _, pc := range p.pending {
+		close(pc.ch)
 	}
-	<-h.done // Wait for run() to finish reading stdout.
-	if h.cmd != nil {
-		return h.cmd.Wait()
+}
+
+// closedErr returns the error pending calls fail with
+// once the plugin stopped responding.
+func (p *process) closedErr() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.stopErr != nil {
+		return p.stopErr
 	}
-	return nil
+	return ErrClosed
 }
 
-func (h *Host) run(ctx context.Context) error {
-	defer h.closePending()
-	for {
-		var ev envelope
-		if err := h.dec.Decode(&ev); err != nil {
-			return err
+// startReadTimer starts checking whether responses to pending calls
+// arrive within the read timeout. No-op if there is no read timeout.
+func (p *process) startReadTimer() {
+	if p.readTimeout <= 0 {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.readTimer = time.AfterFunc(p.readTimeout, func() {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		if p.closed {
+			return
 		}
-		h.lock.Lock()
-		ch := h.pending[ev.ID]
-		h.lock.Unlock()
-		if ch != nil {
-			select {
-			case ch <- ev:
-			case <-ctx.Done():
-				return ctx.Err()
+		next := p.readTimeout
+		if len(p.pending) > 0 {
+			idle := time.Since(p.lastRead)
+			if idle >= p.readTimeout {
+				p.timedOut(ErrReadTimeout)
+				return
 			}
+			next -= idle
 		}
-	}
+		p.readTimer.Reset(next)
+	})
 }
 
-func (h *Host) closePending() {
-	h.lock.Lock()
-	defer h.lock.Unlock()
-	for _, ch := range h.pending {
-		close(ch)
+// timedOut kills the plugin that stopped responding or receiving,
+// err is ErrReadTimeout or ErrWriteTimeout. p.lock must be held.
+func (p *process) timedOut(err error) {
+	if p.closed {
+		return
 	}
+	p.stopErr = err
+	_ = p.output.Close() // Unblock run.
+	p.killProcess()
+}
+
+// endpoint handles a request.
+// Streaming endpoints send stream items through emit.
+type endpoint func(
+	ctx context.Context, meta RequestMeta, data json.RawMessage,
+	emit func(any) error,
+) (any, error)
+
+// RequestMeta describes a request received by the plugin.
+// Headers carry the metadata of the caller. The codec isn't included
+// since request data is always JSON, only responses may be compressed
+// (see FeatureCompression).
+type RequestMeta struct {
+	ID       string    // Unique per request.
+	Method   string    // Name of the endpoint.
+	Deadline time.Time // Deadline of the caller, zero if there is none.
+
+	// Headers are set by the caller using WithHeaders, nil if there are none.
+	Headers map[string]string
+
+	file string // Path of the shared request data, see HandleShared.
+	fd   bool   // A file descriptor was passed, see HandleFD.
 }
 
 type Plugin struct {
-	enc          *json.Encoder
-	dec          *json.Decoder
-	endpoints    map[string]func(context.Context, json.RawMessage) (any, error)
-	running      atomic.Bool
-	wgDispatcher sync.WaitGroup
-	lockEnc      sync.Mutex                    // protects enc
-	lockCancel   sync.Mutex                    // protects cancel
-	cancel       map[string]context.CancelFunc // id → cancel func
+	enc               *json.Encoder
+	w                 io.Writer      // enc writes to, see writeBinary
+	out               *delayedWriter // nil unless responses are buffered
+	dec               decoder
+	useNumber         bool // set by WithPluginUseNumber
+	endpoints         atomic.Pointer[map[string]endpoint]
+	lockReplace       sync.Mutex          // serializes ReplaceHandlers
+	lockEndpoints     sync.Mutex          // protects staging and registering endpoints
+	staging           map[string]endpoint // set during ReplaceHandlers
+	running           atomic.Bool
+	wgDispatcher      sync.WaitGroup
+	lockEnc           sync.Mutex                         // protects enc
+	lockCancel        sync.Mutex                         // protects cancel and flows
+	cancel            map[string]context.CancelCauseFunc // id → cancel func
+	flows             map[string]*flowCredits            // id → credits, see WithFlowControl
+	lockCalled        sync.Mutex                         // protects called
+	called            map[string]struct{}                // endpoints dispatched at least once, nil unless tracked
+	features          atomic.Pointer[featureSet]         // negotiated with the host
+	compression       atomic.Pointer[compression]        // negotiated with the host
+	exitCode          atomic.Int32
+	includeStacks     atomic.Bool
+	lenientProtocol   atomic.Bool // set by SetStrictProtocol
+	healthChecks      []healthCheck
+	started           time.Time // when Run was invoked
+	unknownPolicy     UnknownMethodPolicy
+	eofPolicy         EOFPolicy       // set by SetEOFPolicy
+	eofTimeout        time.Duration   // zero if handlers are awaited indefinitely
+	settled           bool            // set once Run awaited handlers, see settle
+	fallback          endpoint        // nil if not set by HandleFallback
+	base              context.Context // nil if not set by SetContext
+	panicHandler      func(recovered any, stack []byte)
+	onShutdown        []func()
+	prepareOnce       sync.Once
+	onPrepareShutdown []func()
+	shuttingDown      atomic.Bool          // set by the prepare shutdown method
+	paused            atomic.Bool          // set by Pause
+	fdConn            *net.UnixConn        // nil unless the host passes file descriptors
+	lockFDs           sync.Mutex           // protects fds
+	fds               map[string]*passedFD // request id → passed file
+	callbackID        atomic.Uint64
+	lockCallbacks     sync.Mutex               // protects callbacks
+	callbacks         map[string]chan envelope // id → response, see CallHost
+	onEvent           func(PluginEvent)        // nil unless set by WithPluginEvents
+}
+
+// PluginOption configures a plugin.
+type PluginOption func(*pluginConfig)
+
+type pluginConfig struct {
+	strictStdout bool
+	ndjson       bool
+	useNumber    bool
+
+	readBufferSize  int           // set by WithPluginReadBufferSize
+	writeBufferSize int           // set by WithPluginWriteBufferSize
+	flushDelay      time.Duration // zero if writes aren't buffered
+
+	in  io.Reader // set by WithPluginIO
+	out io.Writer
+
+	onEvent    func(PluginEvent) // set by WithPluginEvents
+	trackCalls bool              // set by WithCallTracking
 }
 
-// NewPlugin binds to the process’ own stdin/stdout.
-func NewPlugin() *Plugin {
-	return &Plugin{
-		enc:       json.NewEncoder(os.Stdout),
-		dec:       json.NewDecoder(bufio.NewReader(os.Stdin)),
-		endpoints: map[string]func(context.Context, json.RawMessage) (any, error){},
-		cancel:    make(map[string]context.CancelFunc),
+// NewPlugin binds to the process’ own stdin/stdout, or to the pipes
+// passed by the host if it launched the plugin with WithStdio.
+//
+// Every message is written to the host as soon as it's encoded, so the
+// host never waits for a response sitting in a buffer: writers with
+// a Flush method (such as *bufio.Writer passed to WithPluginIO) are
+// flushed after each message. Only WithPluginWriteBuffer delays writes,
+// and only for the configured delay.
+func NewPlugin(opts ...PluginOption) *Plugin {
+	var c pluginConfig
+	for _, o := range opts {
+		o(&c)
+	}
+	in, out := c.in, c.out
+	if in == nil || out == nil {
+		in, out = pluginIO()
+	}
+	p := &Plugin{
+		dec:       newDecoder(in, c.ndjson, c.readBufferSize),
+		useNumber: c.useNumber,
+		onEvent:   c.onEvent,
+		cancel:    make(map[string]context.CancelCauseFunc),
+		flows:     map[string]*flowCredits{},
+		fdConn:    pluginFDSocket(),
+		fds:       map[string]*passedFD{},
+		callbacks: map[string]chan envelope{},
 	}
+	if c.trackCalls {
+		p.called = map[string]struct{}{}
+	}
+	if c.strictStdout && out == os.Stdout {
+		out = p.guardStdout()
+	}
+	if c.flushDelay > 0 {
+		p.out = newDelayedWriter(out, c.writeBufferSize, c.flushDelay)
+		out = p.out
+	} else if f, ok := out.(flusher); ok {
+		out = flushWriter{out, f}
+	}
+	p.w, p.enc = out, json.NewEncoder(out)
+	p.endpoints.Store(&map[string]endpoint{})
+	return p
 }
 
 // Handle registers an RPC endpoint overwriting any existing endpoint.
@@ -237,17 +1993,60 @@ func Handle[Req any, Resp any](
 	name string,
 	fn func(context.Context, Req) (Resp, error),
 ) {
-	if p.running.Load() {
-		panic("add handlers before invoking Run")
-	}
-	p.endpoints[name] = func(ctx context.Context, raw json.RawMessage) (any, error) {
+	HandleCtx(p, name, func(ctx context.Context, _ RequestMeta, req Req) (Resp, error) {
+		return fn(ctx, req)
+	})
+}
+
+// HandleCtx is like Handle but also passes the request metadata to fn.
+// The deadline of the caller, if any, is also applied to ctx.
+func HandleCtx[Req any, Resp any](
+	p *Plugin,
+	name string,
+	fn func(context.Context, RequestMeta, Req) (Resp, error),
+) {
+	p.handle(name, func(
+		ctx context.Context, meta RequestMeta, raw json.RawMessage, _ func(any) error,
+	) (any, error) {
 		var req Req
-		if err := json.Unmarshal(raw, &req); err != nil {
+		if err := unmarshal(raw, &req, p.useNumber); err != nil {
 			var zero Resp
 			return zero, err
 		}
-		return fn(ctx, req)
+		return fn(ctx, meta, req)
+	})
+}
+
+// SetExitCode sets the code Run returns on clean shutdown, which is 0
+// by default. Use it to report a terminal status to the host process,
+// which can read it from the error returned by Host.Close.
+// Safe to use from handlers.
+func (p *Plugin) SetExitCode(code int) { p.exitCode.Store(int32(code)) }
+
+// WithCallTracking makes the plugin track which endpoints received
+// requests, see UncalledMethods.
+func WithCallTracking() PluginOption {
+	return func(c *pluginConfig) { c.trackCalls = true }
+}
+
+// UncalledMethods returns the sorted names of all registered endpoints
+// that haven't received a single request yet.
+// Useful for asserting that a test suite covers the entire plugin API.
+// Panics unless the plugin was created with WithCallTracking.
+func (p *Plugin) UncalledMethods() []string {
+	if p.called == nil {
+		panic("create the plugin with WithCallTracking to track calls")
 	}
+	p.lockCalled.Lock()
+	defer p.lockCalled.Unlock()
+	var names []string
+	for name := range *p.endpoints.Load() {
+		if _, ok := p.called[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
 }
 
 // Run blocks handling requests until stdin closes or ctx is done.
@@ -256,107 +2055,404 @@ func (p *Plugin) Run(ctx context.Context) (osReturnCode int) {
 	if wasRunning := p.running.Swap(true); wasRunning {
 		panic("plugin is already running")
 	}
+	p.started = time.Now()
+	defer p.flush()
+	if p.base != nil {
+		// Take values from base, cancelation from both.
+		runCtx := ctx
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(p.base)
+		defer cancel()
+		defer context.AfterFunc(runCtx, cancel)()
+	}
+	defer p.recoverPanic()
+	defer p.shutdown()
+	defer p.closeCallbacks()
+	if p.fdConn != nil {
+		go p.receiveFDs()
+	}
 	for {
 		if ctx.Err() != nil {
 			// Run canceled.
-			return 0
+			return int(p.exitCode.Load())
 		}
 		var e envelope
 		if err := p.dec.Decode(&e); err != nil {
+			if errors.Is(err, ErrInvalidFrame) {
+				if p.skipMalformed(err.Error()) {
+					continue
+				}
+				fmt.Fprintln(os.Stderr, "plugger: protocol violation: "+err.Error())
+				p.closeCallbacks() // The host can't be understood anymore.
+				return ExitCodeInvalidFrame
+			}
 			// stdin closed – clean exit
-			return 0
+			p.closeCallbacks() // The host can't respond anymore.
+			p.handleEOF()
+			return int(p.exitCode.Load())
 		}
+		received := time.Now()
 
 		switch {
-		case e.Cancel != "":
+		case e.Cancel != "" || len(e.Cancels) > 0:
 			// Cancelation message received.
-			p.lockCancel.Lock()
-			if cancelFn, ok := p.cancel[e.Cancel]; ok {
-				cancelFn() // Abort the worker goroutine.
-				delete(p.cancel, e.Cancel)
+			// Requests are registered before the next message is decoded,
+			// so the cancel either finds its request or the request
+			// already finished and the cancel is ignored.
+			if e.Cancel != "" {
+				p.cancelRequest(e.Cancel, e.Reason, true)
+			}
+			for _, id := range e.Cancels {
+				p.cancelRequest(id, e.Reason, true)
 			}
-			p.lockCancel.Unlock()
 			continue // No reply for cancel.
+		case e.Credit != "":
+			p.grantCredits(e.Credit, e.Credits)
+			continue
+		case e.Callback:
+			p.deliverCallback(e)
+			continue
 		case e.ID == "":
-			panic(`protocol violation: both "id" and "cancel" empty`)
+			const msg = `both "id" and "cancel" empty`
+			if p.skipMalformed(msg) {
+				continue
+			}
+			panic("protocol violation: " + msg)
 		}
 
-		ctxReq, cancelFn := context.WithCancel(ctx)
-
+		// This is the only place requests are registered.
+		ctxReq, cancelFn := context.WithCancelCause(ctx)
 		p.lockCancel.Lock()
 		p.cancel[e.ID] = cancelFn
+		if e.Credits > 0 && p.hasFeature(FeatureFlowControl) {
+			p.flows[e.ID] = newFlowCredits(e.Credits)
+		}
 		p.lockCancel.Unlock()
+		p.event(PluginEvent{Kind: EventReceived, ID: e.ID, Method: e.Method})
 
 		p.wgDispatcher.Add(1)
-		go p.dispatch(ctxReq, cancelFn, e)
+		go p.dispatch(ctxReq, e, received)
+	}
+}
+
+// cancelRequest cancels and unregisters the request with the reason
+// sent by the host, if any, reporting EventCanceled if byHost is set.
+// No-op if the request is unknown or was already canceled.
+func (p *Plugin) cancelRequest(id, reason string, byHost bool) {
+	p.lockCancel.Lock()
+	cancelFn, ok := p.cancel[id]
+	delete(p.cancel, id)
+	delete(p.flows, id)
+	if ok && byHost {
+		// Reported before EventDone, which waits for the lock.
+		p.event(PluginEvent{Kind: EventCanceled, ID: id, Reason: reason})
+	}
+	p.lockCancel.Unlock()
+	if !ok {
+		return
+	}
+	var cause error
+	if reason != "" {
+		cause = CancelReason(reason)
+	}
+	cancelFn(cause) // Abort the worker goroutine.
+}
+
+// canceledByHost reports whether the host canceled request id,
+// which unregistered it. Requests canceled because Run stopped
+// are still registered and their responses are sent.
+func (p *Plugin) canceledByHost(id string) bool {
+	p.lockCancel.Lock()
+	defer p.lockCancel.Unlock()
+	_, ok := p.cancel[id]
+	return !ok
+}
+
+// CancelReason is the cause of a handler's context canceled by the host
+// with a reason (see WithCancelReason), retrieved by context.Cause.
+type CancelReason string
+
+func (r CancelReason) Error() string { return string(r) }
+
+// hasFeature reports whether feature was negotiated with the host.
+func (p *Plugin) hasFeature(feature string) bool {
+	f := p.features.Load()
+	return f != nil && f.has(feature)
+}
+
+// builtin returns the endpoint of a reserved method or nil if method
+// isn't reserved. Reserved methods can't be overwritten by Handle.
+func (p *Plugin) builtin(method string) endpoint {
+	switch method {
+	case methodHandshake:
+		return p.handshake
+	case methodEcho:
+		return p.echo
+	case methodHealth:
+		return p.health
+	case methodPrepareShutdown:
+		return p.prepareShutdown
 	}
+	return nil
 }
 
-func (p *Plugin) dispatch(ctx context.Context, cancelFn context.CancelFunc, ev envelope) {
+func (p *Plugin) dispatch(ctx context.Context, ev envelope, received time.Time) {
+	defer p.recoverPanic()
 	defer func() {
 		// Clean up cancelation function and release dispatcher slot.
-		p.lockCancel.Lock()
-		delete(p.cancel, ev.ID)
-		p.lockCancel.Unlock()
-		cancelFn()
+		p.cancelRequest(ev.ID, "", false)
+		p.event(PluginEvent{Kind: EventDone, ID: ev.ID, Method: ev.Method})
 		p.wgDispatcher.Done()
 	}()
+	if ev.FD && p.fdConn != nil {
+		defer p.releaseFD(ev.ID)
+	}
 
-	fn := p.endpoints[ev.Method]
+	fn := p.builtin(ev.Method)
+	paused := fn == nil && p.paused.Load() // Built-in methods are served.
+	if fn == nil && !paused {
+		if fn = (*p.endpoints.Load())[ev.Method]; fn != nil && p.called != nil {
+			p.lockCalled.Lock()
+			p.called[ev.Method] = struct{}{}
+			p.lockCalled.Unlock()
+		}
+	}
+
+	if fn == nil && ev.Method != "" && !paused {
+		var drop bool
+		if fn, drop = p.unknownMethod(ev); drop {
+			return
+		}
+	}
 
 	out := envelope{ID: ev.ID}
+	p.lockCancel.Lock()
+	flow := p.flows[ev.ID] // nil without flow control
+	p.lockCancel.Unlock()
 
 	if fn == nil {
-		out.Error = "unknown method: " + ev.Method
+		switch {
+		case paused:
+			out.Error, out.Code = ErrPaused.Error(), p.errorCode(ErrPaused)
+		case ev.Method == "":
+			out.Error = ErrEmptyMethod.Error()
+		default:
+			out.Error = "unknown method: " + ev.Method
+		}
 		p.lockEnc.Lock()
 		err := p.enc.Encode(out)
 		p.lockEnc.Unlock()
-		if err != nil {
+		if err != nil && !hostGone(err) {
 			panic(fmt.Errorf("encoding unknown method response: %w", err))
 		}
 		return
 	}
-	data, err := fn(ctx, ev.Data)
+	emit := func(item any) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !p.hasFeature(FeatureStream) {
+			// Hosts unaware of streams would take the item for the response.
+			return ErrStreamUnsupported
+		}
+		if flow != nil {
+			if err := flow.take(ctx); err != nil {
+				return err
+			}
+		}
+		if b, ok := item.(binaryChunk); ok && p.hasFeature(FeatureBinaryFrames) {
+			return p.writeBinary(ev.ID, b)
+		}
+		raw, err := marshal(item)
+		if err != nil {
+			return fmt.Errorf("marshaling stream item: %w", err)
+		}
+		chunk := envelope{ID: ev.ID, Chunk: true, Data: raw}
+		_ = p.compression.Load().compress(&chunk) // Sent uncompressed on failure.
+		p.lockEnc.Lock()
+		defer p.lockEnc.Unlock()
+		return p.enc.Encode(chunk)
+	}
+	meta := RequestMeta{
+		ID: ev.ID, Method: ev.Method, Deadline: ev.Deadline,
+		Headers: ev.Headers, file: ev.File, fd: ev.FD,
+	}
+	if ev.Logs && p.hasFeature(FeatureCallLog) {
+		ctx = context.WithValue(ctx, ctxKeyCallLog{}, &callLog{p: p, ctx: ctx, id: ev.ID})
+	}
+	if !ev.Deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, ev.Deadline)
+		defer cancel()
+	}
+	started := time.Now()
+	data, err := fn(ctx, meta, ev.Data, emit)
+	if p.hasFeature(FeatureTiming) {
+		out.Timing = &timing{
+			Queue: started.Sub(received).Microseconds(),
+			Exec:  time.Since(started).Microseconds(),
+		}
+	}
+	if t, ok := data.(Tagged); ok {
+		data = t.Value
+		if p.hasFeature(FeatureVariant) {
+			out.Variant = t.Variant
+		}
+	}
 	if err != nil {
 		out.Error = err.Error()
+		out.Stack = p.errorStack(err)
+		out.Retry = p.errorRetry(err)
+		out.Code = p.errorCode(err)
 	} else if data != nil {
-		out.Data, _ = json.Marshal(data)
+		var buf *pooledEncoder
+		out.Data, buf, _ = marshalPooled(data)
+		defer buf.release()                     // Encode copies the data.
+		_ = p.compression.Load().compress(&out) // Sent uncompressed on failure.
+	}
+	if p.canceledByHost(ev.ID) {
+		return // The host discards responses to canceled requests.
 	}
 	p.lockEnc.Lock()
 	err = p.enc.Encode(out)
 	p.lockEnc.Unlock()
-	if err != nil {
+	if err != nil && !hostGone(err) {
 		panic(fmt.Errorf("encoding response: %w", err))
 	}
 }
 
+// hostGone reports whether err writing to the host means that the host
+// stopped reading, in which case Run returns once stdin is closed.
+func hostGone(err error) bool {
+	return isBrokenPipe(err) || errors.Is(err, os.ErrClosed) ||
+		errors.Is(err, io.ErrClosedPipe)
+}
+
 var reModule = regexp.MustCompile(`^[\w.\-]+(\.[\w.\-]+)+/[\w.\-/]+(@[\w.\-]+)?$`)
 
-func spawn(plugin string) (*exec.Cmd, error) {
-	switch {
-	case reModule.MatchString(plugin):
-		if err := requireGo(); err != nil {
-			return nil, err
-		}
-		return exec.Command("go", "run", plugin), nil
-	case isGoFile(plugin):
+// SpawnKind is how a plugin is launched, which depends on the plugin path
+// passed to RunPlugin or Configure. Paths are classified as the first
+// matching kind in this order:
+//
+//  1. SpawnGoFile: an existing .go file, run with "go run <file>".
+//  2. SpawnLocalPackage: an existing directory inside a Go module,
+//     run with "go run ." in that directory.
+//  3. SpawnExecutable: an existing executable file, run directly.
+//  4. SpawnModule: a remote module path that doesn't exist locally,
+//     run with "go run <module>".
+//
+// A directory containing both a Go module and an executable is therefore
+// launched as SpawnLocalPackage. Other existing paths are rejected with
+// ErrInvalidPluginPath.
+type SpawnKind int
+
+const (
+	SpawnModule SpawnKind = iota + 1
+	SpawnGoFile
+	SpawnLocalPackage
+	SpawnExecutable
+)
+
+func (k SpawnKind) String() string {
+	switch k {
+	case SpawnModule:
+		return "module"
+	case SpawnGoFile:
+		return "go-file"
+	case SpawnLocalPackage:
+		return "local-package"
+	case SpawnExecutable:
+		return "executable"
+	}
+	return fmt.Sprintf("SpawnKind(%d)", int(k))
+}
+
+// spawn classifies the plugin and creates the command launching it,
+// see SpawnKind. module is the module path of local packages.
+func spawn(plugin string) (
+	cmd *exec.Cmd, kind SpawnKind, module string, err error,
+) {
+	if isGoFile(plugin) {
 		if err := requireGo(); err != nil {
-			return nil, err
+			return nil, 0, "", err
 		}
 		cmd := exec.Command("go", "run", plugin)
-		return cmd, nil
-	case isLocalGoPackage(plugin):
+		return cmd, SpawnGoFile, "", nil
+	}
+	if module, ok := localGoModule(plugin); ok {
 		if err := requireGo(); err != nil {
-			return nil, err
+			return nil, 0, "", err
 		}
 		cmd := exec.Command("go", "run", ".")
 		cmd.Dir = plugin
-		return cmd, nil
+		return cmd, SpawnLocalPackage, module, nil
+	}
+	switch {
 	case isExecutable(plugin):
-		return exec.Command(plugin), nil
+		return exec.Command(plugin), SpawnExecutable, "", nil
+	case exists(plugin):
+		// Never treat local files as remote modules.
+		return nil, 0, "", ErrInvalidPluginPath
+	case reModule.MatchString(plugin):
+		if err := requireGo(); err != nil {
+			return nil, 0, "", err
+		}
+		return exec.Command("go", "run", plugin), SpawnModule, "", nil
 	default:
-		return nil, ErrInvalidPluginPath
+		return nil, 0, "", ErrInvalidPluginPath
+	}
+}
+
+// goBuildEnv returns the environment variables configuring the build
+// directories of the go toolchain, see WithGoBuildDirs.
+func goBuildEnv(cfg *runConfig) ([]string, error) {
+	var env []string
+	for _, d := range []struct{ name, dir string }{
+		{"GOTMPDIR", cfg.goTmpDir}, {"GOCACHE", cfg.goCache},
+	} {
+		if d.dir == "" {
+			continue
+		}
+		abs, err := filepath.Abs(d.dir) // The go command requires absolute paths.
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", ErrBuildDir, d.dir, err)
+		}
+		if err := checkWritable(abs); err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", ErrBuildDir, abs, err)
+		}
+		env = append(env, d.name+"="+abs)
+	}
+	return env, nil
+}
+
+// checkWritable returns an error if no files can be created in dir.
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".plugger-*")
+	if err != nil {
+		return err
+	}
+	_ = f.Close()
+	return os.Remove(f.Name())
+}
+
+// moduleResolutionError returns the go command's output if it reports
+// an error, which before the plugin is running means that the module
+// couldn't be resolved. Returns "" otherwise.
+func moduleResolutionError(goStderr string) string {
+	for line := range strings.Lines(goStderr) {
+		if strings.HasPrefix(line, "go: ") &&
+			!strings.HasPrefix(line, "go: downloading ") &&
+			!strings.HasPrefix(line, "go: finding ") &&
+			!strings.HasPrefix(line, "go: extracting ") {
+			return strings.TrimSpace(goStderr)
+		}
 	}
+	return ""
+}
+
+func exists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
 }
 
 func isGoFile(p string) bool {
@@ -371,22 +2467,29 @@ func isGoFile(p string) bool {
 	return !info.IsDir() && filepath.Ext(abs) == ".go"
 }
 
-func isLocalGoPackage(p string) bool {
+// localGoModule returns the path of the module declared by the go.mod
+// governing directory p. Returns false if p isn't a local Go package.
+func localGoModule(p string) (module string, ok bool) {
 	abs, err := filepath.Abs(p)
 	if err != nil {
-		return false
+		return "", false
 	}
 	info, err := os.Stat(abs)
 	if err != nil {
-		return false
+		return "", false
 	}
 	if !info.IsDir() {
-		return false
+		return "", false
 	}
 	cmd := exec.Command("go", "list", "-m")
 	cmd.Dir = abs
-	err = cmd.Run()
-	return err == nil
+	out, err := cmd.Output()
+	if err != nil {
+		return "", false
+	}
+	// Workspaces list all their modules, the first is the main module.
+	module, _, _ = strings.Cut(string(out), "\n")
+	return strings.TrimSpace(module), true
 }
 
 func isExecutable(p string) bool {
@@ -1,29 +1,37 @@
 package plugger_test
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/romshark/plugger"
+	"github.com/romshark/plugger/pluggertest"
 )
 
-func writeFile(t *testing.T, name, body string) {
+func writeFile(t testing.TB, name, body string) {
 	err := os.WriteFile(name, []byte(strings.TrimSpace(body)+"\n"), 0o777)
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
-func readFile(t *testing.T, name string) string {
+func readFile(t testing.TB, name string) string {
 	c, err := os.ReadFile(name)
 	if err != nil {
 		t.Fatal(err)
@@ -31,44 +39,8 @@ func readFile(t *testing.T, name string) string {
 	return string(c)
 }
 
-type logWriter struct {
-	t         *testing.T
-	lock      sync.Mutex
-	listeners []chan<- string
-}
-
-var _ io.WriteCloser = new(logWriter)
-
-func newLogWriter(t *testing.T) *logWriter { return &logWriter{t: t} }
-
-func (w *logWriter) AddReader(c chan<- string) {
-	w.lock.Lock()
-	w.listeners = append(w.listeners, c)
-	w.lock.Unlock()
-}
-
-func (w *logWriter) Write(b []byte) (int, error) {
-	w.lock.Lock()
-	m := string(b)
-	for _, l := range w.listeners {
-		l <- m
-	}
-	w.t.Log(m)
-	w.lock.Unlock()
-	return len(b), nil
-}
-
-func (w *logWriter) Close() error {
-	w.lock.Lock()
-	for _, l := range w.listeners {
-		close(l)
-	}
-	w.lock.Unlock()
-	return nil
-}
-
 func TestCallLocalGoPackage(t *testing.T) {
-	h, _ := launchLocalModule(t, t.Context(), "test_happy",
+	h, _ := pluggertest.Launch(t, t.Context(), "test_happy",
 		"testdata/t1_plugin_main.go.txt")
 	testPlugin(t, h)
 }
@@ -89,7 +61,7 @@ func TestCallLocalGoFile(t *testing.T) {
 	ctx := t.Context()
 	h := plugger.NewHost()
 	go func() {
-		err := h.RunPlugin(ctx, mainFile, newLogWriter(t))
+		err := h.RunPlugin(ctx, mainFile, pluggertest.NewLogWriter(t))
 		if err != nil && !errors.Is(err, io.EOF) {
 			t.Errorf("RunPlugin error: %v", err)
 		}
@@ -108,7 +80,7 @@ func TestCallBashScriptExecutable(t *testing.T) {
 	ctx := t.Context()
 	h := plugger.NewHost()
 	go func() {
-		err := h.RunPlugin(ctx, "testdata/test_executable.sh", newLogWriter(t))
+		err := h.RunPlugin(ctx, "testdata/test_executable.sh", pluggertest.NewLogWriter(t))
 		if err != nil && !errors.Is(err, io.EOF) {
 			t.Errorf("RunPlugin error: %v", err)
 		}
@@ -122,32 +94,441 @@ func TestCallBashScriptExecutable(t *testing.T) {
 	}
 }
 
+func TestConcurrentCalls(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_concurrent_calls",
+		"testdata/t1_plugin_main.go.txt")
+
+	// Requests written concurrently must not interleave.
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Go(func() {
+			for j := range 20 {
+				resp, err := plugger.Call[AddReq, AddResp](
+					t.Context(), h, "add", AddReq{A: i, B: j},
+				)
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+					return
+				}
+				if resp.Sum != i+j {
+					t.Errorf("expected %d+%d=%d, got %d", i, j, i+j, resp.Sum)
+				}
+			}
+		})
+	}
+	wg.Wait()
+}
+
+func TestConcurrentResponses(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_concurrent_responses",
+		"testdata/tcount_plugin_main.go.txt")
+
+	// Large responses written by overlapping handlers must not interleave.
+	var wg sync.WaitGroup
+	for i := range 100 {
+		wg.Go(func() {
+			resp, err := plugger.Call[int, string](t.Context(), h, "repeat", i)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			if resp != strings.Repeat(strconv.Itoa(i%10), 64<<10) {
+				t.Errorf("unexpected response to request %d", i)
+			}
+		})
+	}
+	wg.Wait()
+}
+
 func TestCancelRequest(t *testing.T) {
-	h, logWriter := launchLocalModule(t, t.Context(), "test_cancel",
+	events := make(chan plugger.PluginEvent, 16)
+	conn := pluggertest.Serve(t, func(p *plugger.Plugin) {
+		plugger.Handle(p, "wait", func(ctx context.Context, _ struct{}) (struct{}, error) {
+			<-ctx.Done()
+			return struct{}{}, context.Cause(ctx)
+		})
+	}, plugger.WithPluginEvents(func(e plugger.PluginEvent) { events <- e }))
+	expect := func(e plugger.PluginEvent) {
+		t.Helper()
+		if got := <-events; got != e {
+			t.Fatalf("expected event %#v, got %#v", e, got)
+		}
+	}
+
+	// Cancel only once the request was received.
+	conn.Send(`{"id":"1","method":"wait","data":{}}`)
+	expect(plugger.PluginEvent{Kind: plugger.EventReceived, ID: "1", Method: "wait"})
+	conn.Send(`{"cancel":"1","reason":"user left"}`)
+	expect(plugger.PluginEvent{Kind: plugger.EventCanceled, ID: "1", Reason: "user left"})
+	expect(plugger.PluginEvent{Kind: plugger.EventDone, ID: "1", Method: "wait"})
+
+	// Canceling a completed request reports nothing.
+	conn.Send(`{"id":"2","method":"__echo","data":"ok"}`)
+	if resp := string(conn.Receive()); resp != `{"id":"2","data":"ok"}` {
+		t.Fatalf("unexpected response: %s", resp)
+	}
+	expect(plugger.PluginEvent{Kind: plugger.EventReceived, ID: "2", Method: "__echo"})
+	expect(plugger.PluginEvent{Kind: plugger.EventDone, ID: "2", Method: "__echo"})
+	conn.Send(`{"cancel":"2"}`)
+	conn.Send(`{"id":"3","method":"__echo","data":"ok"}`)
+	expect(plugger.PluginEvent{Kind: plugger.EventReceived, ID: "3", Method: "__echo"})
+}
+
+func TestCancelCause(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_cancel_cause",
 		"testdata/tcancel_plugin_main.go.txt")
 
-	ctx, cancel := context.WithCancel(t.Context())
-	cancel() // Cancel the call immediately.
+	errUserLeft := errors.New("user navigated away")
+	ctx, cancel := context.WithCancelCause(t.Context())
+	cancel(errUserLeft)
 	_, err := plugger.Call[AddReq, AddResp](
 		ctx, h, "add", AddReq{A: 1, B: 1},
 	)
+	if !errors.Is(err, errUserLeft) {
+		t.Fatalf("expected the cancelation cause, received: %v", err)
+	}
 	if !errors.Is(err, context.Canceled) {
-		t.Fatalf("expected err context.Canceled; received: %v", err)
+		t.Fatalf("expected err context.Canceled, received: %v", err)
 	}
+}
 
+func TestCancelReason(t *testing.T) {
+	h, logWriter := pluggertest.Launch(t, t.Context(), "test_cancel_reason",
+		"testdata/tcancel_plugin_main.go.txt")
 	c := make(chan string, 2)
 	logWriter.AddReader(c)
 
-	if m := <-c; m != "request received\n" {
-		t.Fatalf("unexpected log: %q", m)
+	for _, tc := range []struct {
+		name   string
+		cause  error
+		opts   []plugger.CallOption
+		expect string
+	}{
+		{
+			name:   "cause",
+			cause:  errors.New("user navigated away"),
+			expect: "request canceled: user navigated away\n",
+		},
+		{
+			name:   "option",
+			opts:   []plugger.CallOption{plugger.WithCancelReason("shutting down")},
+			expect: "request canceled: shutting down\n",
+		},
+		{
+			name:   "none",
+			expect: "request canceled\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancelCause(t.Context())
+			cancel(tc.cause)
+			_, err := plugger.Call[AddReq, AddResp](
+				ctx, h, "add", AddReq{A: 1, B: 1}, tc.opts...,
+			)
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("expected err context.Canceled, received: %v", err)
+			}
+			if m := <-c; m != "request received\n" {
+				t.Fatalf("unexpected log: %q", m)
+			}
+			if m := <-c; m != tc.expect {
+				t.Fatalf("unexpected log: %q", m)
+			}
+		})
+	}
+}
+
+func TestCancelImmediatelyAfterSend(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_cancel_after_send",
+		"testdata/tcount_plugin_main.go.txt")
+	// Wait for the plugin to start.
+	if _, err := plugger.Call[struct{}, CountResp](
+		t.Context(), h, "count", struct{}{},
+	); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Cancel at varying points in time right after the request is sent.
+	var wg sync.WaitGroup
+	for i := range 100 {
+		wg.Go(func() {
+			ctx, cancel := context.WithTimeout(
+				t.Context(), time.Duration(i)*10*time.Microsecond,
+			)
+			defer cancel()
+			_, _ = plugger.Call[struct{}, CountResp](
+				ctx, h, "slow_count", struct{}{},
+			)
+		})
+	}
+	wg.Wait()
+	waitActive(t, h, 0)
+}
+
+func TestCallTimeout(t *testing.T) {
+	f := pluggertest.MakeModule(t, "test_call_timeout",
+		"testdata/tcount_plugin_main.go.txt")
+	h := plugger.NewHost(plugger.WithCallTimeout(100 * time.Millisecond))
+	h.Configure(f, plugger.WithStderr(pluggertest.NewLogWriter(t)))
+	t.Cleanup(func() { _ = h.Close() })
+	// Compiling the plugin on first use takes longer than the timeout.
+	if _, err := plugger.Call[struct{}, CountResp](t.Context(), h, "count", struct{}{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	start := time.Now()
+	_, err := plugger.Call[int, struct{}](t.Context(), h, "sleep", 1000)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected DeadlineExceeded, got: %v", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("call didn't time out: %v", d)
+	}
+
+	// The caller's deadline takes precedence.
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+	if _, err := plugger.Call[int, struct{}](ctx, h, "sleep", 300); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestCancelBatch(t *testing.T) {
+	for _, batch := range []int{1, 4, 64} {
+		t.Run(fmt.Sprintf("batch_%d", batch), func(t *testing.T) {
+			f := pluggertest.MakeModule(t, "test_cancel_batch",
+				"testdata/tcount_plugin_main.go.txt")
+			h := plugger.NewHost()
+			go func() {
+				_ = h.RunPlugin(t.Context(), f, pluggertest.NewLogWriter(t),
+					plugger.WithCancelBatch(batch))
+			}()
+			t.Cleanup(func() { _ = h.Close() })
+
+			ctx, cancel := context.WithCancel(t.Context())
+			var wg sync.WaitGroup
+			for range 50 {
+				wg.Go(func() {
+					_, _ = plugger.Call[struct{}, struct{}](
+						ctx, h, "wait", struct{}{},
+					)
+				})
+			}
+			waitActive(t, h, 50)
+			cancel()
+			wg.Wait()
+			waitActive(t, h, 0)
+		})
+	}
+}
+
+func TestCancelCall(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_cancel_call",
+		"testdata/tcount_plugin_main.go.txt")
+	waitActive(t, h, 0) // Wait for the plugin to start.
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := plugger.Call[struct{}, struct{}](
+			t.Context(), h, "wait", struct{}{},
+		)
+		errs <- err
+	}()
+	waitActive(t, h, 1)
+
+	calls := h.Calls()
+	if len(calls) != 1 || calls[0].Method != "wait" {
+		t.Fatalf("unexpected calls: %#v", calls)
+	}
+	if h.CancelCall("unknown") {
+		t.Fatal("expected unknown call not to be canceled")
+	}
+	if !h.CancelCall(calls[0].ID) {
+		t.Fatal("expected call to be canceled")
+	}
+	if err := <-errs; !errors.Is(err, plugger.ErrCanceledByHost) {
+		t.Fatalf("expected ErrCanceledByHost, got: %v", err)
+	}
+	waitActive(t, h, 0)
+	if calls := h.Calls(); len(calls) != 0 {
+		t.Fatalf("unexpected calls: %#v", calls)
+	}
+}
+
+func TestCancelGrace(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_cancel_grace",
+		"testdata/tcount_plugin_main.go.txt")
+	waitActive(t, h, 0) // Wait for the plugin to start.
+
+	call := func(method string, grace time.Duration) (CountResp, error) {
+		ctx, cancel := context.WithCancel(t.Context())
+		type result struct {
+			resp CountResp
+			err  error
+		}
+		results := make(chan result, 1)
+		go func() {
+			resp, err := plugger.Call[struct{}, CountResp](
+				ctx, h, method, struct{}{}, plugger.WithCancelGrace(grace),
+			)
+			results <- result{resp, err}
+		}()
+		waitActive(t, h, 1)
+		cancel()
+		r := <-results
+		return r.resp, r.err
+	}
+
+	// The response arrives within the grace period.
+	resp, err := call("slow_count", 5*time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.Calls != 1 {
+		t.Fatalf("expected 1 call, got %d", resp.Calls)
+	}
+
+	// The grace period expires and the request is canceled.
+	start := time.Now()
+	_, err = call("wait", 50*time.Millisecond)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got: %v", err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Fatalf("expected the call to wait for the grace period, took %v", d)
+	}
+	waitActive(t, h, 0)
+}
+
+func TestWithoutRemoteCancel(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_without_remote_cancel",
+		"testdata/tcount_plugin_main.go.txt")
+	waitActive(t, h, 0) // Wait for the plugin to start.
+
+	ctx, cancel := context.WithCancel(t.Context())
+	errs := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		_, err := plugger.Call[struct{}, CountResp](
+			ctx, h, "slow_count", struct{}{}, plugger.WithoutRemoteCancel(),
+		)
+		errs <- err
+	}()
+	waitActive(t, h, 1)
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got: %v", err)
+	}
+
+	// The plugin wasn't notified and keeps processing the request
+	// for the 200ms slow_count takes unless canceled.
+	waitActive(t, h, 0) // The discarded response doesn't break other calls.
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Fatalf("expected the call to still be processed, completed after %v", d)
+	}
+	resp, err := plugger.Call[struct{}, CountResp](t.Context(), h, "count", struct{}{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.Calls != 2 {
+		t.Fatalf("expected 2 calls, got %d", resp.Calls)
+	}
+}
+
+// eventually polls cond until it's true for up to 5 seconds
+// and reports whether it became true.
+func eventually(cond func() bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
 	}
-	if m := <-c; m != "request canceled\n" {
-		t.Fatalf("unexpected log: %q", m)
+	return true
+}
+
+// waitActive waits until the number of calls in progress
+// reported by the count plugin reaches n.
+func waitActive(t *testing.T, h *plugger.Host, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		active, err := plugger.Call[struct{}, int64](
+			t.Context(), h, "active", struct{}{},
+		)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if active == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d handlers running, got %d", n, active)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	f := pluggertest.MakeModule(t, "test_read_timeout", "testdata/twedge_plugin_main.go.txt")
+	h := plugger.NewHost()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- h.RunPlugin(t.Context(), f, pluggertest.NewLogWriter(t),
+			plugger.WithReadTimeout(100*time.Millisecond))
+	}()
+	t.Cleanup(func() { _ = h.Close() })
+
+	if _, err := plugger.Call[struct{}, string](
+		t.Context(), h, "ping", struct{}{},
+	); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond) // Idle time doesn't count.
+	if _, err := plugger.Call[struct{}, string](
+		t.Context(), h, "ping", struct{}{},
+	); err != nil {
+		t.Fatalf("unexpected error after idling: %v", err)
+	}
+
+	_, err := plugger.Call[struct{}, struct{}](t.Context(), h, "wedge", struct{}{})
+	if !errors.Is(err, plugger.ErrReadTimeout) || !errors.Is(err, plugger.ErrTimeout) {
+		t.Fatalf("expected ErrReadTimeout, got: %v", err)
+	}
+	if err := <-errs; !errors.Is(err, plugger.ErrReadTimeout) {
+		t.Fatalf("expected RunPlugin to return ErrReadTimeout, got: %v", err)
+	}
+}
+
+func TestStrictStdout(t *testing.T) {
+	bin := pluggertest.BuildModule(t, "test_strict_stdout", "testdata/tstrict_plugin_main.go.txt")
+	h := plugger.NewHost()
+	var stderr syncBuffer
+	go func() { _ = h.RunPlugin(t.Context(), bin, nil, plugger.WithStderr(&stderr)) }()
+
+	if _, err := plugger.Call[struct{}, string](
+		t.Context(), h, "ping", struct{}{},
+	); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err := plugger.Call[struct{}, struct{}](t.Context(), h, "print", struct{}{})
+	const expect = `protocol corruption: plugin wrote to stdout: "oops\n"`
+	if err != plugger.ErrorResponse(expect) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var errExit *exec.ExitError
+	if err := h.Close(); !errors.As(err, &errExit) || errExit.ExitCode() != 2 {
+		t.Fatalf("expected exit code 2, got: %v", err)
+	}
+	if !strings.Contains(stderr.String(), expect) {
+		t.Fatalf("expected the error in stderr, got: %q", stderr.String())
 	}
 }
 
 func TestMalformedResponse(t *testing.T) {
-	h, _ := launchLocalModule(t, t.Context(), "test_malformed_response",
+	h, _ := pluggertest.Launch(t, t.Context(), "test_malformed_response",
 		"testdata/tinvalresp_plugin_main.go.txt")
 
 	_, err := plugger.Call[AddReq, AddResp](
@@ -160,6 +541,820 @@ func TestMalformedResponse(t *testing.T) {
 	}
 }
 
+func TestIdleTimeout(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_idle_timeout",
+		"testdata/t1_plugin_main.go.txt")
+	h.SetIdleTimeout(50 * time.Millisecond)
+
+	got, err := plugger.Call[AddReq, AddResp](
+		t.Context(), h, "add", AddReq{A: 1, B: 2},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.Sum != 3 {
+		t.Fatalf("unexpected result: %d", got.Sum)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := plugger.Call[AddReq, AddResp](
+			t.Context(), h, "add", AddReq{A: 1, B: 2},
+		)
+		if errors.Is(err, plugger.ErrClosed) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("plugin wasn't closed after idle timeout, last error: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond) // Longer than the idle timeout.
+	}
+}
+
+func TestIdleTimeoutRace(t *testing.T) {
+	modDir := pluggertest.MakeModule(t, "test_idle_timeout_race",
+		"testdata/t1_plugin_main.go.txt")
+	h := plugger.NewHost()
+	h.Configure(modDir, plugger.WithStderr(pluggertest.NewLogWriter(t)))
+	defer func() { _ = h.Close() }()
+	h.SetIdleTimeout(time.Millisecond)
+
+	// Calls never observe the plugin closed by the idle timeout.
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Go(func() {
+			for range 20 {
+				_, err := plugger.Call[AddReq, AddResp](
+					t.Context(), h, "add", AddReq{A: 1, B: 2},
+				)
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+					return
+				}
+				time.Sleep(time.Millisecond) // Let the idle timeout fire.
+			}
+		})
+	}
+	wg.Wait()
+}
+
+func TestLazyLaunch(t *testing.T) {
+	modDir := pluggertest.MakeModule(t, "test_lazy_launch",
+		"testdata/t1_plugin_main.go.txt")
+
+	h := plugger.NewHost()
+	h.Configure(modDir, plugger.WithStderr(pluggertest.NewLogWriter(t)))
+	t.Cleanup(func() {
+		if err := h.Close(); err != nil {
+			t.Fatalf("closing host: %v", err)
+		}
+	})
+
+	// The first call launches the plugin.
+	testPlugin(t, h)
+
+	// Let the idle timeout shut the plugin down, the next call relaunches it.
+	h.SetIdleTimeout(10 * time.Millisecond)
+	if !eventually(func() bool { return h.Features() == nil }) {
+		t.Fatal("plugin wasn't shut down by the idle timeout")
+	}
+	testPlugin(t, h)
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func TestStderrPhases(t *testing.T) {
+	t.Run("build", func(t *testing.T) {
+		modDir := filepath.Join(t.TempDir(), "broken")
+		if err := os.MkdirAll(modDir, 0o777); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, filepath.Join(modDir, "go.mod"), "module broken\ngo 1.25")
+		writeFile(t, filepath.Join(modDir, "main.go"),
+			"package main\nfunc main() { undefinedFunction() }")
+
+		var build, runtime syncBuffer
+		h := plugger.NewHost()
+		err := h.RunPlugin(t.Context(), modDir, nil,
+			plugger.WithBuildStderr(&build), plugger.WithRuntimeStderr(&runtime))
+		if err == nil {
+			t.Fatal("expected compilation to fail")
+		}
+		if !strings.Contains(build.String(), "undefinedFunction") {
+			t.Fatalf("unexpected build stderr: %q", build.String())
+		}
+		if runtime.String() != "" {
+			t.Fatalf("unexpected runtime stderr: %q", runtime.String())
+		}
+	})
+
+	t.Run("runtime", func(t *testing.T) {
+		modDir := pluggertest.MakeModule(t, "test_stderr_phases",
+			"testdata/tcancel_plugin_main.go.txt")
+
+		var build, runtime syncBuffer
+		h := plugger.NewHost()
+		h.Configure(modDir,
+			plugger.WithBuildStderr(&build), plugger.WithRuntimeStderr(&runtime))
+		_, err := plugger.Call[AddReq, AddResp](
+			t.Context(), h, "add", AddReq{A: 1, B: 1},
+		)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := h.Close(); err != nil {
+			t.Fatalf("closing host: %v", err)
+		}
+		if build.String() != "" {
+			t.Fatalf("unexpected build stderr: %q", build.String())
+		}
+		if runtime.String() != "request received\n" {
+			t.Fatalf("unexpected runtime stderr: %q", runtime.String())
+		}
+	})
+}
+
+func TestModuleResolutionError(t *testing.T) {
+	t.Setenv("GOPROXY", "off")
+	h := plugger.NewHost()
+	err := h.RunPlugin(t.Context(),
+		"example.invalid/nonexistent/plugin@v0.0.0", nil,
+		plugger.WithStderr(io.Discard))
+	if !errors.Is(err, plugger.ErrModuleResolution) {
+		t.Fatalf("expected ErrModuleResolution, got: %v", err)
+	}
+	if !strings.Contains(err.Error(), "GOPROXY=off") {
+		t.Fatalf("expected the go command's output in the error, got: %v", err)
+	}
+}
+
+func TestLocalFileNotTreatedAsModule(t *testing.T) {
+	t.Chdir(t.TempDir())
+	// Matches the module path pattern but exists as a non-executable file.
+	if err := os.MkdirAll("plugins.d", 0o777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("plugins.d/plugin.txt", nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h := plugger.NewHost()
+	err := h.RunPlugin(t.Context(), "plugins.d/plugin.txt", nil)
+	if !errors.Is(err, plugger.ErrInvalidPluginPath) {
+		t.Fatalf("expected ErrInvalidPluginPath, got: %v", err)
+	}
+}
+
+// failingCloser is a plugin stderr writer failing to close.
+type failingCloser struct{ io.Writer }
+
+var errLogsLost = errors.New("logs lost")
+
+func (failingCloser) Close() error { return errLogsLost }
+
+func TestRunPluginStderrCloseError(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("not supported on windows")
+	}
+	h := plugger.NewHost()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- h.RunPlugin(t.Context(), "testdata/test_executable.sh",
+			failingCloser{io.Discard})
+	}()
+	testPlugin(t, h)
+	if err := h.Close(); err != nil {
+		t.Fatalf("closing host: %v", err)
+	}
+	if err := <-errs; !errors.Is(err, errLogsLost) {
+		t.Fatalf("expected the close error, got: %v", err)
+	}
+}
+
+func TestCloseAsync(t *testing.T) {
+	modDir := pluggertest.MakeModule(t, "test_close_async",
+		"testdata/t1_plugin_main.go.txt")
+	h := plugger.NewHost()
+	h.Configure(modDir, plugger.WithStderr(pluggertest.NewLogWriter(t)))
+	testPlugin(t, h)
+
+	c := h.CloseAsync()
+	// The host is closed before the plugin exited.
+	_, err := plugger.Call[AddReq, AddResp](t.Context(), h, "add", AddReq{})
+	if !errors.Is(err, plugger.ErrClosed) {
+		t.Fatalf("expected ErrClosed, got: %v", err)
+	}
+	if err := <-c; err != nil {
+		t.Fatalf("unexpected exit error: %v", err)
+	}
+	if _, ok := <-c; ok {
+		t.Fatal("expected the channel to be closed")
+	}
+	if err := <-h.CloseAsync(); err != nil {
+		t.Fatalf("closing again: %v", err)
+	}
+}
+
+func TestStartupProgress(t *testing.T) {
+	modDir := pluggertest.MakeModule(t, "test_startup_progress",
+		"testdata/t1_plugin_main.go.txt")
+
+	var lock sync.Mutex
+	var msgs []string
+	h := plugger.NewHost()
+	h.OnStartupProgress(func(_ context.Context, msg string) {
+		lock.Lock()
+		msgs = append(msgs, msg)
+		lock.Unlock()
+	})
+	h.Configure(modDir, plugger.WithStderr(pluggertest.NewLogWriter(t)))
+	testPlugin(t, h)
+	if err := h.Close(); err != nil {
+		t.Fatalf("closing host: %v", err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	expect := []string{plugger.StartupCompiling, plugger.StartupHandshakeComplete}
+	if !slices.Equal(msgs, expect) {
+		t.Fatalf("unexpected progress: %q", msgs)
+	}
+}
+
+func TestOnSpawn(t *testing.T) {
+	type spawned struct {
+		kind plugger.SpawnKind
+		args []string
+	}
+	launch := func(t *testing.T, plugin string) spawned {
+		t.Helper()
+		var s spawned
+		h := plugger.NewHost()
+		h.OnSpawn(func(
+			_ context.Context, kind plugger.SpawnKind, cmd string, args []string,
+		) {
+			s = spawned{kind: kind, args: args}
+		})
+		h.Configure(plugin, plugger.WithStderr(pluggertest.NewLogWriter(t)))
+		defer func() { _ = h.Close() }()
+		testPlugin(t, h)
+		return s
+	}
+
+	t.Run("local_package", func(t *testing.T) {
+		modDir := pluggertest.MakeModule(t, "test_on_spawn",
+			"testdata/t1_plugin_main.go.txt")
+		// An executable in the module doesn't change the classification.
+		err := os.WriteFile(filepath.Join(modDir, "plugin"),
+			[]byte("#!/bin/sh\n"), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := launch(t, modDir)
+		if s.kind != plugger.SpawnLocalPackage {
+			t.Fatalf("expected %s, got %s", plugger.SpawnLocalPackage, s.kind)
+		}
+		if expect := []string{"run", "."}; !slices.Equal(s.args, expect) {
+			t.Fatalf("expected args %q, got %q", expect, s.args)
+		}
+	})
+
+	t.Run("executable", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("not supported on windows")
+		}
+		s := launch(t, "testdata/test_executable.sh")
+		if s.kind != plugger.SpawnExecutable {
+			t.Fatalf("expected %s, got %s", plugger.SpawnExecutable, s.kind)
+		}
+		if len(s.args) != 0 {
+			t.Fatalf("unexpected args: %q", s.args)
+		}
+	})
+}
+
+func TestReentrantCall(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("not supported on windows")
+	}
+	call := func(ctx context.Context, h *plugger.Host) error {
+		_, err := plugger.Call[AddReq, AddResp](ctx, h, "add", AddReq{A: 1, B: 2})
+		return err
+	}
+	var spawnErr, progressErr error
+	h := plugger.NewHost()
+	h.OnSpawn(func(ctx context.Context, _ plugger.SpawnKind, _ string, _ []string) {
+		spawnErr = call(ctx, h)
+	})
+	h.OnStartupProgress(func(ctx context.Context, msg string) {
+		if msg == plugger.StartupHandshakeComplete {
+			progressErr = call(ctx, h)
+		}
+	})
+	h.Configure("testdata/test_executable.sh",
+		plugger.WithStderr(pluggertest.NewLogWriter(t)))
+	defer func() { _ = h.Close() }()
+	testPlugin(t, h) // Launches the plugin.
+
+	if !errors.Is(spawnErr, plugger.ErrReentrantCall) {
+		t.Fatalf("expected ErrReentrantCall from OnSpawn, got: %v", spawnErr)
+	}
+	if !errors.Is(progressErr, plugger.ErrReentrantCall) {
+		t.Fatalf("expected ErrReentrantCall from OnStartupProgress, got: %v",
+			progressErr)
+	}
+}
+
+func TestCallDuringLaunchCallback(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("not supported on windows")
+	}
+	spawned, unblock := make(chan struct{}), make(chan struct{})
+	h := plugger.NewHost()
+	h.OnSpawn(func(context.Context, plugger.SpawnKind, string, []string) {
+		close(spawned)
+		<-unblock
+	})
+	go func() {
+		_ = h.RunPlugin(t.Context(), "testdata/test_executable.sh",
+			pluggertest.NewLogWriter(t))
+	}()
+	defer func() { _ = h.Close() }()
+	<-spawned
+
+	errCall := make(chan error, 1)
+	go func() {
+		_, err := plugger.Call[AddReq, AddResp](
+			t.Context(), h, "add", AddReq{A: 1, B: 2},
+		)
+		errCall <- err
+	}()
+	if !eventually(func() bool { return h.DebugStats().ActiveCalls == 1 }) {
+		t.Fatal("call didn't start")
+	}
+	close(unblock)
+	if err := <-errCall; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestGoBuildDirs(t *testing.T) {
+	modDir := pluggertest.MakeModule(t, "test_go_build_dirs",
+		"testdata/t1_plugin_main.go.txt")
+
+	t.Run("tmp", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		h := plugger.NewHost()
+		h.Configure(modDir, plugger.WithStderr(pluggertest.NewLogWriter(t)),
+			plugger.WithGoBuildDirs(tmpDir, ""))
+		defer func() { _ = h.Close() }()
+		testPlugin(t, h)
+
+		// go run keeps the binary in GOTMPDIR while it's running.
+		entries, err := os.ReadDir(tmpDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) == 0 {
+			t.Fatal("expected build artifacts in the temp directory")
+		}
+	})
+
+	t.Run("not_writable", func(t *testing.T) {
+		h := plugger.NewHost()
+		err := h.RunPlugin(t.Context(), modDir, pluggertest.NewLogWriter(t),
+			plugger.WithGoBuildDirs("", filepath.Join(t.TempDir(), "missing")))
+		if !errors.Is(err, plugger.ErrBuildDir) {
+			t.Fatalf("expected ErrBuildDir, got: %v", err)
+		}
+	})
+}
+
+func TestWriteBuffer(t *testing.T) {
+	modDir := pluggertest.MakeModule(t, "test_write_buffer",
+		"testdata/t1_plugin_main.go.txt")
+
+	t.Run("delayed", func(t *testing.T) {
+		h := plugger.NewHost()
+		h.Configure(modDir, plugger.WithStderr(pluggertest.NewLogWriter(t)),
+			plugger.WithWriteBuffer(time.Millisecond))
+		defer func() { _ = h.Close() }()
+		testPlugin(t, h)
+	})
+
+	t.Run("waiting", func(t *testing.T) {
+		h := plugger.NewHost()
+		h.Configure(modDir, plugger.WithStderr(pluggertest.NewLogWriter(t)),
+			plugger.WithWriteBuffer(time.Hour))
+		defer func() { _ = h.Close() }()
+
+		// Requests are flushed once their callers await the response.
+		ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+		defer cancel()
+		var wg sync.WaitGroup
+		for i := range 20 {
+			wg.Go(func() {
+				r, err := plugger.Call[AddReq, AddResp](ctx, h, "add", AddReq{A: i, B: 1})
+				if err != nil || r.Sum != i+1 {
+					t.Errorf("unexpected result: %#v, %v", r, err)
+				}
+			})
+		}
+		wg.Wait()
+	})
+}
+
+type MetaResp struct {
+	ID          string            `json:"id"`
+	Method      string            `json:"method"`
+	Deadline    time.Time         `json:"deadline"`
+	CtxDeadline time.Time         `json:"ctxDeadline"`
+	Headers     map[string]string `json:"headers"`
+}
+
+func TestHandleCtx(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_handle_ctx",
+		"testdata/tmeta_plugin_main.go.txt")
+
+	m, err := plugger.Call[struct{}, MetaResp](t.Context(), h, "meta", struct{}{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m.ID == "" || m.Method != "meta" {
+		t.Fatalf("unexpected metadata: %#v", m)
+	}
+	if !m.Deadline.IsZero() || !m.CtxDeadline.IsZero() {
+		t.Fatalf("unexpected deadline: %#v", m)
+	}
+
+	deadline := time.Now().Add(time.Minute)
+	ctx, cancel := context.WithDeadline(t.Context(), deadline)
+	defer cancel()
+	m2, err := plugger.Call[struct{}, MetaResp](ctx, h, "meta", struct{}{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m2.ID == m.ID {
+		t.Fatalf("expected unique request IDs, got %q twice", m.ID)
+	}
+	if !m2.Deadline.Equal(deadline) || !m2.CtxDeadline.Equal(deadline) {
+		t.Fatalf("expected deadline %v, got: %#v", deadline, m2)
+	}
+}
+
+func TestCallH(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_call_h",
+		"testdata/tmeta_plugin_main.go.txt")
+	h.EnableCache("meta", time.Minute, 0)
+
+	m, handle, err := plugger.CallH[struct{}, MetaResp](
+		t.Context(), h, "meta", struct{}{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if handle.ID() == "" || handle.ID() != m.ID || handle.Cached() {
+		t.Fatalf("unexpected handle %#v for request %q", handle, m.ID)
+	}
+
+	_, handle, err = plugger.CallH[struct{}, MetaResp](
+		t.Context(), h, "meta", struct{}{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if handle.ID() != "" || !handle.Cached() {
+		t.Fatalf("expected cached response, got handle %#v", handle)
+	}
+}
+
+func TestCallRawReq(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_call_raw_req",
+		"testdata/t1_plugin_main.go.txt")
+
+	resp, err := plugger.CallRawReq[AddResp](
+		t.Context(), h, "add", json.RawMessage(`{"a":2,"b":3}`),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.Sum != 5 {
+		t.Fatalf("unexpected sum: %d", resp.Sum)
+	}
+
+	_, err = plugger.CallRawReq[struct{}](
+		t.Context(), h, "simulated_error", json.RawMessage(`{}`),
+	)
+	if !errors.Is(err, plugger.ErrorResponse("simulated error")) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = plugger.CallRawReq[AddResp](
+		t.Context(), h, "add", json.RawMessage(`{"a":`),
+	)
+	if err == nil || err.Error() != "marshaling request: invalid JSON" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestWithHeaders(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_with_headers",
+		"testdata/tmeta_plugin_main.go.txt")
+	h.EnableCache("meta", time.Minute, 0)
+
+	headers := map[string]string{"route": "eu-1", "auth": "token"}
+	for range 2 {
+		m, handle, err := plugger.CallH[struct{}, MetaResp](
+			t.Context(), h, "meta", struct{}{}, plugger.WithHeaders(headers))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !maps.Equal(m.Headers, headers) {
+			t.Fatalf("expected headers %v, got %v", headers, m.Headers)
+		}
+		if handle.Cached() {
+			t.Fatal("calls with headers must not be cached")
+		}
+	}
+
+	m, err := plugger.Call[struct{}, MetaResp](t.Context(), h, "meta", struct{}{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m.Headers != nil {
+		t.Fatalf("expected no headers, got %v", m.Headers)
+	}
+}
+
+func TestContextEnvMapping(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("not supported on windows")
+	}
+	type ctxKeyTraceID struct{}
+	ctx := context.WithValue(t.Context(), ctxKeyTraceID{}, "trace-42")
+
+	h := plugger.NewHost()
+	go func() {
+		_ = h.RunPlugin(ctx, "testdata/test_executable.sh",
+			pluggertest.NewLogWriter(t),
+			plugger.WithContextEnvMapping(map[any]string{
+				ctxKeyTraceID{}: "TRACE_ID",
+				"missing":       "MISSING",
+			}))
+	}()
+	defer func() { _ = h.Close() }()
+
+	for name, expect := range map[string]string{
+		"TRACE_ID": "trace-42",
+		"MISSING":  "",
+	} {
+		v, err := plugger.Call[string, string](t.Context(), h, "env", name)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if v != expect {
+			t.Fatalf("expected %s=%q, got %q", name, expect, v)
+		}
+	}
+}
+
+func TestLauncherPrefix(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("not supported on windows")
+	}
+	h := plugger.NewHost()
+	var spawned []string
+	h.OnSpawn(func(_ context.Context, _ plugger.SpawnKind, cmd string, args []string) {
+		spawned = append([]string{filepath.Base(cmd)}, args...)
+	})
+	go func() {
+		_ = h.RunPlugin(t.Context(), "testdata/test_executable.sh",
+			pluggertest.NewLogWriter(t),
+			plugger.WithLauncherPrefix([]string{"env", "PREFIXED=yes"}))
+	}()
+	defer func() { _ = h.Close() }()
+
+	v, err := plugger.Call[string, string](t.Context(), h, "env", "PREFIXED")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if v != "yes" {
+		t.Fatalf("expected PREFIXED=yes, got %q", v)
+	}
+	expect := []string{"env", "PREFIXED=yes", "testdata/test_executable.sh"}
+	if !slices.Equal(spawned, expect) {
+		t.Fatalf("unexpected spawned command: %q", spawned)
+	}
+}
+
+func TestUncalledMethods(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_uncalled_methods",
+		"testdata/tmeta_plugin_main.go.txt")
+
+	uncalled, err := plugger.Call[struct{}, []string](
+		t.Context(), h, "uncalled", struct{}{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []string{"meta", "unused"}; !slices.Equal(uncalled, want) {
+		t.Fatalf("expected %v, got %v", want, uncalled)
+	}
+
+	if _, err := plugger.Call[struct{}, MetaResp](
+		t.Context(), h, "meta", struct{}{},
+	); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	uncalled, err = plugger.Call[struct{}, []string](
+		t.Context(), h, "uncalled", struct{}{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []string{"unused"}; !slices.Equal(uncalled, want) {
+		t.Fatalf("expected %v, got %v", want, uncalled)
+	}
+}
+
+func TestUncalledMethodsUntracked(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected UncalledMethods to panic")
+		}
+	}()
+	plugger.NewPlugin().UncalledMethods()
+}
+
+func TestStdio(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("not supported on windows")
+	}
+	f := pluggertest.MakeModule(t, "test_stdio", "testdata/tstdio_plugin_main.go.txt")
+	h := plugger.NewHost()
+	var stdout syncBuffer
+	errs := make(chan error, 1)
+	go func() {
+		errs <- h.RunPlugin(t.Context(), f, pluggertest.NewLogWriter(t),
+			plugger.WithStdio(strings.NewReader("hello\n"), &stdout))
+	}()
+
+	line, err := plugger.Call[struct{}, string](
+		t.Context(), h, "read_line", struct{}{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if line != "hello\n" {
+		t.Fatalf("unexpected line: %q", line)
+	}
+	if _, err := plugger.Call[string, struct{}](
+		t.Context(), h, "print", "world",
+	); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := h.Close(); err != nil {
+		t.Fatalf("closing host: %v", err)
+	}
+	if err := <-errs; err != nil && !errors.Is(err, io.EOF) {
+		t.Fatalf("RunPlugin error: %v", err)
+	}
+	if s := stdout.String(); s != "world\n" {
+		t.Fatalf("unexpected stdout: %q", s)
+	}
+}
+
+func TestRestartRetry(t *testing.T) {
+	f := pluggertest.MakeModule(t, "test_restart_retry",
+		"testdata/tcrash_plugin_main.go.txt")
+	h := plugger.NewHost()
+	h.Configure(f, plugger.WithStderr(pluggertest.NewLogWriter(t)))
+	t.Cleanup(func() { _ = h.Close() })
+
+	t.Run("no_retry", func(t *testing.T) {
+		marker := filepath.Join(t.TempDir(), "marker")
+		_, err := plugger.Call[string, string](t.Context(), h, "crash_once", marker)
+		if !errors.Is(err, plugger.ErrClosed) {
+			t.Fatalf("expected ErrClosed, got: %v", err)
+		}
+	})
+
+	t.Run("retry", func(t *testing.T) {
+		marker := filepath.Join(t.TempDir(), "marker")
+		resp, err := plugger.Call[string, string](
+			t.Context(), h, "crash_once", marker, plugger.WithRestartRetry(1),
+		)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if resp != "ok" {
+			t.Fatalf("unexpected response: %q", resp)
+		}
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		const timeout = 500 * time.Millisecond
+		ctx, cancel := context.WithTimeout(t.Context(), timeout)
+		defer cancel()
+		start := time.Now()
+		_, err := plugger.Call[struct{}, struct{}](
+			ctx, h, "crash_slowly", struct{}{}, plugger.WithRestartRetry(100),
+		)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected DeadlineExceeded, got: %v", err)
+		}
+		if d := time.Since(start); d > timeout+time.Second {
+			t.Fatalf("retries exceeded the deadline: %v", d)
+		}
+	})
+}
+
+func TestStartFailed(t *testing.T) {
+	h := plugger.NewHost()
+	t.Cleanup(func() { _ = h.Close() })
+
+	// The call waits for the plugin to start.
+	errs := make(chan error, 1)
+	go func() {
+		_, err := plugger.Call[AddReq, AddResp](t.Context(), h, "add", AddReq{})
+		errs <- err
+	}()
+	err := h.RunPlugin(t.Context(), filepath.Join(t.TempDir(), "nonexistent"), nil)
+	if !errors.Is(err, plugger.ErrInvalidPluginPath) {
+		t.Fatalf("expected ErrInvalidPluginPath, got: %v", err)
+	}
+	select {
+	case err := <-errs:
+		if !errors.Is(err, plugger.ErrStartFailed) ||
+			!errors.Is(err, plugger.ErrInvalidPluginPath) {
+			t.Fatalf("expected ErrStartFailed, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("call blocked after the plugin failed to start")
+	}
+}
+
+func TestRunPluginRetry(t *testing.T) {
+	modDir := pluggertest.MakeModule(t, "test_run_plugin_retry",
+		"testdata/t1_plugin_main.go.txt")
+	h := plugger.NewHost()
+	t.Cleanup(func() { _ = h.Close() })
+
+	err := h.RunPlugin(t.Context(), filepath.Join(modDir, "nonexistent"), nil)
+	if !errors.Is(err, plugger.ErrInvalidPluginPath) {
+		t.Fatalf("expected ErrInvalidPluginPath, got: %v", err)
+	}
+	_, err = plugger.Call[AddReq, AddResp](t.Context(), h, "add", AddReq{})
+	if !errors.Is(err, plugger.ErrClosed) {
+		t.Fatalf("expected ErrClosed, got: %v", err)
+	}
+	if !errors.Is(err, plugger.ErrStartFailed) ||
+		!errors.Is(err, plugger.ErrInvalidPluginPath) {
+		t.Fatalf("expected ErrStartFailed, got: %v", err)
+	}
+
+	// Retry concurrently, only one attempt may launch the plugin.
+	errs := make(chan error, 2)
+	for range 2 {
+		go func() { errs <- h.RunPlugin(t.Context(), modDir, pluggertest.NewLogWriter(t)) }()
+	}
+	if err := <-errs; !errors.Is(err, plugger.ErrAlreadyRunning) {
+		t.Fatalf("expected ErrAlreadyRunning, got: %v", err)
+	}
+	testPlugin(t, h)
+	if err := h.Close(); err != nil {
+		t.Fatalf("closing host: %v", err)
+	}
+	if err := <-errs; err != nil && !errors.Is(err, io.EOF) {
+		t.Fatalf("RunPlugin error: %v", err)
+	}
+}
+
+func TestSetExitCode(t *testing.T) {
+	bin := pluggertest.BuildModule(t, "test_exit_code", "testdata/t1_plugin_main.go.txt")
+	h := plugger.NewHost()
+	h.Configure(bin, plugger.WithStderr(pluggertest.NewLogWriter(t)))
+	_, err := plugger.Call[int, struct{}](t.Context(), h, "set_exit_code", 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var exitErr *exec.ExitError
+	if err := h.Close(); !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Fatalf("expected exit code 3, got: %v", err)
+	}
+}
+
 type AddReq struct {
 	A int `json:"a"`
 	B int `json:"b"`
@@ -205,6 +1400,12 @@ func testPlugin(t *testing.T, h *plugger.Host) {
 		t.Fatalf("unexpected error message: %q", msg)
 	}
 
+	// Empty method name.
+	_, err = plugger.Call[AddReq, AddResp](t.Context(), h, "", AddReq{A: 1, B: 1})
+	if !errors.Is(err, plugger.ErrEmptyMethod) {
+		t.Fatalf("expected ErrEmptyMethod, got: %v", err)
+	}
+
 	// Malformed payload (string where an int is expected).
 	_, err = plugger.Call[MalformedReq, AddResp](
 		t.Context(), h, "add", MalformedReq{A: "2", B: 3},
@@ -224,49 +1425,148 @@ func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
 
-func launchLocalModule(
-	t *testing.T, ctx context.Context, testDirName, mainFilePath string,
-) (*plugger.Host, *logWriter) {
-	// Absolute path to the plugger source directory (this package).
-	_, thisFile, _, _ := runtime.Caller(0)
-	pluggerDir := filepath.Dir(thisFile)
-
-	// Create a tiny plugin module in temp dir.
-	modDir := filepath.Join(t.TempDir(), testDirName)
-	t.Logf("mod-dir: %s", modDir)
-	if err := os.MkdirAll(modDir, 0o777); err != nil {
+func TestDispatchEmptyMethod(t *testing.T) {
+	bin := pluggertest.BuildModule(t, "test_dispatch_empty_method",
+		"testdata/t1_plugin_main.go.txt")
+	// The host rejects empty method names, so talk to the plugin directly.
+	cmd := exec.Command(bin)
+	cmd.Stderr = pluggertest.NewLogWriter(t)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
 		t.Fatal(err)
 	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("starting plugin: %v", err)
+	}
+	defer func() {
+		_ = stdin.Close()
+		_ = cmd.Wait()
+	}()
 
-	// go.mod with replace lets the plugin import local "plugger"
-	writeFile(t, filepath.Join(modDir, "go.mod"), fmt.Sprintf(`
-		module exampleplugin
-		go 1.25
+	if _, err := io.WriteString(stdin, `{"id":"1","method":""}`+"\n"); err != nil {
+		t.Fatalf("writing request: %v", err)
+	}
+	out, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading response: %v", err)
+	}
+	const expect = `{"id":"1","err":"empty method name"}` + "\n"
+	if out != expect {
+		t.Fatalf("expected response %q, got %q", expect, out)
+	}
+}
 
-		require github.com/romshark/plugger v0.0.0
-		replace github.com/romshark/plugger => %s
-	`, pluggerDir))
+func TestDispatchCanceledResponse(t *testing.T) {
+	events := make(chan plugger.PluginEvent, 16)
+	release := make(chan struct{})
+	base, cancelBase := context.WithCancel(t.Context())
+	defer cancelBase()
+	conn := pluggertest.Serve(t, func(p *plugger.Plugin) {
+		p.SetContext(base)
+		// Ignores cancelation.
+		plugger.Handle(p, "slow", func(context.Context, struct{}) (string, error) {
+			<-release
+			return "done", nil
+		})
+	}, plugger.WithPluginEvents(func(e plugger.PluginEvent) { events <- e }))
+	await := func(kind plugger.PluginEventKind) {
+		t.Helper()
+		for e := range events {
+			if e.Kind == kind {
+				return
+			}
+		}
+	}
 
-	// plugin main.go
-	mainFileContents := readFile(t, mainFilePath)
-	writeFile(t, filepath.Join(modDir, "main.go"), mainFileContents)
+	// Responses to requests canceled by the host are dropped.
+	conn.Send(`{"id":"1","method":"slow","data":{}}`)
+	await(plugger.EventReceived)
+	conn.Send(`{"cancel":"1"}`)
+	await(plugger.EventCanceled)
+	release <- struct{}{}
+	await(plugger.EventDone)
+	conn.Send(`{"id":"2","method":"__echo","data":"ok"}`)
+	if resp := string(conn.Receive()); resp != `{"id":"2","data":"ok"}` {
+		t.Fatalf("unexpected response: %s", resp)
+	}
 
-	// Launch host and plugin.
-	h := plugger.NewHost()
-	logWriter := newLogWriter(t)
-	go func() {
-		err := h.RunPlugin(ctx, modDir, logWriter)
-		if err != nil && !errors.Is(err, io.EOF) {
-			t.Errorf("RunPlugin error: %v", err)
-		}
-	}()
+	// Responses to requests canceled by stopping Run are sent.
+	conn.Send(`{"id":"3","method":"slow","data":{}}`)
+	await(plugger.EventReceived)
+	cancelBase()
+	release <- struct{}{}
+	if resp := string(conn.Receive()); resp != `{"id":"3","data":"done"}` {
+		t.Fatalf("unexpected response: %s", resp)
+	}
+}
 
-	t.Cleanup(func() {
-		// Cleanup.
-		if err := h.Close(); err != nil {
-			t.Fatalf("closing host: %v", err)
+func TestStrictProtocol(t *testing.T) {
+	bin := pluggertest.BuildModule(t, "test_strict_protocol",
+		"testdata/tlenient_plugin_main.go.txt")
+	// Malformed envelopes can't be sent through a host.
+	const malformed = `{"method":"echo","data":"no id"}` + "\n" + // No ID.
+		`{"id":"1",` + "\n" // Not a single envelope.
+
+	t.Run("lenient", func(t *testing.T) {
+		cmd := exec.Command(bin)
+		stderr := new(syncBuffer)
+		cmd.Stderr = stderr
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("starting plugin: %v", err)
+		}
+		_, err = io.WriteString(stdin,
+			malformed+`{"id":"2","method":"echo","data":"ok"}`+"\n")
+		if err != nil {
+			t.Fatalf("writing requests: %v", err)
+		}
+		out, err := bufio.NewReader(stdout).ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading response: %v", err)
+		}
+		const expect = `{"id":"2","data":"ok"}` + "\n"
+		if out != expect {
+			t.Fatalf("expected response %q, got %q", expect, out)
+		}
+		_ = stdin.Close()
+		if err := cmd.Wait(); err != nil {
+			t.Fatalf("unexpected exit: %v", err)
+		}
+		for _, msg := range []string{
+			`plugger: skipping malformed envelope: both "id" and "cancel" empty`,
+			`plugger: skipping malformed envelope: invalid NDJSON frame`,
+		} {
+			if !strings.Contains(stderr.String(), msg) {
+				t.Fatalf("expected %q in stderr: %q", msg, stderr.String())
+			}
 		}
 	})
 
-	return h, logWriter
+	t.Run("strict", func(t *testing.T) {
+		cmd := exec.Command(bin)
+		cmd.Env = append(os.Environ(), "TEST_STRICT_PROTOCOL=1")
+		stderr := new(syncBuffer)
+		cmd.Stderr = stderr
+		cmd.Stdin = strings.NewReader(malformed)
+		err := cmd.Run()
+		var errExit *exec.ExitError
+		if !errors.As(err, &errExit) {
+			t.Fatalf("expected the plugin to crash, got: %v", err)
+		}
+		const msg = `protocol violation: both "id" and "cancel" empty`
+		if !strings.Contains(stderr.String(), msg) {
+			t.Fatalf("expected %q in stderr: %q", msg, stderr.String())
+		}
+	})
 }
@@ -0,0 +1,154 @@
+// Package pluggertest provides utilities for testing plugins
+// and hosts built with plugger.
+package pluggertest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/romshark/plugger"
+)
+
+// MakeModule creates the plugin module name in a temp directory with
+// the contents of mainFile as its main.go and returns the path to it.
+// The module requires plugger replaced by the source directory this
+// package was compiled from, so mainFile can import plugger without
+// network access and is tested against the same version as the host.
+func MakeModule(t testing.TB, name, mainFile string) string {
+	t.Helper()
+	// Absolute path to the plugger source directory (parent of this package).
+	_, thisFile, _, ok := runtime.Caller(0)
+	if !ok || !filepath.IsAbs(thisFile) {
+		t.Fatal("plugger source directory unknown, " +
+			"the test binary must be built without -trimpath")
+	}
+	pluggerDir := filepath.Dir(filepath.Dir(thisFile))
+	if _, err := os.Stat(filepath.Join(pluggerDir, "go.mod")); err != nil {
+		t.Fatalf("plugger source directory %s without go.mod: %v", pluggerDir, err)
+	}
+
+	main, err := os.ReadFile(mainFile)
+	if err != nil {
+		t.Fatalf("reading main file: %v", err)
+	}
+
+	modDir := filepath.Join(t.TempDir(), name)
+	t.Logf("mod-dir: %s", modDir)
+	if err := os.MkdirAll(modDir, 0o777); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(modDir, "go.mod"), fmt.Sprintf(`
+		module exampleplugin
+		go 1.25
+
+		require github.com/romshark/plugger v0.0.0
+		replace github.com/romshark/plugger => %s
+	`, pluggerDir))
+	writeFile(t, filepath.Join(modDir, "main.go"), string(main))
+	return modDir
+}
+
+// BuildModule is like MakeModule but also compiles the module
+// and returns the path to the executable instead.
+func BuildModule(t testing.TB, name, mainFile string) string {
+	t.Helper()
+	modDir := MakeModule(t, name, mainFile)
+	bin := filepath.Join(t.TempDir(), name)
+	if runtime.GOOS == "windows" {
+		bin += ".exe"
+	}
+	cmd := exec.Command("go", "build", "-o", bin, ".")
+	cmd.Dir = modDir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("building plugin: %v\n%s", err, out)
+	}
+	return bin
+}
+
+// Launch creates the plugin module like MakeModule and runs it on a new
+// host, which is closed when the test completes. The plugin's stderr is
+// written to the returned LogWriter. The test fails if RunPlugin fails
+// with an error other than io.EOF. Calls wait for the plugin to start.
+func Launch(
+	t testing.TB, ctx context.Context, name, mainFile string,
+	opts ...plugger.RunOption,
+) (*plugger.Host, *LogWriter) {
+	t.Helper()
+	modDir := MakeModule(t, name, mainFile)
+
+	h := plugger.NewHost()
+	logWriter := NewLogWriter(t)
+	go func() {
+		err := h.RunPlugin(ctx, modDir, logWriter, opts...)
+		if err != nil && !errors.Is(err, io.EOF) {
+			t.Errorf("RunPlugin error: %v", err)
+		}
+	}()
+
+	t.Cleanup(func() {
+		if err := h.Close(); err != nil {
+			t.Fatalf("closing host: %v", err)
+		}
+	})
+
+	return h, logWriter
+}
+
+// LogWriter is a plugin stderr sink writing to the test log.
+// Readers added with AddReader receive every write as well.
+type LogWriter struct {
+	t         testing.TB
+	lock      sync.Mutex
+	listeners []chan<- string
+}
+
+var _ io.WriteCloser = new(LogWriter)
+
+// NewLogWriter creates a LogWriter writing to the log of t.
+func NewLogWriter(t testing.TB) *LogWriter { return &LogWriter{t: t} }
+
+// AddReader makes all subsequent writes also be sent to c,
+// which is closed once the writer is closed.
+// Writes block until c receives.
+func (w *LogWriter) AddReader(c chan<- string) {
+	w.lock.Lock()
+	w.listeners = append(w.listeners, c)
+	w.lock.Unlock()
+}
+
+func (w *LogWriter) Write(b []byte) (int, error) {
+	w.lock.Lock()
+	m := string(b)
+	for _, l := range w.listeners {
+		l <- m
+	}
+	w.t.Log(m)
+	w.lock.Unlock()
+	return len(b), nil
+}
+
+// Close closes all readers.
+func (w *LogWriter) Close() error {
+	w.lock.Lock()
+	for _, l := range w.listeners {
+		close(l)
+	}
+	w.lock.Unlock()
+	return nil
+}
+
+func writeFile(t testing.TB, name, body string) {
+	err := os.WriteFile(name, []byte(strings.TrimSpace(body)+"\n"), 0o777)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
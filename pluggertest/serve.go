@@ -0,0 +1,88 @@
+package pluggertest
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/romshark/plugger"
+)
+
+// Conn is the host side of a plugin served by Serve speaking
+// the protocol directly.
+type Conn struct {
+	t         testing.TB
+	requests  *io.PipeWriter
+	responses chan json.RawMessage
+}
+
+// Serve runs a plugin in-process, which makes tests independent of
+// process startup and allows observing the plugin, for example with
+// plugger.WithPluginEvents. register registers the plugin's endpoints.
+// The plugin is stopped once the test completes.
+func Serve(
+	t testing.TB, register func(p *plugger.Plugin), opts ...plugger.PluginOption,
+) *Conn {
+	t.Helper()
+	reqR, reqW := io.Pipe()
+	respR, respW := io.Pipe()
+	p := plugger.NewPlugin(append(opts, plugger.WithPluginIO(reqR, respW))...)
+	register(p)
+
+	c := &Conn{t: t, requests: reqW, responses: make(chan json.RawMessage, 64)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer respW.Close()
+		if code := p.Run(context.Background()); code != 0 {
+			t.Errorf("plugin exited with code %d", code)
+		}
+	}()
+	go func() {
+		defer close(c.responses)
+		s := bufio.NewScanner(respR)
+		s.Buffer(nil, 64<<20)
+		for s.Scan() {
+			c.responses <- json.RawMessage(s.Text())
+		}
+	}()
+	t.Cleanup(func() {
+		_ = reqW.Close() // Stops the plugin.
+		go func() {
+			for range c.responses { // Unblock the plugin.
+			}
+		}()
+		<-done
+	})
+	return c
+}
+
+// Send writes a single envelope to the plugin,
+// for example `{"id":"1","method":"add","data":{"a":1,"b":2}}`.
+// Fails the test if the plugin stopped.
+func (c *Conn) Send(envelope string) {
+	c.t.Helper()
+	if _, err := io.WriteString(c.requests, envelope+"\n"); err != nil {
+		c.t.Fatalf("sending envelope: %v", err)
+	}
+}
+
+// Receive returns the next envelope written by the plugin.
+// Fails the test if the plugin stopped or didn't write
+// an envelope within 10 seconds.
+func (c *Conn) Receive() json.RawMessage {
+	c.t.Helper()
+	select {
+	case ev, ok := <-c.responses:
+		if !ok {
+			c.t.Fatal("plugin stopped")
+		}
+		return ev
+	case <-time.After(10 * time.Second):
+		c.t.Fatal("timed out awaiting envelope")
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package plugger
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// WithPrebuilt runs the executable at path instead of building the Go
+// plugin passed to RunPlugin if it exists, for example a binary built
+// when packaging the host. This lets plugins run where the go toolchain
+// isn't available. The plugin falls back to being built from source if
+// there's no executable at path, in which case the go toolchain is
+// required and the error names both the plugin and path if it's missing.
+// The plugin is reported as SpawnExecutable when running path.
+func WithPrebuilt(path string) RunOption {
+	return func(c *runConfig) { c.prebuilt = path }
+}
+
+// spawnPrebuilt is like spawn but prefers the executable configured
+// with WithPrebuilt.
+func spawnPrebuilt(cfg *runConfig) (
+	cmd *exec.Cmd, kind SpawnKind, module string, err error,
+) {
+	if cfg.prebuilt == "" {
+		return spawn(cfg.plugin)
+	}
+	if isExecutable(cfg.prebuilt) {
+		return exec.Command(cfg.prebuilt), SpawnExecutable, "", nil
+	}
+	cmd, kind, module, err = spawn(cfg.plugin)
+	if err != nil {
+		return nil, 0, "", fmt.Errorf(
+			"prebuilt plugin %q not found, running %q: %w",
+			cfg.prebuilt, cfg.plugin, err,
+		)
+	}
+	return cmd, kind, module, nil
+}
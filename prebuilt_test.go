@@ -0,0 +1,59 @@
+package plugger_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/romshark/plugger"
+	"github.com/romshark/plugger/pluggertest"
+)
+
+func TestPrebuilt(t *testing.T) {
+	src := pluggertest.MakeModule(t, "test_prebuilt", "testdata/t1_plugin_main.go.txt")
+	bin := pluggertest.BuildModule(t, "test_prebuilt", "testdata/t1_plugin_main.go.txt")
+	missing := filepath.Join(t.TempDir(), "missing")
+
+	t.Run("prebuilt", func(t *testing.T) {
+		t.Setenv("PATH", "") // No go toolchain.
+		h := plugger.NewHost()
+		var kinds []plugger.SpawnKind
+		h.OnSpawn(func(_ context.Context, kind plugger.SpawnKind, _ string, _ []string) {
+			kinds = append(kinds, kind)
+		})
+		go func() {
+			_ = h.RunPlugin(t.Context(), src, pluggertest.NewLogWriter(t),
+				plugger.WithPrebuilt(bin))
+		}()
+		defer func() { _ = h.Close() }()
+		testPlugin(t, h)
+		if len(kinds) != 1 || kinds[0] != plugger.SpawnExecutable {
+			t.Fatalf("unexpected spawn kinds: %v", kinds)
+		}
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		h := plugger.NewHost()
+		go func() {
+			_ = h.RunPlugin(t.Context(), src, pluggertest.NewLogWriter(t),
+				plugger.WithPrebuilt(missing))
+		}()
+		defer func() { _ = h.Close() }()
+		testPlugin(t, h)
+	})
+
+	t.Run("neither", func(t *testing.T) {
+		t.Setenv("PATH", "")
+		h := plugger.NewHost()
+		err := h.RunPlugin(t.Context(), filepath.Join(src, "main.go"),
+			pluggertest.NewLogWriter(t), plugger.WithPrebuilt(missing))
+		if !errors.Is(err, plugger.ErrGoToolchainNotFound) {
+			t.Fatalf("expected ErrGoToolchainNotFound, got: %v", err)
+		}
+		if !strings.Contains(err.Error(), missing) {
+			t.Fatalf("error doesn't name the prebuilt path: %v", err)
+		}
+	})
+}
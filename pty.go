@@ -0,0 +1,30 @@
+package plugger
+
+import "os"
+
+// WithPTY connects the plugin's stdin and stdout to a pseudo-terminal
+// for plugins that behave differently when attached to a terminal,
+// such as interactive command line tools. Like with WithStdio, the
+// protocol moves to a pair of pipes, so plugins must be built with this
+// package or read the PLUGGER_PROTOCOL_FDS environment variable.
+// WithPTY takes precedence over WithStdio. The terminal is available
+// through Host.PTY. Only supported on Linux and macOS, RunPlugin returns
+// ErrPTYUnsupported elsewhere.
+func WithPTY() RunOption {
+	return func(c *runConfig) { c.pty = true }
+}
+
+// PTY returns the controlling side of the pseudo-terminal of a plugin
+// launched with WithPTY, nil if the plugin isn't running or wasn't launched
+// with WithPTY. Reading it returns the plugin's terminal output and
+// writing it sends input. The terminal must be read, otherwise the plugin
+// blocks writing to it once its buffer is full. The file is closed
+// once the plugin exited.
+func (h *Host) PTY() *os.File {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.proc == nil {
+		return nil
+	}
+	return h.proc.pty
+}
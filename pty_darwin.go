@@ -0,0 +1,36 @@
+package plugger
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// openPTY opens a pseudo-terminal returning its controlling side
+// and the terminal.
+func openPTY() (pty, tty *os.File, err error) {
+	pty, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening pty: %w", err)
+	}
+	name := make([]byte, 128)
+	if err = ioctl(pty.Fd(), syscall.TIOCPTYGRANT, 0); err == nil {
+		err = ioctl(pty.Fd(), syscall.TIOCPTYUNLK, 0)
+	}
+	if err == nil {
+		err = ioctl(pty.Fd(), syscall.TIOCPTYGNAME, uintptr(unsafe.Pointer(&name[0])))
+	}
+	if err == nil {
+		if i := bytes.IndexByte(name, 0); i >= 0 {
+			name = name[:i]
+		}
+		tty, err = os.OpenFile(string(name), os.O_RDWR|syscall.O_NOCTTY, 0)
+	}
+	if err != nil {
+		_ = pty.Close()
+		return nil, nil, fmt.Errorf("opening pty: %w", err)
+	}
+	return pty, tty, nil
+}
@@ -0,0 +1,33 @@
+package plugger
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// openPTY opens a pseudo-terminal returning its controlling side
+// and the terminal.
+func openPTY() (pty, tty *os.File, err error) {
+	pty, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening pty: %w", err)
+	}
+	var n uint32
+	var unlock int32
+	if err = ioctl(pty.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err == nil {
+		err = ioctl(pty.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock)))
+	}
+	if err == nil {
+		tty, err = os.OpenFile(
+			"/dev/pts/"+strconv.Itoa(int(n)), os.O_RDWR|syscall.O_NOCTTY, 0,
+		)
+	}
+	if err != nil {
+		_ = pty.Close()
+		return nil, nil, fmt.Errorf("opening pty: %w", err)
+	}
+	return pty, tty, nil
+}
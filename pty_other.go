@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+
+package plugger
+
+import (
+	"os"
+	"os/exec"
+)
+
+func openPTY() (pty, tty *os.File, err error) {
+	return nil, nil, ErrPTYUnsupported
+}
+
+func setControllingTTY(*exec.Cmd) {}
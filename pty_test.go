@@ -0,0 +1,42 @@
+package plugger_test
+
+import (
+	"bufio"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/romshark/plugger"
+	"github.com/romshark/plugger/pluggertest"
+)
+
+func TestPTY(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("not supported on " + runtime.GOOS)
+	}
+	f := pluggertest.MakeModule(t, "test_pty", "testdata/tpty_plugin_main.go.txt")
+	h := plugger.NewHost()
+	h.Configure(f, plugger.WithStderr(pluggertest.NewLogWriter(t)), plugger.WithPTY())
+	defer func() { _ = h.Close() }()
+
+	if h.PTY() != nil {
+		t.Fatal("expected no terminal before launch")
+	}
+	if _, err := plugger.Call[string, struct{}](
+		t.Context(), h, "print", "hello terminal",
+	); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pty := h.PTY()
+	if pty == nil {
+		t.Fatal("expected a terminal")
+	}
+	line, err := bufio.NewReader(pty).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading terminal: %v", err)
+	}
+	// Terminals translate "\n" to "\r\n".
+	if line = strings.TrimRight(line, "\r\n"); line != "hello terminal" {
+		t.Fatalf("unexpected terminal output: %q", line)
+	}
+}
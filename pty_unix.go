@@ -0,0 +1,21 @@
+//go:build linux || darwin
+
+package plugger
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setControllingTTY makes the terminal connected to cmd's stdin
+// the controlling terminal of cmd in a new session.
+func setControllingTTY(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+}
+
+func ioctl(fd, req, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package plugger
+
+import "context"
+
+// ctxKeyLaunch marks contexts passed to code running while the plugin
+// is being launched: the OnSpawn and OnStartupProgress callbacks and
+// host handlers serving calls the plugin makes during the launch, for
+// example from the init call (see SetInitCall and HandleHost).
+type ctxKeyLaunch struct{}
+
+// launchContext returns ctx marked as blocking the launch of the plugin.
+func launchContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxKeyLaunch{}, true)
+}
+
+// reentrant reports whether a call made with ctx would wait for the
+// launch of the plugin it's blocking. No plugin is running while a launch
+// callback or a host handler serving the launching plugin runs, so any
+// call made with their context would wait for the launch.
+func reentrant(ctx context.Context) bool {
+	return ctx.Value(ctxKeyLaunch{}) != nil
+}
@@ -0,0 +1,111 @@
+package plugger
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+)
+
+// RestartPolicy defines how RunPlugin relaunches a plugin that exited
+// unexpectedly, see WithRestart.
+type RestartPolicy struct {
+	// MaxRestarts is the number of times the plugin is relaunched.
+	MaxRestarts int
+	// Backoff is the delay before the first relaunch, which is doubled
+	// for every further relaunch. Defaults to 100 milliseconds.
+	Backoff time.Duration
+	// MaxBackoff limits the delay, unlimited if zero.
+	MaxBackoff time.Duration
+}
+
+// backoff returns the delay before relaunch n (0-based).
+func (r *RestartPolicy) backoff(n int) time.Duration {
+	d, limit := r.Backoff, r.MaxBackoff
+	if d <= 0 {
+		d = 100 * time.Millisecond
+	}
+	if limit <= 0 {
+		limit = math.MaxInt64
+	}
+	for range n {
+		if d > limit/2 { // Doubling would exceed the limit or overflow.
+			return limit
+		}
+		d *= 2
+	}
+	return min(d, limit)
+}
+
+// WithRestart makes RunPlugin relaunch the plugin according to policy
+// if it exits before the host is closed or ctx is canceled, for example
+// due to a crash. Calls in progress fail with an error wrapping ErrClosed,
+// which WithRestartRetry retries, calls made while the plugin is
+// relaunched wait for it. RunPlugin returns once the plugin exited
+// and won't be relaunched. Closing the host stops relaunching.
+// Configure panics if passed WithRestart, since lazily launched plugins
+// are relaunched by the next call anyway.
+func WithRestart(policy RestartPolicy) RunOption {
+	return func(c *runConfig) { c.restart = &policy }
+}
+
+// detachExited makes calls wait for the relaunch of p if it exited
+// unexpectedly and is relaunched, see RunPlugin.
+func (h *Host) detachExited(ctx context.Context, p *process, err error) {
+	if !p.restart || ctx.Err() != nil || errors.Is(err, ErrHandedOff) {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if !h.closed && h.proc == p { // Not closed by Close or the idle timeout.
+		h.proc, h.restarted = nil, make(chan struct{})
+	}
+}
+
+// relaunching reports whether the plugin is about to be relaunched.
+func (h *Host) relaunching() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.restarted != nil
+}
+
+// relaunch launches the plugin again after the backoff of relaunch n
+// and wakes up the calls waiting for it.
+// Returns ErrClosed if the host was closed in the meantime.
+func (h *Host) relaunch(ctx context.Context, cfg *runConfig, n int) (*process, error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	h.lock.Lock()
+	closed := h.closed
+	h.stopRestart = cancel
+	h.lock.Unlock()
+	defer func() {
+		h.lock.Lock()
+		close(h.restarted)
+		h.restarted, h.stopRestart = nil, nil
+		h.lock.Unlock()
+		cancel(nil)
+	}()
+	if closed {
+		return nil, ErrClosed
+	}
+	t := time.NewTimer(cfg.restart.backoff(n))
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+		return nil, causeErr(ctx)
+	}
+	h.launchLock.Lock()
+	defer h.launchLock.Unlock()
+	p, err := h.launch(ctx, cfg)
+	if err != nil {
+		h.lock.Lock()
+		if h.closed {
+			err = ErrClosed // Close canceled the launch.
+		} else {
+			h.startErr = err
+		}
+		h.lock.Unlock()
+	}
+	return p, err
+}
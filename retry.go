@@ -0,0 +1,79 @@
+package plugger
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// RetryAfter annotates err with a hint telling the host to back off for d
+// before retrying, for example when the plugin is overloaded. The hint is
+// honored by calls using WithRestartRetry and surfaces as RetryAfterError
+// otherwise. Returns nil if err is nil.
+func RetryAfter(d time.Duration, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &retryAfterError{err: err, after: d}
+}
+
+// retryAfterError is an error annotated by RetryAfter.
+type retryAfterError struct {
+	err   error
+	after time.Duration
+}
+
+func (e *retryAfterError) Error() string { return e.err.Error() }
+func (e *retryAfterError) Unwrap() error { return e.err }
+
+// errorRetry returns the retry hint of err in milliseconds to send
+// to the host, 0 if there is none or the host doesn't support it.
+func (p *Plugin) errorRetry(err error) int64 {
+	if !p.hasFeature(FeatureRetryAfter) {
+		return 0
+	}
+	var r *retryAfterError
+	if !errors.As(err, &r) {
+		return 0
+	}
+	return max(r.after.Milliseconds(), 1) // 0 means there is no hint.
+}
+
+// RetryAfterError is returned by calls if the plugin asked the host
+// to back off before retrying (see RetryAfter).
+type RetryAfterError struct {
+	Err   error // ErrorResponse or StackTraceError
+	After time.Duration
+}
+
+func (e *RetryAfterError) Error() string { return e.Err.Error() }
+
+// Unwrap returns the error of the response.
+func (e *RetryAfterError) Unwrap() error { return e.Err }
+
+// RetryAfter returns how long the plugin asked the host to back off.
+func (e *RetryAfterError) RetryAfter() time.Duration { return e.After }
+
+// awaitRetry waits for the back off duration requested by err and reports
+// whether the call should be retried, which is the case if the plugin
+// stopped responding or asked to retry before the deadline of ctx.
+func awaitRetry(ctx context.Context, err error) bool {
+	if errors.Is(err, ErrClosed) {
+		return true
+	}
+	var r *RetryAfterError
+	if !errors.As(err, &r) {
+		return false
+	}
+	if d, ok := ctx.Deadline(); ok && time.Until(d) < r.After {
+		return false // Waiting would exceed the deadline.
+	}
+	t := time.NewTimer(r.After)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
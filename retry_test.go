@@ -0,0 +1,96 @@
+package plugger_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/romshark/plugger"
+	"github.com/romshark/plugger/pluggertest"
+)
+
+func TestRetryAfter(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_retry_after",
+		"testdata/tretry_plugin_main.go.txt")
+
+	// Without retries the hint is returned.
+	_, err := plugger.Call[struct{}, int64](t.Context(), h, "busy", struct{}{})
+	var r *plugger.RetryAfterError
+	if !errors.As(err, &r) {
+		t.Fatalf("expected RetryAfterError, got: %#v", err)
+	}
+	if d := r.RetryAfter(); d != 100*time.Millisecond {
+		t.Fatalf("unexpected retry after: %v", d)
+	}
+	if !errors.Is(err, plugger.ErrorResponse("busy")) {
+		t.Fatalf("expected ErrorResponse, got: %v", err)
+	}
+	if _, err := plugger.Call[struct{}, int64](
+		t.Context(), h, "busy", struct{}{},
+	); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Retries back off.
+	start := time.Now()
+	n, err := plugger.Call[struct{}, int64](
+		t.Context(), h, "busy", struct{}{}, plugger.WithRestartRetry(1),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n != 4 {
+		t.Fatalf("expected call 4 to succeed, got %d", n)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Fatalf("expected the retry to back off, took %v", d)
+	}
+
+	// Backing off would exceed the deadline.
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	_, err = plugger.Call[struct{}, int64](
+		ctx, h, "busy", struct{}{}, plugger.WithRestartRetry(1),
+	)
+	if !errors.As(err, &r) {
+		t.Fatalf("expected RetryAfterError, got: %#v", err)
+	}
+}
+
+func TestRetryAttempts(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_retry_attempts",
+		"testdata/tretry_plugin_main.go.txt")
+	var lock sync.Mutex
+	var attempts []int
+	h.OnCallEnd(func(s plugger.CallStats) {
+		lock.Lock()
+		attempts = append(attempts, s.Attempt)
+		lock.Unlock()
+	})
+
+	n, handle, err := plugger.CallH[struct{}, int64](
+		t.Context(), h, "busy", struct{}{}, plugger.WithRestartRetry(3),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("expected call 2 to succeed, got %d", n)
+	}
+	if a := handle.Attempts(); a != 2 {
+		t.Fatalf("expected 2 attempts, got %d", a)
+	}
+	errs := handle.RetryErrors()
+	var r *plugger.RetryAfterError
+	if len(errs) != 1 || !errors.As(errs[0], &r) {
+		t.Fatalf("unexpected retry errors: %v", errs)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if !slices.Equal(attempts, []int{1, 2}) {
+		t.Fatalf("unexpected attempts: %v", attempts)
+	}
+}
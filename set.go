@@ -0,0 +1,84 @@
+package plugger
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// PluginSet is a named set of hosts closed together in a defined order.
+type PluginSet struct {
+	lock  sync.Mutex
+	names []string // in the order of Add
+	hosts map[string]*Host
+	order []string // set by SetShutdownOrder
+}
+
+// NewPluginSet creates a new empty plugin set.
+func NewPluginSet() *PluginSet {
+	return &PluginSet{hosts: map[string]*Host{}}
+}
+
+// Add adds h to the set under name, replacing any host of the same name.
+func (s *PluginSet) Add(name string, h *Host) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.hosts[name]; !ok {
+		s.names = append(s.names, name)
+	}
+	s.hosts[name] = h
+}
+
+// Host returns the host added under name or nil if there is none.
+func (s *PluginSet) Host(name string) *Host {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.hosts[name]
+}
+
+// SetShutdownOrder sets the order Close closes the hosts in, for example
+// to let a plugin flush its data to another plugin before that one is closed.
+// Hosts not in order are closed afterwards in reverse order of Add.
+// Returns an error if order contains duplicate or unknown names.
+func (s *PluginSet) SetShutdownOrder(order []string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, name := range order {
+		if _, ok := s.hosts[name]; !ok {
+			return fmt.Errorf("unknown plugin: %q", name)
+		}
+		if slices.Contains(order[:i], name) {
+			return fmt.Errorf("duplicate plugin: %q", name)
+		}
+	}
+	s.order = slices.Clone(order)
+	return nil
+}
+
+// Close closes all hosts one after the other in shutdown order
+// (see SetShutdownOrder), each once the previous one was closed.
+// A host failing to close doesn't keep the others from closing,
+// the returned error joins the errors of all hosts.
+func (s *PluginSet) Close() error {
+	s.lock.Lock()
+	order := slices.Clone(s.order)
+	for _, name := range slices.Backward(s.names) {
+		if !slices.Contains(order, name) {
+			order = append(order, name)
+		}
+	}
+	hosts := make([]*Host, len(order))
+	for i, name := range order {
+		hosts[i] = s.hosts[name]
+	}
+	s.lock.Unlock()
+
+	var errs []error
+	for i, h := range hosts {
+		if err := h.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing %q: %w", order[i], err))
+		}
+	}
+	return errors.Join(errs...)
+}
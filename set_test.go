@@ -0,0 +1,72 @@
+package plugger_test
+
+import (
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/romshark/plugger"
+	"github.com/romshark/plugger/pluggertest"
+)
+
+// closeRecorder records which plugin wrote to stderr in which order.
+type closeRecorder struct {
+	lock  sync.Mutex
+	names []string
+}
+
+func (r *closeRecorder) writer(name string) *recorderWriter {
+	return &recorderWriter{r: r, name: name}
+}
+
+type recorderWriter struct {
+	r    *closeRecorder
+	name string
+}
+
+func (w *recorderWriter) Write(b []byte) (int, error) {
+	w.r.lock.Lock()
+	defer w.r.lock.Unlock()
+	if n := len(w.r.names); n == 0 || w.r.names[n-1] != w.name {
+		w.r.names = append(w.r.names, w.name)
+	}
+	return len(b), nil
+}
+
+func TestPluginSetShutdownOrder(t *testing.T) {
+	bin := pluggertest.BuildModule(t, "test_plugin_set_shutdown_order",
+		"testdata/tlifecycle_plugin_main.go.txt")
+
+	var rec closeRecorder
+	s := plugger.NewPluginSet()
+	for _, name := range []string{"storage", "cache", "writer"} {
+		h := plugger.NewHost()
+		go func() {
+			_ = h.RunPlugin(t.Context(), bin, nil,
+				plugger.WithStderr(rec.writer(name)))
+		}()
+		s.Add(name, h)
+		_, err := plugger.Call[struct{}, string](t.Context(), h, "dep", struct{}{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if err := s.SetShutdownOrder([]string{"unknown"}); err == nil {
+		t.Fatal("expected error for unknown plugin")
+	}
+	if err := s.SetShutdownOrder([]string{"writer", "writer"}); err == nil {
+		t.Fatal("expected error for duplicate plugin")
+	}
+	if err := s.SetShutdownOrder([]string{"writer", "storage"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("closing plugin set: %v", err)
+	}
+	// The shutdown hooks write to stderr. Hosts not in the order
+	// are closed last.
+	if expect := []string{"writer", "storage", "cache"}; !slices.Equal(rec.names, expect) {
+		t.Fatalf("expected shutdown order %q, got %q", expect, rec.names)
+	}
+}
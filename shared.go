@@ -0,0 +1,107 @@
+package plugger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// CallShared sends data to an endpoint registered with HandleShared
+// passing it in a temporary file instead of the pipe, which avoids
+// encoding and copying large payloads. The plugin maps the file into
+// memory where supported. The file is removed once the call completed.
+// data is sent inline if the plugin doesn't support FeatureSharedFile.
+// Responses are never cached or coalesced.
+func CallShared[Resp any](
+	ctx context.Context, h *Host, method string, data []byte, opts ...CallOption,
+) (Resp, error) {
+	var zero Resp
+	c := newCallConfig(opts)
+	c.coalesce = false
+	c.shared = data
+	if c.shared == nil {
+		c.shared = []byte{}
+	}
+	resp, err := h.call(ctx, method, nil, c, nil)
+	if err != nil {
+		return zero, err
+	}
+	if err := unmarshal(resp.Data, &zero, h.useNumber.Load()); err != nil {
+		return zero, fmt.Errorf("%w: %w", ErrMalformedResponse, err)
+	}
+	return zero, nil
+}
+
+// sharedRequest returns the request data and the path of the file
+// the data was written to. data is sent inline if p doesn't support
+// shared files. cleanup removes the file.
+func sharedRequest(p *process, data []byte) (
+	raw json.RawMessage, file string, cleanup func(), err error,
+) {
+	p.lock.Lock()
+	supported := p.features.has(FeatureSharedFile)
+	p.lock.Unlock()
+	if !supported {
+		raw, err = json.Marshal(data)
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("marshaling shared data: %w", err)
+		}
+		return raw, "", func() {}, nil
+	}
+	f, err := os.CreateTemp(sharedDir(), "plugger-*")
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("creating shared file: %w", err)
+	}
+	cleanup = func() { _ = os.Remove(f.Name()) }
+	_, err = f.Write(data)
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		cleanup()
+		return nil, "", nil, fmt.Errorf("writing shared file: %w", err)
+	}
+	return nil, f.Name(), cleanup, nil
+}
+
+// sharedDir returns the directory shared files are created in,
+// which is memory backed on Linux.
+func sharedDir() string {
+	if runtime.GOOS == "linux" {
+		if info, err := os.Stat("/dev/shm"); err == nil && info.IsDir() {
+			return "/dev/shm"
+		}
+	}
+	return os.TempDir()
+}
+
+// HandleShared registers an endpoint receiving data sent by CallShared
+// overwriting any existing endpoint. data is only valid until fn returns
+// and must not be modified, since it may be mapped from a file.
+// Must be used before Run is invoked!
+func HandleShared[Resp any](
+	p *Plugin,
+	name string,
+	fn func(ctx context.Context, data []byte) (Resp, error),
+) {
+	p.handle(name, func(
+		ctx context.Context, meta RequestMeta, raw json.RawMessage,
+		_ func(any) error,
+	) (any, error) {
+		if meta.file == "" {
+			var data []byte
+			if err := json.Unmarshal(raw, &data); err != nil {
+				return nil, err
+			}
+			return fn(ctx, data)
+		}
+		data, unmap, err := mapFile(meta.file)
+		if err != nil {
+			return nil, fmt.Errorf("mapping shared file: %w", err)
+		}
+		defer unmap()
+		return fn(ctx, data)
+	})
+}
@@ -0,0 +1,45 @@
+package plugger_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/romshark/plugger"
+	"github.com/romshark/plugger/pluggertest"
+)
+
+func TestCallShared(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_call_shared",
+		"testdata/tshared_plugin_main.go.txt")
+
+	large := make([]byte, 8<<20)
+	_, _ = rand.Read(large)
+	for _, data := range [][]byte{large, []byte("small"), nil} {
+		resp, err := plugger.CallShared[string](t.Context(), h, "checksum", data)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		s := sha256.Sum256(data)
+		if expect := hex.EncodeToString(s[:]); resp != expect {
+			t.Fatalf("expected checksum %q, got %q", expect, resp)
+		}
+	}
+}
+
+func TestCallSharedTimeout(t *testing.T) {
+	f := pluggertest.MakeModule(t, "test_call_shared_timeout",
+		"testdata/tshared_plugin_main.go.txt")
+	h := plugger.NewHost(plugger.WithCallTimeout(100 * time.Millisecond))
+	h.Configure(f, plugger.WithStderr(pluggertest.NewLogWriter(t)))
+	t.Cleanup(func() { _ = h.Close() })
+
+	_, err := plugger.CallShared[struct{}](t.Context(), h, "wait", []byte("data"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected DeadlineExceeded, got: %v", err)
+	}
+}
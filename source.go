@@ -0,0 +1,164 @@
+package plugger
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+const pluggerModule = "github.com/romshark/plugger"
+
+// BuildError is returned by RunPluginFromSource if the plugin source
+// failed to compile.
+type BuildError struct {
+	Output string // Output of the go toolchain.
+}
+
+func (e *BuildError) Error() string {
+	return ErrPluginBuildFailed.Error() + ": " + e.Output
+}
+
+// Unwrap returns ErrPluginBuildFailed.
+func (e *BuildError) Unwrap() error { return ErrPluginBuildFailed }
+
+// RunPluginFromSource is like RunPlugin but runs the main package read
+// from src, for example generated code. The source is compiled in a
+// temporary module requiring the version of plugger the host is built
+// with, resolved from the local plugger source where available.
+// Other dependencies are resolved by the go toolchain.
+// Returns a BuildError if the source fails to compile.
+// Temporary files are removed once the plugin stopped or failed to start.
+func (h *Host) RunPluginFromSource(
+	ctx context.Context, src io.Reader, pluginStderr io.WriteCloser,
+	opts ...RunOption,
+) error {
+	bin, cleanup, err := buildSource(ctx, src, newRunConfig("", nil, opts))
+	if err != nil {
+		h.lock.Lock()
+		h.startErr = err
+		h.lock.Unlock()
+		h.signalReady() // Unblock Call waiters.
+		if pluginStderr != nil {
+			// Signal no more logs just like RunPlugin.
+			if errClose := pluginStderr.Close(); errClose != nil {
+				err = errors.Join(err,
+					fmt.Errorf("closing plugin stderr: %w", errClose))
+			}
+		}
+		return err
+	}
+	defer cleanup()
+	return h.RunPlugin(ctx, bin, pluginStderr, opts...)
+}
+
+// buildSource compiles the main package read from src into
+// a temporary directory removed by cleanup.
+func buildSource(
+	ctx context.Context, src io.Reader, cfg *runConfig,
+) (bin string, cleanup func(), err error) {
+	if err := requireGo(); err != nil {
+		return "", nil, err
+	}
+	env, err := goBuildEnv(cfg)
+	if err != nil {
+		return "", nil, err
+	}
+	dir, err := os.MkdirTemp(cfg.goTmpDir, "plugger-source-")
+	if err != nil {
+		return "", nil, fmt.Errorf("creating module directory: %w", err)
+	}
+	remove := func() { _ = os.RemoveAll(dir) }
+	defer func() {
+		if err != nil {
+			remove()
+		}
+	}()
+
+	main, err := os.Create(filepath.Join(dir, "main.go"))
+	if err != nil {
+		return "", nil, fmt.Errorf("creating main file: %w", err)
+	}
+	_, err = io.Copy(main, src)
+	if errClose := main.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("writing main file: %w", err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "go.mod"), sourceGoMod(), 0o644)
+	if err != nil {
+		return "", nil, fmt.Errorf("writing go.mod: %w", err)
+	}
+
+	bin = filepath.Join(dir, "plugin")
+	if runtime.GOOS == "windows" {
+		bin += ".exe"
+	}
+	cmd := exec.CommandContext(ctx, "go", "build", "-mod=mod", "-o", bin, ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if ctx.Err() != nil {
+			return "", nil, causeErr(ctx)
+		}
+		if len(out) == 0 {
+			return "", nil, fmt.Errorf("running go build: %w", err)
+		}
+		return "", nil, &BuildError{Output: strings.TrimSpace(string(out))}
+	}
+	return bin, remove, nil
+}
+
+// sourceGoMod returns the go.mod of plugins built from source requiring
+// the plugger version of the running binary. The requirement is replaced
+// by the local plugger source if it's available, which avoids
+// downloading it and is the only option for development versions.
+func sourceGoMod() []byte {
+	version, replace := "v0.0.0", ""
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, m := range append([]*debug.Module{&info.Main}, info.Deps...) {
+			if m.Path != pluggerModule {
+				continue
+			}
+			if strings.HasPrefix(m.Version, "v") {
+				version = m.Version
+			}
+			if m.Replace != nil && filepath.IsAbs(m.Replace.Path) {
+				replace = m.Replace.Path // Replaced by a local directory.
+			}
+		}
+	}
+	if dir := sourceDir(); dir != "" {
+		replace = dir
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "module pluggersource\n\ngo 1.25\n\nrequire %s %s\n",
+		pluggerModule, version)
+	if replace != "" {
+		fmt.Fprintf(&b, "\nreplace %s => %s\n", pluggerModule, replace)
+	}
+	return b.Bytes()
+}
+
+// sourceDir returns the directory of the plugger source the running
+// binary was built from, "" if it's not available.
+func sourceDir() string {
+	_, file, _, ok := runtime.Caller(0)
+	if !ok || !filepath.IsAbs(file) { // Built with -trimpath.
+		return ""
+	}
+	dir := filepath.Dir(file)
+	if _, err := os.Stat(filepath.Join(dir, "go.mod")); err != nil {
+		return ""
+	}
+	return dir
+}
@@ -0,0 +1,71 @@
+package plugger_test
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/romshark/plugger"
+	"github.com/romshark/plugger/pluggertest"
+)
+
+func TestRunPluginFromSource(t *testing.T) {
+	tmpDir := t.TempDir()
+	src, err := os.Open("testdata/t1_plugin_main.go.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = src.Close() }()
+
+	h := plugger.NewHost()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- h.RunPluginFromSource(t.Context(), src,
+			pluggertest.NewLogWriter(t), plugger.WithGoBuildDirs(tmpDir, ""))
+	}()
+	testPlugin(t, h)
+	if err := h.Close(); err != nil {
+		t.Fatalf("closing host: %v", err)
+	}
+	<-errs
+	expectEmptyDir(t, tmpDir)
+}
+
+func TestRunPluginFromSourceBuildFailed(t *testing.T) {
+	tmpDir := t.TempDir()
+	src := strings.NewReader("package main\n\nfunc main() { undefinedFunc() }\n")
+
+	h := plugger.NewHost()
+	err := h.RunPluginFromSource(t.Context(), src,
+		pluggertest.NewLogWriter(t), plugger.WithGoBuildDirs(tmpDir, ""))
+	if !errors.Is(err, plugger.ErrPluginBuildFailed) {
+		t.Fatalf("expected ErrPluginBuildFailed, got: %v", err)
+	}
+	var errBuild *plugger.BuildError
+	if !errors.As(err, &errBuild) || !strings.Contains(errBuild.Output, "undefinedFunc") {
+		t.Fatalf("expected BuildError naming the undefined function, got: %v", err)
+	}
+	expectEmptyDir(t, tmpDir)
+
+	// Calls don't wait for a plugin that failed to build.
+	_, err = plugger.Call[struct{}, struct{}](t.Context(), h, "add", struct{}{})
+	if !errors.Is(err, plugger.ErrClosed) {
+		t.Fatalf("expected ErrClosed, got: %v", err)
+	}
+	if !errors.Is(err, plugger.ErrStartFailed) ||
+		!errors.Is(err, plugger.ErrPluginBuildFailed) {
+		t.Fatalf("expected ErrStartFailed, got: %v", err)
+	}
+}
+
+func expectEmptyDir(t *testing.T, dir string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected temporary files to be removed, found: %v", entries)
+	}
+}
@@ -0,0 +1,100 @@
+package plugger
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// WithStack annotates err with the stack trace of the caller.
+// The trace is sent to the host only if enabled by
+// Plugin.SetIncludeStacks and surfaces as StackTraceError.
+// Returns nil if err is nil.
+func WithStack(err error) error {
+	if err == nil {
+		return nil
+	}
+	var pcs [32]uintptr
+	n := runtime.Callers(2, pcs[:])
+	return &stackError{err: err, pcs: pcs[:n]}
+}
+
+// stackError is an error annotated by WithStack.
+type stackError struct {
+	err error
+	pcs []uintptr
+}
+
+func (e *stackError) Error() string { return e.err.Error() }
+func (e *stackError) Unwrap() error { return e.err }
+
+// trace formats the stack trace like runtime/debug.Stack does.
+func (e *stackError) trace() string {
+	var b strings.Builder
+	frames := runtime.CallersFrames(e.pcs)
+	for {
+		f, more := frames.Next()
+		fmt.Fprintf(&b, "%s\n\t%s:%d\n", f.Function, f.File, f.Line)
+		if !more {
+			break
+		}
+	}
+	return b.String()
+}
+
+// SetIncludeStacks sets whether stack traces of errors annotated
+// with WithStack are sent to the host. Disabled by default since traces
+// expose internals of the plugin, enable it for development only.
+// Safe to use from handlers.
+func (p *Plugin) SetIncludeStacks(include bool) { p.includeStacks.Store(include) }
+
+// errorStack returns the stack trace of err to send to the host,
+// "" if there is none or it must not be sent.
+func (p *Plugin) errorStack(err error) string {
+	if !p.includeStacks.Load() || !p.hasFeature(FeatureErrorStack) {
+		return ""
+	}
+	var s *stackError
+	if !errors.As(err, &s) {
+		return ""
+	}
+	return s.trace()
+}
+
+// StackTraceError is returned by calls instead of ErrorResponse
+// if the plugin included the stack trace of the error (see WithStack).
+type StackTraceError struct {
+	Response ErrorResponse
+	Trace    string
+}
+
+func (e *StackTraceError) Error() string { return string(e.Response) }
+
+// Unwrap returns the ErrorResponse.
+func (e *StackTraceError) Unwrap() error { return e.Response }
+
+// StackTrace returns the stack trace captured by the plugin.
+func (e *StackTraceError) StackTrace() string { return e.Trace }
+
+// responseError returns the error of an error response.
+func responseError(ev envelope) error {
+	var err error = ErrorResponse(ev.Error)
+	if ev.Stack != "" {
+		err = &StackTraceError{Response: ErrorResponse(ev.Error), Trace: ev.Stack}
+	}
+	if code := errorCodes[ev.Code]; code != nil {
+		if ev.Stack == "" && ev.Error == code.Error() {
+			err = code // For example ErrPaused, see Plugin.Pause.
+		} else {
+			err = &codedError{err: err, code: code}
+		}
+	}
+	if ev.Retry > 0 {
+		err = &RetryAfterError{
+			Err: err, After: time.Duration(ev.Retry) * time.Millisecond,
+		}
+	}
+	return err
+}
@@ -0,0 +1,41 @@
+package plugger_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/romshark/plugger"
+	"github.com/romshark/plugger/pluggertest"
+)
+
+func TestWithStack(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_with_stack",
+		"testdata/tstack_plugin_main.go.txt")
+
+	_, err := plugger.Call[struct{}, struct{}](t.Context(), h, "fail", struct{}{})
+	if err != plugger.ErrorResponse("boom") {
+		t.Fatalf("expected error response without stack, got: %#v", err)
+	}
+
+	if _, err := plugger.Call[bool, struct{}](
+		t.Context(), h, "include_stacks", true,
+	); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = plugger.Call[struct{}, struct{}](t.Context(), h, "fail", struct{}{})
+	var errStack *plugger.StackTraceError
+	if !errors.As(err, &errStack) {
+		t.Fatalf("expected StackTraceError, got: %#v", err)
+	}
+	if err.Error() != "boom" {
+		t.Fatalf("unexpected message: %q", err.Error())
+	}
+	if !errors.Is(err, plugger.ErrorResponse("boom")) {
+		t.Fatalf("expected to unwrap to the error response, got: %#v", err)
+	}
+	if trace := errStack.StackTrace(); !strings.HasPrefix(trace, "main.fail\n") ||
+		!strings.Contains(trace, "main.main.func1\n") {
+		t.Fatalf("unexpected stack trace:\n%s", trace)
+	}
+}
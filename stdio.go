@@ -0,0 +1,78 @@
+package plugger
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// envProtocolFDs tells the plugin which file descriptors carry
+// the protocol if not stdin and stdout. Format: "<requests>,<responses>".
+const envProtocolFDs = "PLUGGER_PROTOCOL_FDS"
+
+// WithStdio connects the plugin's stdin and stdout to stdin and stdout
+// (e.g. os.Stdin and os.Stdout to let the plugin interact with
+// the terminal) and moves the protocol to a pair of pipes passed to the
+// plugin as file descriptors 3 (requests) and 4 (responses).
+// Plugins built with this package pick them up automatically,
+// other executables must read the PLUGGER_PROTOCOL_FDS environment variable.
+// Not supported on Windows, RunPlugin returns ErrStdioUnsupported there.
+func WithStdio(stdin io.Reader, stdout io.Writer) RunOption {
+	return func(c *runConfig) {
+		c.stdio = true
+		c.stdin, c.stdout = stdin, stdout
+	}
+}
+
+// WithPluginIO makes the plugin speak the protocol over in and out
+// instead of stdin and stdout, for example to run it in-process in tests.
+// If out has a Flush method, like *bufio.Writer, it's flushed after every
+// message written (see NewPlugin).
+func WithPluginIO(in io.Reader, out io.Writer) PluginOption {
+	return func(c *pluginConfig) { c.in, c.out = in, out }
+}
+
+// protocolPipes connects cmd's stdin and stdout to stdin and stdout
+// and returns the ends of the protocol pipes used by the host.
+// closeChildEnds must be called once cmd was started.
+func protocolPipes(cmd *exec.Cmd, stdin io.Reader, stdout io.Writer) (
+	requests io.WriteCloser, responses io.ReadCloser,
+	closeChildEnds func(), err error,
+) {
+	if runtime.GOOS == "windows" {
+		return nil, nil, nil, ErrStdioUnsupported
+	}
+	reqR, reqW, err := os.Pipe()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("creating request pipe: %w", err)
+	}
+	respR, respW, err := os.Pipe()
+	if err != nil {
+		_, _ = reqR.Close(), reqW.Close()
+		return nil, nil, nil, fmt.Errorf("creating response pipe: %w", err)
+	}
+	cmd.Stdin, cmd.Stdout = stdin, stdout
+	cmd.ExtraFiles = []*os.File{reqR, respW} // fd 3 and 4
+	cmd.Env = append(os.Environ(), envProtocolFDs+"=3,4")
+	return reqW, respR, func() { _, _ = reqR.Close(), respW.Close() }, nil
+}
+
+// pluginIO returns the reader and writer the plugin speaks the protocol
+// over, which are stdin and stdout unless the host launched the plugin
+// with WithStdio.
+func pluginIO() (io.Reader, io.Writer) {
+	var in, out uintptr
+	v := os.Getenv(envProtocolFDs)
+	if v == "" {
+		return os.Stdin, os.Stdout
+	}
+	if _, err := fmt.Sscanf(v, "%d,%d", &in, &out); err != nil {
+		panic(fmt.Errorf("invalid %s: %q", envProtocolFDs, v))
+	}
+	// Don't pass the protocol on to processes launched by the plugin.
+	_ = os.Unsetenv(envProtocolFDs)
+	return os.NewFile(in, "plugger-requests"),
+		os.NewFile(out, "plugger-responses")
+}
@@ -0,0 +1,181 @@
+package plugger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"iter"
+)
+
+// CallStreamSummary sends a typed request to a streaming endpoint
+// registered with HandleStreamSummary. Stream items are delivered through
+// the returned channel which is closed once the stream ended.
+// The returned function blocks until the stream ended and returns
+// the final summary or the error that terminated the stream.
+// The item channel must be drained, canceling ctx aborts the stream.
+// Use WithReceiveBuffer to let slow consumers fall behind
+// without stalling other calls. Waiting for another call before
+// receiving the next item deadlocks once the buffer is full, since the
+// other call's response is stuck behind the items, so make such calls
+// from another goroutine or buffer enough items.
+func CallStreamSummary[Req, Item, Summary any](
+	ctx context.Context, h *Host, method string, req Req, opts ...CallOption,
+) (<-chan Item, func() (Summary, error)) {
+	items := make(chan Item)
+	done := make(chan struct{})
+	var summary Summary
+	var err error
+
+	raw, errMarshal := marshal(req)
+	if errMarshal != nil {
+		close(items)
+		return items, func() (Summary, error) {
+			return summary, fmt.Errorf("marshaling request: %w", errMarshal)
+		}
+	}
+
+	go func() {
+		defer close(done)
+		defer close(items)
+		var resp envelope
+		c := newCallConfig(opts)
+		resp, err = h.call(ctx, method, raw, c, func(raw json.RawMessage) error {
+			var item Item
+			if err := unmarshal(raw, &item, h.useNumber.Load()); err != nil {
+				return fmt.Errorf("%w: %w", ErrMalformedResponse, err)
+			}
+			select {
+			case items <- item:
+				return nil
+			case <-ctx.Done():
+				return causeErr(ctx)
+			}
+		})
+		if err != nil {
+			return
+		}
+		errUnmarshal := unmarshal(resp.Data, &summary, h.useNumber.Load())
+		if errUnmarshal != nil {
+			err = fmt.Errorf("%w: %w", ErrMalformedResponse, errUnmarshal)
+		}
+	}()
+
+	return items, func() (Summary, error) {
+		<-done
+		return summary, err
+	}
+}
+
+// HandleStreamSummary registers a streaming RPC endpoint overwriting any
+// existing endpoint. fn sends stream items through emit and returns
+// the final summary once done. emit returns an error if the request was
+// canceled and must not be used after fn returns.
+// Must be used before Run is invoked!
+func HandleStreamSummary[Req, Item, Summary any](
+	p *Plugin,
+	name string,
+	fn func(ctx context.Context, req Req, emit func(Item) error) (Summary, error),
+) {
+	p.handle(name, func(
+		ctx context.Context, _ RequestMeta, raw json.RawMessage,
+		emit func(any) error,
+	) (any, error) {
+		var req Req
+		if err := unmarshal(raw, &req, p.useNumber); err != nil {
+			var zero Summary
+			return zero, err
+		}
+		return fn(ctx, req, func(item Item) error { return emit(item) })
+	})
+}
+
+// CallStream is like CallStreamSummary but for streaming endpoints
+// without a summary, such as those registered with HandleSeq.
+// The returned function blocks until the stream ended and returns
+// the error that terminated the stream.
+func CallStream[Req, Item any](
+	ctx context.Context, h *Host, method string, req Req, opts ...CallOption,
+) (<-chan Item, func() error) {
+	items, result := CallStreamSummary[Req, Item, json.RawMessage](
+		ctx, h, method, req, opts...,
+	)
+	return items, func() error {
+		_, err := result()
+		return err
+	}
+}
+
+// CallSeq is like CallStream but returns the stream items as a sequence
+// yielding the error that terminated the stream, if any, as the last
+// element. Every iteration makes a new call, stopping the iteration early
+// aborts the stream.
+func CallSeq[Req, Item any](
+	ctx context.Context, h *Host, method string, req Req, opts ...CallOption,
+) iter.Seq2[Item, error] {
+	return func(yield func(Item, error) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		items, result := CallStream[Req, Item](ctx, h, method, req, opts...)
+		for item := range items {
+			if !yield(item, nil) {
+				cancel()
+				for range items { // Unblock the call.
+				}
+				_ = result()
+				return
+			}
+		}
+		if err := result(); err != nil {
+			var zero Item
+			yield(zero, err)
+		}
+	}
+}
+
+// HandleStream registers a streaming RPC endpoint without a summary
+// overwriting any existing endpoint. fn sends stream items through emit,
+// which returns an error if the request was canceled and must not be
+// used after fn returns. Hosts receive the items with CallStream or CallSeq.
+// Must be used before Run is invoked!
+func HandleStream[Req, Item any](
+	p *Plugin,
+	name string,
+	fn func(ctx context.Context, req Req, emit func(Item) error) error,
+) {
+	HandleStreamSummary(p, name, func(
+		ctx context.Context, req Req, emit func(Item) error,
+	) (struct{}, error) {
+		return struct{}{}, fn(ctx, req, emit)
+	})
+}
+
+// HandleSeq registers a streaming RPC endpoint overwriting any existing
+// endpoint. fn returns the sequence of stream items, each of which is
+// sent to the host as it's yielded. The stream ends once the sequence
+// ends or yields an error, which terminates the stream. The sequence
+// should stop once ctx is done, iterating stops anyway once the request
+// was canceled. Hosts receive the items with CallStream.
+// Must be used before Run is invoked!
+func HandleSeq[Req, Item any](
+	p *Plugin,
+	name string,
+	fn func(ctx context.Context, req Req) (iter.Seq2[Item, error], error),
+) {
+	HandleStreamSummary(p, name, func(
+		ctx context.Context, req Req, emit func(Item) error,
+	) (struct{}, error) {
+		seq, err := fn(ctx, req)
+		if err != nil {
+			return struct{}{}, err
+		}
+		for item, err := range seq {
+			if err != nil {
+				return struct{}{}, err
+			}
+			if err := emit(item); err != nil {
+				return struct{}{}, err
+			}
+		}
+		return struct{}{}, nil
+	})
+}
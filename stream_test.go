@@ -0,0 +1,359 @@
+package plugger_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync/atomic"
+	"testing"
+
+	"github.com/romshark/plugger"
+	"github.com/romshark/plugger/pluggertest"
+)
+
+type SearchReq struct {
+	N int `json:"n"`
+}
+
+type SearchItem struct {
+	I int `json:"i"`
+}
+
+type SearchSummary struct {
+	Total int `json:"total"`
+}
+
+func TestCallStreamSummary(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_stream_summary",
+		"testdata/tstream_plugin_main.go.txt")
+
+	items, result := plugger.CallStreamSummary[SearchReq, SearchItem, SearchSummary](
+		t.Context(), h, "search", SearchReq{N: 100},
+	)
+	expect := 0
+	for item := range items {
+		if item.I != expect {
+			t.Fatalf("expected item %d, got %d", expect, item.I)
+		}
+		expect++
+	}
+	if expect != 100 {
+		t.Fatalf("expected 100 items, got %d", expect)
+	}
+	summary, err := result()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if summary.Total != 100 {
+		t.Fatalf("unexpected summary: %#v", summary)
+	}
+
+	// The host remains usable after the stream ended.
+	items, result = plugger.CallStreamSummary[SearchReq, SearchItem, SearchSummary](
+		t.Context(), h, "search", SearchReq{N: 0},
+	)
+	for range items {
+		t.Fatal("unexpected item")
+	}
+	if summary, err := result(); err != nil || summary.Total != 0 {
+		t.Fatalf("unexpected result: %#v, %v", summary, err)
+	}
+}
+
+func TestCallStreamSummaryCancel(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_stream_summary_cancel",
+		"testdata/tstream_plugin_main.go.txt")
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	items, result := plugger.CallStreamSummary[struct{}, SearchItem, SearchSummary](
+		ctx, h, "endless", struct{}{},
+	)
+	for item := range items {
+		if item.I == 10 {
+			cancel()
+		}
+	}
+	if _, err := result(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got: %v", err)
+	}
+
+	// The canceled stream doesn't block other calls.
+	items, result = plugger.CallStreamSummary[SearchReq, SearchItem, SearchSummary](
+		t.Context(), h, "search", SearchReq{N: 3},
+	)
+	for range items {
+	}
+	if summary, err := result(); err != nil || summary.Total != 3 {
+		t.Fatalf("unexpected result: %#v, %v", summary, err)
+	}
+}
+
+func TestReceiveBuffer(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_receive_buffer",
+		"testdata/tstream_plugin_main.go.txt")
+
+	// Items of the first stream are buffered while it isn't consumed.
+	slowItems, slowResult := plugger.CallStreamSummary[
+		SearchReq, SearchItem, SearchSummary,
+	](t.Context(), h, "search", SearchReq{N: 50}, plugger.WithReceiveBuffer(64))
+
+	// The unconsumed stream doesn't stall the second stream.
+	items, result := plugger.CallStreamSummary[SearchReq, SearchItem, SearchSummary](
+		t.Context(), h, "search", SearchReq{N: 3},
+	)
+	for range items {
+	}
+	if summary, err := result(); err != nil || summary.Total != 3 {
+		t.Fatalf("unexpected result: %#v, %v", summary, err)
+	}
+
+	n := 0
+	for range slowItems {
+		n++
+	}
+	if summary, err := slowResult(); err != nil || summary.Total != 50 || n != 50 {
+		t.Fatalf("unexpected result: %d items, %#v, %v", n, summary, err)
+	}
+}
+
+func TestCallBinaryStream(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		opts []plugger.RunOption
+	}{
+		{"json", nil},
+		{"ndjson", []plugger.RunOption{plugger.WithNDJSON()}},
+		{"unbuffered", []plugger.RunOption{plugger.WithReadBufferSize(-1)}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _ := pluggertest.Launch(t, t.Context(), "test_binary_stream",
+				"testdata/tstream_plugin_main.go.txt", tt.opts...)
+
+			r, result := plugger.CallBinaryStream[SearchReq, SearchSummary](
+				t.Context(), h, "bytes", SearchReq{N: 100},
+			)
+			data, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(data) != 100*256 {
+				t.Fatalf("expected %d bytes, got %d", 100*256, len(data))
+			}
+			for i, b := range data {
+				if b != byte(i) {
+					t.Fatalf("unexpected byte %d at %d", b, i)
+				}
+			}
+			summary, err := result()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if summary.Total != len(data) {
+				t.Fatalf("unexpected summary: %#v", summary)
+			}
+			if !slices.Contains(h.Features(), plugger.FeatureBinaryFrames) {
+				t.Fatalf("binary frames not negotiated: %v", h.Features())
+			}
+
+			// Closing the reader aborts the stream.
+			r, result = plugger.CallBinaryStream[SearchReq, SearchSummary](
+				t.Context(), h, "bytes", SearchReq{N: 1 << 20},
+			)
+			if _, err := io.ReadFull(r, make([]byte, 1000)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			_ = r.Close()
+			if _, err := result(); !errors.Is(err, io.ErrClosedPipe) {
+				t.Fatalf("expected io.ErrClosedPipe, got: %v", err)
+			}
+
+			// Large writes are split into several frames.
+			const size = 3<<20 + 1
+			r, result = plugger.CallBinaryStream[SearchReq, SearchSummary](
+				t.Context(), h, "blob", SearchReq{N: size},
+			)
+			data, err = io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(data) != size || data[size-1] != byte((size-1)%256) {
+				t.Fatalf("unexpected data of %d bytes", len(data))
+			}
+			if summary, err := result(); err != nil || summary.Total != size {
+				t.Fatalf("unexpected result: %#v, %v", summary, err)
+			}
+
+			// JSON calls work in between binary frames.
+			testStreamHost(t, h)
+		})
+	}
+}
+
+func testStreamHost(t *testing.T, h *plugger.Host) {
+	t.Helper()
+	items, result := plugger.CallStreamSummary[SearchReq, SearchItem, SearchSummary](
+		t.Context(), h, "search", SearchReq{N: 10},
+	)
+	for range items {
+	}
+	if summary, err := result(); err != nil || summary.Total != 10 {
+		t.Fatalf("unexpected result: %#v, %v", summary, err)
+	}
+}
+
+func TestHandleSeq(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_handle_seq",
+		"testdata/tstream_plugin_main.go.txt")
+
+	items, result := plugger.CallStream[SearchReq, SearchItem](
+		t.Context(), h, "seq", SearchReq{N: 50},
+	)
+	expect := 0
+	for item := range items {
+		if item.I != expect {
+			t.Fatalf("expected item %d, got %d", expect, item.I)
+		}
+		expect++
+	}
+	if err := result(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expect != 50 {
+		t.Fatalf("expected 50 items, got %d", expect)
+	}
+
+	for n, msg := range map[int]string{-1: "failed", 0: "no items requested"} {
+		items, result = plugger.CallStream[SearchReq, SearchItem](
+			t.Context(), h, "seq", SearchReq{N: n},
+		)
+		for range items {
+		}
+		if err := result(); !errors.Is(err, plugger.ErrorResponse(msg)) {
+			t.Fatalf("expected error %q, got: %v", msg, err)
+		}
+	}
+}
+
+func TestCallSeq(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_call_seq",
+		"testdata/tstream_plugin_main.go.txt")
+
+	expect := 0
+	for i, err := range plugger.CallSeq[int, int](t.Context(), h, "ints", 1000) {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if i != expect {
+			t.Fatalf("expected item %d, got %d", expect, i)
+		}
+		expect++
+	}
+	if expect != 1000 {
+		t.Fatalf("expected 1000 items, got %d", expect)
+	}
+
+	// Stopping the iteration stops the plugin's producer.
+	for i, err := range plugger.CallSeq[int, int](t.Context(), h, "ints", -1) {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if i == 10 {
+			break
+		}
+	}
+	if !eventually(func() bool {
+		n, err := plugger.Call[struct{}, int64](t.Context(), h, "canceled", struct{}{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return n == 1
+	}) {
+		t.Fatal("producer wasn't canceled")
+	}
+
+	var errs []error
+	for _, err := range plugger.CallSeq[int, int](t.Context(), h, "missing", 1) {
+		errs = append(errs, err)
+	}
+	if len(errs) != 1 || !errors.Is(errs[0], plugger.ErrorResponse("unknown method: missing")) {
+		t.Fatalf("expected a single unknown method error, got: %v", errs)
+	}
+}
+
+func TestFlowControl(t *testing.T) {
+	var emitted atomic.Int32
+	conn := pluggertest.Serve(t, func(p *plugger.Plugin) {
+		plugger.HandleStreamSummary(p, "search",
+			func(
+				_ context.Context, r SearchReq, emit func(SearchItem) error,
+			) (SearchSummary, error) {
+				for i := range r.N {
+					if err := emit(SearchItem{I: i}); err != nil {
+						return SearchSummary{}, err
+					}
+					emitted.Add(1)
+				}
+				return SearchSummary{Total: r.N}, nil
+			})
+	})
+	conn.Send(`{"id":"1","method":"__handshake","data":{"features":["stream","flow_control"]}}`)
+	conn.Receive()
+
+	expectItems := func(from, to int) {
+		t.Helper()
+		for i := from; i < to; i++ {
+			expect := fmt.Sprintf(`{"id":"2","data":{"i":%d},"chunk":true}`, i)
+			if resp := string(conn.Receive()); resp != expect {
+				t.Fatalf("expected %s, got %s", expect, resp)
+			}
+		}
+		// The item is received before emit returns.
+		if !eventually(func() bool { return emitted.Load() >= int32(to) }) {
+			t.Fatal("item wasn't emitted")
+		}
+		if n := emitted.Load(); n != int32(to) {
+			t.Fatalf("expected %d items emitted, got %d", to, n)
+		}
+	}
+	conn.Send(`{"id":"2","method":"search","data":{"n":5},"credits":2}`)
+	expectItems(0, 2)
+	conn.Send(`{"credit":"2","credits":2}`)
+	expectItems(2, 4)
+	conn.Send(`{"credit":"2","credits":2}`)
+	expectItems(4, 5)
+	if resp := string(conn.Receive()); resp != `{"id":"2","data":{"total":5}}` {
+		t.Fatalf("unexpected response: %s", resp)
+	}
+}
+
+func TestFlowControlHost(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_flow_control",
+		"testdata/tstream_plugin_main.go.txt")
+
+	for _, lowWater := range []int{0, 1, 3} {
+		items, result := plugger.CallStreamSummary[SearchReq, SearchItem, SearchSummary](
+			t.Context(), h, "search", SearchReq{N: 100},
+			plugger.WithFlowControl(4, lowWater),
+		)
+		expect := 0
+		for item := range items {
+			if item.I != expect {
+				t.Fatalf("expected item %d, got %d", expect, item.I)
+			}
+			expect++
+		}
+		if expect != 100 {
+			t.Fatalf("expected 100 items, got %d", expect)
+		}
+		summary, err := result()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if summary.Total != 100 {
+			t.Fatalf("unexpected summary: %#v", summary)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package plugger
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// WithStrictStdout makes writes to os.Stdout outside the protocol fatal
+// instead of corrupting the protocol, which helps finding stray prints
+// during development. Requests in progress fail with an error response
+// naming the offending output and the plugin exits with code 2.
+// Only writes through the os.Stdout variable are detected, not writes
+// to file descriptor 1 by cgo code or processes inheriting it.
+// No-op if the host launched the plugin with WithStdio.
+func WithStrictStdout() PluginOption {
+	return func(c *pluginConfig) { c.strictStdout = true }
+}
+
+// guardStdout replaces os.Stdout with a pipe reporting any write
+// and returns the original stdout for the protocol.
+func (p *Plugin) guardStdout() io.Writer {
+	protocol := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		panic(fmt.Errorf("guarding stdout: %w", err))
+	}
+	os.Stdout = w
+	go func() {
+		b := make([]byte, 256)
+		n, err := r.Read(b)
+		if err != nil {
+			return
+		}
+		p.failStrayStdout(b[:n])
+	}()
+	return protocol
+}
+
+// failStrayStdout fails all requests in progress and exits.
+func (p *Plugin) failStrayStdout(output []byte) {
+	const exitCode = 2
+	p.exitCode.Store(exitCode) // In case Run returns first.
+	msg := fmt.Sprintf("protocol corruption: plugin wrote to stdout: %q", output)
+	fmt.Fprintln(os.Stderr, "plugger: "+msg)
+
+	p.lockCancel.Lock()
+	ids := make([]string, 0, len(p.cancel))
+	for id := range p.cancel {
+		ids = append(ids, id)
+	}
+	p.lockCancel.Unlock()
+
+	p.lockEnc.Lock() // Held until exit, no more responses.
+	for _, id := range ids {
+		_ = p.enc.Encode(envelope{ID: id, Error: msg})
+	}
+	p.flush()
+	os.Exit(exitCode)
+}
+
+// SetStrictProtocol sets whether malformed envelopes sent by the host
+// end Run, which is the default. Otherwise malformed envelopes are
+// logged to stderr and skipped, which keeps the plugin running despite
+// a buggy host. Envelopes without an ID and NDJSON frames that aren't
+// a single envelope (see WithPluginNDJSON) can be skipped, other
+// malformed JSON leaves the stream unreadable and still ends Run.
+// Safe to use from handlers.
+func (p *Plugin) SetStrictProtocol(strict bool) { p.lenientProtocol.Store(!strict) }
+
+// skipMalformed reports whether the malformed envelope is skipped
+// instead of panicking, logging why it's malformed.
+func (p *Plugin) skipMalformed(reason string) bool {
+	if !p.lenientProtocol.Load() {
+		return false
+	}
+	fmt.Fprintln(os.Stderr, "plugger: skipping malformed envelope: "+reason)
+	return true
+}
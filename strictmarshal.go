@@ -0,0 +1,99 @@
+package plugger
+
+import (
+	"cmp"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// SetStrictMarshal makes Call, CallH and CallWithLogs verify that
+// requests survive marshaling before sending them: the marshaled request
+// is unmarshaled into a new value of the request type, which must equal
+// the original. Calls fail with ErrNonRoundTrippable naming the differing
+// fields otherwise, which catches lossy custom marshalers (see
+// RegisterMarshaler) and values encoding/json can't see, such as structs
+// without exported fields. Fields tagged `json:"-"` are never sent and
+// thus not compared.
+// Meant for development and tests, since it more than doubles the cost
+// of marshaling requests.
+func (h *Host) SetStrictMarshal(strict bool) { h.strictMarshal.Store(strict) }
+
+// checkRoundTrip returns ErrNonRoundTrippable if raw,
+// the marshaled v, doesn't unmarshal into a value equal to v.
+func checkRoundTrip[T any](v T, raw []byte) error {
+	var back T
+	if err := unmarshal(raw, &back, false); err != nil {
+		return fmt.Errorf("%w: %w", ErrNonRoundTrippable, err)
+	}
+	diff := diffFields(reflect.ValueOf(&v).Elem(), reflect.ValueOf(&back).Elem(), "")
+	if len(diff) > 0 {
+		return fmt.Errorf("%w: %T: %s differ",
+			ErrNonRoundTrippable, v, strings.Join(diff, ", "))
+	}
+	return nil
+}
+
+// diffFields returns the paths of the marshaled fields that differ
+// between a and b of the same type, or "value" if a and b
+// are leaves (see isLeaf) and differ.
+func diffFields(a, b reflect.Value, path string) []string {
+	if isLeaf(a.Type()) {
+		if leafEqual(a, b) {
+			return nil
+		}
+		return []string{cmp.Or(path, "value")}
+	}
+	var diff []string
+	for i := range a.NumField() {
+		f := a.Type().Field(i)
+		if !f.IsExported() || f.Tag.Get("json") == "-" {
+			continue // Never marshaled by encoding/json.
+		}
+		name := f.Name
+		if path != "" {
+			name = path + "." + name
+		}
+		diff = append(diff, diffFields(a.Field(i), b.Field(i), name)...)
+	}
+	return diff
+}
+
+var (
+	typeJSONMarshaler = reflect.TypeFor[json.Marshaler]()
+	typeTextMarshaler = reflect.TypeFor[encoding.TextMarshaler]()
+)
+
+// isLeaf reports whether values of t are compared as a whole rather
+// than field by field: non-structs, structs marshaling themselves
+// like time.Time and structs without exported fields, whose state
+// encoding/json can't see.
+func isLeaf(t reflect.Type) bool {
+	if t.Kind() != reflect.Struct {
+		return true
+	}
+	if p := reflect.PointerTo(t); p.Implements(typeJSONMarshaler) ||
+		p.Implements(typeTextMarshaler) {
+		return true
+	}
+	for i := range t.NumField() {
+		if t.Field(i).IsExported() {
+			return false
+		}
+	}
+	return true
+}
+
+// leafEqual reports whether a and b are equal using their
+// Equal method if they have one, which ignores state marshaling
+// never preserves, such as the monotonic clock of time.Time.
+func leafEqual(a, b reflect.Value) bool {
+	if m := a.MethodByName("Equal"); m.IsValid() &&
+		m.Type().NumIn() == 1 && m.Type().In(0) == a.Type() &&
+		m.Type().NumOut() == 1 && m.Type().Out(0).Kind() == reflect.Bool {
+		return m.Call([]reflect.Value{b})[0].Bool()
+	}
+	return reflect.DeepEqual(a.Interface(), b.Interface())
+}
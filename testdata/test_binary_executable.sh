@@ -0,0 +1,18 @@
+#!/usr/bin/env bash
+set -euo pipefail
+
+# Accepts the handshake with binary frames and responds to any other
+# request with a binary frame announcing more data than allowed.
+while IFS= read -r line; do
+	[[ -z $line ]] && continue
+
+	id=$(jq -r '.id // empty' <<<"$line")
+	[[ -z $id ]] && continue
+	method=$(jq -r '.method // empty' <<<"$line")
+
+	if [[ $method == __handshake ]]; then
+		printf '{"id":"%s","data":{"features":["stream","binary_frames"]}}\n' "$id"
+		continue
+	fi
+	printf 'b{"id":"%s","chunk":true,"binary":1000000000}\n' "$id"
+done
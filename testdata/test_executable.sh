@@ -31,6 +31,11 @@ while IFS= read -r line; do
 		fi
 		printf '{"id":"%s","data":{"sum":%s}}\n' "$id" "$sum"
 		;;
+	  env)
+		# Handle method "env" returning the variable named by the request.
+		name=$(jq -r '.' <<<"$data")
+		printf '{"id":"%s","data":%s}\n' "$id" "$(jq -n --arg v "${!name:-}" '$v')"
+		;;
 	  simulated_error)
 	   	# Handle method "simulated_error".
 		printf '{"id":"%s","err":"simulated error"}\n' "$id"
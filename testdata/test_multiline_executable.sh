@@ -0,0 +1,12 @@
+#!/usr/bin/env bash
+set -euo pipefail
+
+# Responds to every request with its method name
+# writing each response across multiple lines.
+while IFS= read -r line; do
+	[[ -z $line ]] && continue
+	id=$(jq -e -r '.id' <<<"$line" 2>/dev/null || true)
+	[[ -z $id ]] && continue # Cancellation or malformed, skip.
+	method=$(jq -r '.method // empty' <<<"$line")
+	printf '{\n  "id": "%s",\n  "data": "%s"\n}\n' "$id" "$method"
+done
@@ -0,0 +1,14 @@
+#!/usr/bin/env bash
+set -euo pipefail
+
+# Responds to method "add" only, requests of other methods are ignored.
+while IFS= read -r line; do
+	[[ -z $line ]] && continue
+
+	method=$(jq -r '.method // empty' <<<"$line" 2>/dev/null || true)
+	[[ $method != add ]] && continue
+
+	id=$(jq -r '.id' <<<"$line")
+	sum=$(jq -c '.data.a + .data.b' <<<"$line")
+	printf '{"id":"%s","data":{"sum":%s}}\n' "$id" "$sum"
+done
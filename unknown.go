@@ -0,0 +1,77 @@
+package plugger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// UnknownMethodPolicy defines how the plugin handles requests
+// for methods without an endpoint.
+type UnknownMethodPolicy int
+
+const (
+	// UnknownMethodError responds with the error "unknown method: <method>",
+	// which the host returns as ErrorResponse. This is the default.
+	UnknownMethodError UnknownMethodPolicy = iota
+
+	// UnknownMethodFallback passes the request to the handler registered
+	// with Plugin.HandleFallback, the response of which the host
+	// receives as if the method existed. Behaves like UnknownMethodError
+	// if there is no fallback handler.
+	UnknownMethodFallback
+
+	// UnknownMethodDrop logs the request to stderr without responding.
+	// The call on the host blocks until its context is canceled.
+	UnknownMethodDrop
+
+	// UnknownMethodPanic panics crashing the plugin.
+	// Pending calls on the host return ErrClosed.
+	UnknownMethodPanic
+)
+
+// SetUnknownMethodPolicy sets how requests for unknown methods are handled.
+// Must be used before Run is invoked!
+func (p *Plugin) SetUnknownMethodPolicy(policy UnknownMethodPolicy) {
+	if p.running.Load() {
+		panic("set the unknown method policy before invoking Run")
+	}
+	p.unknownPolicy = policy
+}
+
+// HandleFallback registers fn to handle requests for unknown methods
+// if the policy is UnknownMethodFallback. The response data is
+// marshaled like responses of regular endpoints.
+// Must be used before Run is invoked!
+func (p *Plugin) HandleFallback(
+	fn func(ctx context.Context, meta RequestMeta, data json.RawMessage) (any, error),
+) {
+	if p.running.Load() {
+		panic("add handlers before invoking Run")
+	}
+	p.fallback = func(
+		ctx context.Context, meta RequestMeta, data json.RawMessage,
+		_ func(any) error,
+	) (any, error) {
+		return fn(ctx, meta, data)
+	}
+}
+
+// unknownMethod returns the endpoint handling a request for
+// an unknown method according to the policy, nil if the request
+// must be answered with an error response.
+// Returns drop=true if the request must not be answered.
+func (p *Plugin) unknownMethod(ev envelope) (fn endpoint, drop bool) {
+	switch p.unknownPolicy {
+	case UnknownMethodFallback:
+		return p.fallback, false
+	case UnknownMethodDrop:
+		fmt.Fprintf(os.Stderr, "plugger: dropped request %s for unknown method %q\n",
+			ev.ID, ev.Method)
+		return nil, true
+	case UnknownMethodPanic:
+		panic(fmt.Errorf("unknown method: %q", ev.Method))
+	}
+	return nil, false
+}
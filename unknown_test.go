@@ -0,0 +1,68 @@
+package plugger_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/romshark/plugger"
+	"github.com/romshark/plugger/pluggertest"
+)
+
+func TestUnknownMethodPolicy(t *testing.T) {
+	launch := func(t *testing.T, policy string) *plugger.Host {
+		t.Setenv("TEST_UNKNOWN_METHOD_POLICY", policy)
+		h, _ := pluggertest.Launch(t, t.Context(), "test_unknown_method_policy",
+			"testdata/tunknown_plugin_main.go.txt")
+		return h
+	}
+
+	t.Run("error", func(t *testing.T) {
+		h := launch(t, "")
+		_, err := plugger.Call[int, int](t.Context(), h, "nope", 1)
+		if err != plugger.ErrorResponse("unknown method: nope") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		h := launch(t, "fallback")
+		type Resp struct {
+			Method string          `json:"method"`
+			Data   json.RawMessage `json:"data"`
+		}
+		resp, err := plugger.Call[int, Resp](t.Context(), h, "nope", 42)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if resp.Method != "nope" || string(resp.Data) != "42" {
+			t.Fatalf("unexpected response: %#v", resp)
+		}
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		h := launch(t, "drop")
+		ctx, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+		defer cancel()
+		_, err := plugger.Call[int, int](ctx, h, "nope", 1)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected DeadlineExceeded, got: %v", err)
+		}
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		t.Setenv("TEST_UNKNOWN_METHOD_POLICY", "panic")
+		f := pluggertest.MakeModule(t, "test_unknown_method_policy",
+			"testdata/tunknown_plugin_main.go.txt")
+		h := plugger.NewHost()
+		go func() { _ = h.RunPlugin(t.Context(), f, nil, plugger.WithStderr(io.Discard)) }()
+		defer func() { _ = h.Close() }()
+		_, err := plugger.Call[int, int](t.Context(), h, "nope", 1)
+		if !errors.Is(err, plugger.ErrClosed) {
+			t.Fatalf("expected ErrClosed, got: %v", err)
+		}
+	})
+}
@@ -0,0 +1,103 @@
+package plugger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// Tagged is a response value tagged with its variant.
+// Handlers return it to let hosts using CallVariant
+// tell different response shapes apart.
+type Tagged struct {
+	Variant string
+	Value   any
+}
+
+// Variant tags v with variant.
+func Variant(variant string, v any) Tagged {
+	return Tagged{Variant: variant, Value: v}
+}
+
+// CallVariant sends a typed request and passes the response data
+// to the decoder of the variant the plugin tagged the response with
+// (see Variant) and returns the variant. Responses that aren't tagged
+// are passed to the decoder registered for the empty variant "".
+// Returns ErrUnknownVariant if no decoder is registered for the variant
+// and ErrMalformedResponse if the decoder returns an error.
+func CallVariant[Req any](
+	ctx context.Context, h *Host, method string, req Req,
+	variants map[string]func(json.RawMessage) error, opts ...CallOption,
+) (variant string, err error) {
+	raw, err := marshal(req)
+	if err != nil {
+		return "", fmt.Errorf("marshaling request: %w", err)
+	}
+	resp, err := h.invoke(ctx, method, raw, newCallConfig(opts))
+	if err != nil {
+		return "", err
+	}
+	decode := variants[resp.Variant]
+	if decode == nil {
+		return resp.Variant, fmt.Errorf("%w: %q", ErrUnknownVariant, resp.Variant)
+	}
+	if err := decode(resp.Data); err != nil {
+		return resp.Variant, fmt.Errorf("%w: %w", ErrMalformedResponse, err)
+	}
+	return resp.Variant, nil
+}
+
+// UnionCases maps the variants of a response to the types of their values,
+// which implement the interface I, see CallUnion. Build the decoders with
+// Case.
+type UnionCases[I any] map[string]UnionCase[I]
+
+// UnionCase decodes the value of a variant of a response into I.
+// useNumber is set if the host decodes numbers as json.Number
+// (see WithUseNumber).
+type UnionCase[I any] func(data json.RawMessage, useNumber bool) (I, error)
+
+// Case returns the decoder of values of type V for UnionCases of
+// the interface I, which decodes like Call does, honoring marshalers
+// registered with RegisterMarshaler. Panics if V doesn't implement I.
+func Case[I, V any]() UnionCase[I] {
+	var zero V
+	if _, ok := any(zero).(I); !ok {
+		panic(fmt.Errorf("%v doesn't implement %v",
+			reflect.TypeFor[V](), reflect.TypeFor[I]()))
+	}
+	return func(data json.RawMessage, useNumber bool) (I, error) {
+		var v V
+		if err := unmarshal(data, &v, useNumber); err != nil {
+			var zero I
+			return zero, err
+		}
+		return any(v).(I), nil
+	}
+}
+
+// CallUnion is like CallVariant but decodes the response into the type
+// registered in cases for the variant the plugin tagged the response
+// with (see Variant) and returns it as I, which lets the caller handle
+// the variants with a type switch.
+func CallUnion[Req, I any](
+	ctx context.Context, h *Host, method string, req Req,
+	cases UnionCases[I], opts ...CallOption,
+) (I, error) {
+	var v I
+	useNumber := h.useNumber.Load()
+	variants := make(map[string]func(json.RawMessage) error, len(cases))
+	for variant, decode := range cases {
+		variants[variant] = func(data json.RawMessage) (err error) {
+			v, err = decode(data, useNumber)
+			return err
+		}
+	}
+	_, err := CallVariant(ctx, h, method, req, variants, opts...)
+	if err != nil {
+		var zero I
+		return zero, err
+	}
+	return v, nil
+}
@@ -0,0 +1,117 @@
+package plugger_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/romshark/plugger"
+	"github.com/romshark/plugger/pluggertest"
+)
+
+type ShapeReq struct {
+	Kind string `json:"kind"`
+}
+
+type Circle struct {
+	Radius int `json:"radius"`
+}
+
+type Square struct {
+	Side int `json:"side"`
+}
+
+func TestCallVariant(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_variant",
+		"testdata/tvariant_plugin_main.go.txt")
+
+	var circle Circle
+	var square Square
+	variants := map[string]func(json.RawMessage) error{
+		"circle": func(data json.RawMessage) error {
+			return json.Unmarshal(data, &circle)
+		},
+		"square": func(data json.RawMessage) error {
+			return json.Unmarshal(data, &square)
+		},
+	}
+
+	variant, err := plugger.CallVariant(
+		t.Context(), h, "shape", ShapeReq{Kind: "circle"}, variants,
+	)
+	if err != nil || variant != "circle" || circle.Radius != 2 {
+		t.Fatalf("unexpected result: %q, %#v, %v", variant, circle, err)
+	}
+
+	variant, err = plugger.CallVariant(
+		t.Context(), h, "shape", ShapeReq{Kind: "square"}, variants,
+	)
+	if err != nil || variant != "square" || square.Side != 3 {
+		t.Fatalf("unexpected result: %q, %#v, %v", variant, square, err)
+	}
+
+	variant, err = plugger.CallVariant(
+		t.Context(), h, "shape", ShapeReq{Kind: "triangle"}, variants,
+	)
+	if !errors.Is(err, plugger.ErrUnknownVariant) || variant != "triangle" {
+		t.Fatalf("unexpected result: %q, %v", variant, err)
+	}
+}
+
+type Shape interface{ Area() int }
+
+func (c Circle) Area() int { return 3 * c.Radius * c.Radius }
+func (s Square) Area() int { return s.Side * s.Side }
+
+type Measurement interface{ isMeasurement() }
+
+func (Celsius) isMeasurement() {}
+
+func TestCallUnion(t *testing.T) {
+	h, _ := pluggertest.Launch(t, t.Context(), "test_union",
+		"testdata/tvariant_plugin_main.go.txt")
+
+	cases := plugger.UnionCases[Shape]{
+		"circle": plugger.Case[Shape, Circle](),
+		"square": plugger.Case[Shape, Square](),
+	}
+	for kind, expect := range map[string]Shape{
+		"circle": Circle{Radius: 2},
+		"square": Square{Side: 3},
+	} {
+		shape, err := plugger.CallUnion(
+			t.Context(), h, "shape", ShapeReq{Kind: kind}, cases,
+		)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if shape != expect {
+			t.Fatalf("expected %#v, got %#v", expect, shape)
+		}
+	}
+
+	shape, err := plugger.CallUnion(
+		t.Context(), h, "shape", ShapeReq{Kind: "triangle"}, cases,
+	)
+	if !errors.Is(err, plugger.ErrUnknownVariant) || shape != nil {
+		t.Fatalf("unexpected result: %#v, %v", shape, err)
+	}
+
+	// Cases decode values with registered marshalers.
+	measurement, err := plugger.CallUnion(
+		t.Context(), h, "shape", ShapeReq{Kind: "temperature"},
+		plugger.UnionCases[Measurement]{
+			"celsius": plugger.Case[Measurement, Celsius](),
+		},
+	)
+	if err != nil || measurement != Celsius(21.5) {
+		t.Fatalf("unexpected result: %#v, %v", measurement, err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic for a type not implementing the union")
+		}
+	}()
+	plugger.Case[Shape, ShapeReq]()
+}